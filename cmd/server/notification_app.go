@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"new-client-notification-bot/config"
 	"new-client-notification-bot/internal/handlers"
 	"new-client-notification-bot/internal/services"
+	"new-client-notification-bot/internal/storage"
 	"new-client-notification-bot/pkg/logger"
 	"os"
 	"os/signal"
@@ -16,6 +18,7 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/limiter"
 	"github.com/gofiber/fiber/v2/middleware/recover"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 )
 
 func main() {
@@ -25,40 +28,141 @@ func main() {
 
 	customLogger := logger.NewLogger(logCfg)
 
-	cfg, err := config.NewBotConfig()
+	store, err := storage.NewBoltStore(config.NewStoreConfig().Path)
 	if err != nil {
-		customLogger.Fatal().Err(err).Msg("Failed to load bot config")
+		customLogger.Fatal().Err(err).Msg("failed to open notification store")
 	}
+	defer store.Close()
 
-	telegramBotService, err := services.NewTelegramBotService(cfg, customLogger)
+	channelsCfg := config.NewChannelsConfig()
+	channels := services.NewRegistry()
+	mute, err := services.NewMute(context.Background(), store)
 	if err != nil {
-		customLogger.Fatal().Err(err).Msg("failed to create telegram bot service")
+		customLogger.Fatal().Err(err).Msg("failed to load mute")
 	}
+	dispatchCtx, stopDispatch := context.WithCancel(context.Background())
+	// updatesDone is closed once the bot stops handling updates, so the
+	// store is not closed under a callback or a command.
+	updatesDone := make(chan struct{})
 
-	app := fiber.New()
+	var botCfg *config.BotConfig
+	var defaultChatID int64
+	if channelsCfg.Has(services.ChannelTelegram) {
+		botCfg, err = config.NewBotConfig()
+		if err != nil {
+			customLogger.Fatal().Err(err).Msg("Failed to load bot config")
+		}
+		defaultChatID = botCfg.ChatID
+	}
+
+	// Routes are loaded without Telegram too: their fallback chains apply to
+	// every channel.
+	routingCfg, err := config.NewRoutingConfig(defaultChatID)
+	if err != nil {
+		customLogger.Fatal().Err(err).Msg("failed to load routing config")
+	}
+
+	router, err := services.NewRouter(routingCfg)
+	if err != nil {
+		customLogger.Fatal().Err(err).Msg("failed to create notification router")
+	}
+
+	// Without Telegram there are no messages to edit or retract.
+	var manager services.NotificationManagerInterface
+	if botCfg != nil {
+		telegramBotService, err := services.NewTelegramBotService(botCfg, customLogger)
+		if err != nil {
+			customLogger.Fatal().Err(err).Msg("failed to create telegram bot service")
+		}
+
+		formatter := services.NewMessageFormatter(botCfg, config.NewTemplateConfig(), customLogger)
+		channels.Register(services.ChannelTelegram, services.NewTelegramNotifier(telegramBotService, store, router, formatter))
+
+		commands := services.NewCommands(telegramBotService, store, router, formatter, mute, customLogger)
+		updatesConsumer := services.NewUpdatesConsumer(telegramBotService, store, commands, customLogger)
+		go func() {
+			defer close(updatesDone)
+			updatesConsumer.Run(dispatchCtx)
+		}()
+
+		manager = services.NewNotificationManager(store, telegramBotService, formatter, customLogger)
+	} else {
+		close(updatesDone)
+	}
+
+	if channelsCfg.Has(services.ChannelEmail) {
+		emailCfg, err := config.NewEmailConfig()
+		if err != nil {
+			customLogger.Fatal().Err(err).Msg("failed to load email config")
+		}
+		channels.Register(services.ChannelEmail, services.NewEmailService(emailCfg, config.NewTemplateConfig(), customLogger))
+	}
+
+	if channelsCfg.Has(services.ChannelSlack) {
+		slackCfg, err := config.NewSlackConfig()
+		if err != nil {
+			customLogger.Fatal().Err(err).Msg("failed to load slack config")
+		}
+		channels.Register(services.ChannelSlack, services.NewSlackService(slackCfg, customLogger))
+	}
+
+	if channelsCfg.Has(services.ChannelWebhook) {
+		webhookCfg, err := config.NewWebhookConfig()
+		if err != nil {
+			customLogger.Fatal().Err(err).Msg("failed to load webhook config")
+		}
+		channels.Register(services.ChannelWebhook, services.NewWebhookService(webhookCfg, customLogger))
+	}
+
+	for _, name := range channelsCfg.Enabled {
+		if _, ok := channels.Get(name); !ok {
+			customLogger.Fatal().Str("channel", name).Msg("unknown notification channel")
+		}
+	}
+
+	chains := [][]string{routingCfg.DefaultFallback}
+	for _, route := range routingCfg.Routes {
+		chains = append(chains, route.Fallback)
+	}
+	for _, chain := range chains {
+		for _, name := range chain {
+			if !channelsCfg.Has(name) {
+				customLogger.Fatal().Str("channel", name).Msg("fallback channel is not enabled")
+			}
+		}
+	}
+
+	dispatcher := services.NewDispatcher(store, channels, router, mute, config.NewDispatcherConfig(), customLogger)
+	dispatchDone := make(chan struct{})
+	go func() {
+		defer close(dispatchDone)
+		dispatcher.Run(dispatchCtx)
+	}()
+
+	serverCfg, err := config.NewServerConfig()
+	if err != nil {
+		customLogger.Fatal().Err(err).Msg("failed to load server config")
+	}
+	app := fiber.New(fiber.Config{
+		BodyLimit: serverCfg.BodyLimit(),
+	})
 	app.Use(fiberzerolog.New(fiberzerolog.Config{
 		Logger: customLogger,
 	}))
 	app.Use(recover.New())
+	app.Use(requestid.New())
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: "*",
-		AllowMethods: "POST",
-	}))
-	app.Use(limiter.New(limiter.Config{
-		Max:        10,
-		Expiration: 60 * time.Second,
-		KeyGenerator: func(c *fiber.Ctx) string {
-			return c.IP()
-		},
-		LimitReached: func(c *fiber.Ctx) error {
-			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
-				"success": false,
-				"message": "too many requests",
-			})
-		},
+		AllowMethods: "GET,POST",
 	}))
+	// Requests with a valid API token skip the per-request budget, so a
+	// backend polling status does not run out of it for new leads. Batches
+	// are charged by the handler per lead instead. Requests with a wrong
+	// token are limited like any other.
+	app.Use(handlers.Authenticate(serverCfg.APIToken))
+	app.Use(newLimiter(10, handlers.Authorized))
 
-	handlers.NewNotificationHandler(app, telegramBotService, customLogger)
+	handlers.NewNotificationHandler(app, store, store, manager, serverCfg, customLogger)
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
@@ -73,5 +177,27 @@ func main() {
 	if err := app.Shutdown(); err != nil {
 		customLogger.Fatal().Err(err).Msg("failed to shutdown")
 	}
+	stopDispatch()
+	<-dispatchDone
+	<-updatesDone
+
+}
 
+// newLimiter allows max requests a minute from one IP, skipping the
+// requests next reports.
+func newLimiter(max int, next func(c *fiber.Ctx) bool) fiber.Handler {
+	return limiter.New(limiter.Config{
+		Next:       next,
+		Max:        max,
+		Expiration: 60 * time.Second,
+		KeyGenerator: func(c *fiber.Ctx) string {
+			return c.IP()
+		},
+		LimitReached: func(c *fiber.Ctx) error {
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"success": false,
+				"message": "too many requests",
+			})
+		},
+	})
 }
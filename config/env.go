@@ -1,17 +1,32 @@
 package config
 
 import (
+	"encoding/json"
 	"errors"
 	"log"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 type BotConfig struct {
-	BotToken string
-	ChatID   int64
+	BotToken         string
+	ChatID           int64
+	ParseMode        string
+	SendTimeout      time.Duration
+	RetryMaxAttempts int
+	RetryBaseDelay   time.Duration
+	RetryMaxDelay    time.Duration
+	// APIURL is the Bot API server, a self-hosted one or a fake in tests.
+	APIURL string
+	// Proxy, when set, is the HTTP or SOCKS5 proxy the Bot API is reached
+	// through.
+	Proxy *url.URL
 }
 
 type LogConfig struct {
@@ -19,6 +34,121 @@ type LogConfig struct {
 	Format string
 }
 
+type ServerConfig struct {
+	RequestTimeout time.Duration
+	// MaxAttachments and MaxAttachmentSize (in bytes) limit the files of a
+	// multipart request, and AttachmentTypes lists the MIME types allowed.
+	MaxAttachments    int
+	MaxAttachmentSize int64
+	AttachmentTypes   []string
+	// BatchMaxItems limits the leads of one batch request, and
+	// BatchRateLimit the leads per minute sent in batches from one IP.
+	BatchMaxItems  int
+	BatchRateLimit int
+	// IdempotencyTTL is how long the response to a request with an
+	// Idempotency-Key is kept for replay.
+	IdempotencyTTL time.Duration
+	// FormSuccessURL and FormErrorURL are where plain HTML form posts are
+	// redirected; a form may pick its own page in _redirect if the host is
+	// in FormRedirectHosts.
+	FormSuccessURL    string
+	FormErrorURL      string
+	FormRedirectHosts []string
+	// APIToken guards the lookup and changes of sent notifications; without
+	// it those routes are off.
+	APIToken string
+}
+
+type StoreConfig struct {
+	Path string
+}
+
+// TargetConfig is a chat, or a forum topic in it when ThreadID is set.
+type TargetConfig struct {
+	ChatID   int64 `json:"chat_id"`
+	ThreadID int   `json:"thread_id"`
+}
+
+type RouteConfig struct {
+	Name           string   `json:"name"`
+	CompanyPattern string   `json:"company_pattern"`
+	Keywords       []string `json:"keywords"`
+	Sources        []string `json:"sources"`
+	PhonePrefixes  []string `json:"phone_prefixes"`
+	ChatIDs        []int64  `json:"chat_ids"`
+	// Targets are chats or forum topics, on top of ChatIDs.
+	Targets []TargetConfig `json:"targets"`
+	// Fallback lists the channels tried one by one when the primary ones
+	// fail to deliver a lead of the route.
+	Fallback []string `json:"fallback"`
+	// ContactCard adds the client as a Telegram contact under the lead.
+	ContactCard bool `json:"contact_card"`
+}
+
+type RoutingConfig struct {
+	Routes             []RouteConfig  `json:"routes"`
+	DefaultChatIDs     []int64        `json:"default_chat_ids"`
+	DefaultTargets     []TargetConfig `json:"default_targets"`
+	DefaultFallback    []string       `json:"default_fallback"`
+	DefaultContactCard bool           `json:"default_contact_card"`
+}
+
+type TemplateConfig struct {
+	Dir string
+}
+
+const (
+	SMTPTLSNone     = "none"
+	SMTPTLSStartTLS = "starttls"
+	SMTPTLSImplicit = "tls"
+)
+
+type EmailConfig struct {
+	Host             string
+	Port             int
+	Username         string
+	Password         string
+	From             string
+	To               []string
+	TLSMode          string
+	Timeout          time.Duration
+	RetryMaxAttempts int
+	RetryBaseDelay   time.Duration
+	RetryMaxDelay    time.Duration
+}
+
+type SlackConfig struct {
+	WebhookURL       string
+	Timeout          time.Duration
+	RetryMaxAttempts int
+	RetryBaseDelay   time.Duration
+	RetryMaxDelay    time.Duration
+}
+
+type WebhookConfig struct {
+	URLs             []string
+	Secret           string
+	Timeout          time.Duration
+	RetryMaxAttempts int
+	RetryBaseDelay   time.Duration
+	RetryMaxDelay    time.Duration
+}
+
+// ChannelsConfig lists the channels notifications are delivered through.
+type ChannelsConfig struct {
+	Enabled []string
+}
+
+type DispatcherConfig struct {
+	Interval    time.Duration
+	BatchSize   int
+	MaxAttempts int
+	RetryCap    time.Duration
+	// FallbackAfter is how long a stage of a fallback chain may keep
+	// retrying before the next channel gets the lead.
+	FallbackAfter time.Duration
+}
+
 func Init() {
 	if err := godotenv.Load(); err != nil {
 		log.Fatal("Error loading .env file")
@@ -37,6 +167,28 @@ func getInt(key string, defaultString int) int {
 	return val
 }
 
+func getDuration(key string, defaultDuration time.Duration) time.Duration {
+	valStr := os.Getenv(key)
+
+	val, err := time.ParseDuration(valStr)
+	if err != nil {
+		return defaultDuration
+	}
+
+	return val
+}
+
+// getList reads a comma separated list, dropping empty items.
+func getList(key, defaultString string) []string {
+	var list []string
+	for _, item := range strings.Split(getString(key, defaultString), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func getString(key, defaultString string) string {
 	val := os.Getenv(key)
 	if val == "" {
@@ -55,15 +207,276 @@ func NewBotConfig() (*BotConfig, error) {
 		return nil, errors.New("bot chat id required")
 	}
 
+	parseMode, err := parseModeFromString(getString("BOT_PARSE_MODE", "plain"))
+	if err != nil {
+		return nil, err
+	}
+
+	apiURL := strings.TrimRight(getString("BOT_API_URL", "https://api.telegram.org"), "/")
+	u, err := url.Parse(apiURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, errors.New("invalid bot api url")
+	}
+
+	var proxy *url.URL
+	if raw := getString("BOT_PROXY_URL", ""); raw != "" {
+		proxy, err = url.Parse(raw)
+		if err != nil || !slices.Contains([]string{"http", "https", "socks5", "socks5h"}, proxy.Scheme) || proxy.Host == "" {
+			return nil, errors.New("invalid bot proxy url")
+		}
+	}
+
 	return &BotConfig{
-		BotToken: botToken,
-		ChatID:   int64(chatID),
+		BotToken:         botToken,
+		ChatID:           int64(chatID),
+		ParseMode:        parseMode,
+		SendTimeout:      getDuration("BOT_SEND_TIMEOUT", 30*time.Second),
+		RetryMaxAttempts: getInt("BOT_RETRY_MAX_ATTEMPTS", 3),
+		RetryBaseDelay:   getDuration("BOT_RETRY_BASE_DELAY", 500*time.Millisecond),
+		RetryMaxDelay:    getDuration("BOT_RETRY_MAX_DELAY", 10*time.Second),
+		APIURL:           apiURL,
+		Proxy:            proxy,
 	}, nil
 }
 
+// parseModeFromString maps a case-insensitive BOT_PARSE_MODE value to the
+// parse_mode the Bot API expects. Plain text is sent without a parse mode.
+func parseModeFromString(mode string) (string, error) {
+	switch strings.ToLower(mode) {
+	case "plain", "":
+		return "", nil
+	case "html":
+		return "HTML", nil
+	case "markdownv2":
+		return "MarkdownV2", nil
+	default:
+		return "", errors.New("unsupported bot parse mode")
+	}
+}
+
 func NewLogConfig() *LogConfig {
 	return &LogConfig{
 		Level:  getInt("LOG_LEVEL", 0),
 		Format: getString("LOG_FORMAT", "json"),
 	}
 }
+
+func NewServerConfig() (*ServerConfig, error) {
+	cfg := &ServerConfig{
+		RequestTimeout:    getDuration("REQUEST_TIMEOUT", 5*time.Second),
+		MaxAttachments:    getInt("ATTACHMENTS_MAX_FILES", 5),
+		MaxAttachmentSize: int64(getInt("ATTACHMENTS_MAX_SIZE", 10<<20)),
+		AttachmentTypes: getList("ATTACHMENTS_TYPES", strings.Join([]string{
+			"image/jpeg",
+			"image/png",
+			"application/pdf",
+			"text/plain",
+			"application/msword",
+			"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+			"application/vnd.ms-excel",
+			"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		}, ",")),
+		BatchMaxItems:     getInt("BATCH_MAX_ITEMS", 100),
+		BatchRateLimit:    getInt("BATCH_RATE_LIMIT", 200),
+		IdempotencyTTL:    getDuration("IDEMPOTENCY_TTL", 24*time.Hour),
+		FormSuccessURL:    getString("FORM_SUCCESS_URL", ""),
+		FormErrorURL:      getString("FORM_ERROR_URL", ""),
+		FormRedirectHosts: getList("FORM_REDIRECT_HOSTS", ""),
+		APIToken:          getString("API_TOKEN", ""),
+	}
+
+	if cfg.BatchRateLimit < cfg.BatchMaxItems {
+		return nil, errors.New("BATCH_RATE_LIMIT is less than BATCH_MAX_ITEMS")
+	}
+
+	for _, raw := range []string{cfg.FormSuccessURL, cfg.FormErrorURL} {
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, errors.New("invalid form redirect url")
+		}
+	}
+
+	return cfg, nil
+}
+
+// BodyLimit is the largest request body the server takes: every allowed
+// file at full size, plus room for the form fields. Handlers keep bodies
+// without files to a smaller limit.
+func (c *ServerConfig) BodyLimit() int {
+	return c.MaxAttachments*int(c.MaxAttachmentSize) + 1<<20
+}
+
+func NewStoreConfig() *StoreConfig {
+	return &StoreConfig{
+		Path: getString("STORE_PATH", "notifications.db"),
+	}
+}
+
+// NewRoutingConfig reads the routing table from the JSON file in ROUTES_FILE.
+// Without a file, or without default_chat_ids and default_targets in it,
+// leads that match no route go to defaultChatID. A defaultChatID of 0 means
+// Telegram is off, so routes may then have only a fallback chain.
+func NewRoutingConfig(defaultChatID int64) (*RoutingConfig, error) {
+	cfg := &RoutingConfig{}
+
+	if path := getString("ROUTES_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, route := range cfg.Routes {
+		if defaultChatID != 0 && len(route.ChatIDs) == 0 && len(route.Targets) == 0 {
+			return nil, errors.New("route " + route.Name + " has no chat ids")
+		}
+		for _, target := range route.Targets {
+			if target.ChatID == 0 {
+				return nil, errors.New("route " + route.Name + " has a target without chat id")
+			}
+		}
+		if hasDuplicates(route.Fallback) {
+			return nil, errors.New("route " + route.Name + " repeats a fallback channel")
+		}
+	}
+	if hasDuplicates(cfg.DefaultFallback) {
+		return nil, errors.New("default fallback repeats a channel")
+	}
+
+	for _, target := range cfg.DefaultTargets {
+		if target.ChatID == 0 {
+			return nil, errors.New("default target without chat id")
+		}
+	}
+
+	if len(cfg.DefaultChatIDs) == 0 && len(cfg.DefaultTargets) == 0 {
+		cfg.DefaultChatIDs = []int64{defaultChatID}
+	}
+
+	return cfg, nil
+}
+
+func NewTemplateConfig() *TemplateConfig {
+	return &TemplateConfig{
+		Dir: getString("TEMPLATE_DIR", ""),
+	}
+}
+
+func NewDispatcherConfig() *DispatcherConfig {
+	return &DispatcherConfig{
+		Interval:    getDuration("DISPATCH_INTERVAL", time.Second),
+		BatchSize:   getInt("DISPATCH_BATCH_SIZE", 10),
+		MaxAttempts: getInt("DISPATCH_MAX_ATTEMPTS", 50),
+		RetryCap:    getDuration("DISPATCH_RETRY_CAP", 5*time.Minute),
+		// Telegram being down for this long is rarely a blip.
+		FallbackAfter: getDuration("DISPATCH_FALLBACK_AFTER", 10*time.Minute),
+	}
+}
+
+func NewChannelsConfig() *ChannelsConfig {
+	return &ChannelsConfig{
+		Enabled: getList("CHANNELS", "telegram"),
+	}
+}
+
+func (c *ChannelsConfig) Has(name string) bool {
+	return slices.Contains(c.Enabled, name)
+}
+
+func hasDuplicates(values []string) bool {
+	for i, value := range values {
+		if slices.Contains(values[:i], value) {
+			return true
+		}
+	}
+	return false
+}
+
+func NewEmailConfig() (*EmailConfig, error) {
+	cfg := &EmailConfig{
+		Host:             getString("SMTP_HOST", ""),
+		Port:             getInt("SMTP_PORT", 587),
+		Username:         getString("SMTP_USERNAME", ""),
+		Password:         getString("SMTP_PASSWORD", ""),
+		From:             getString("SMTP_FROM", ""),
+		To:               getList("SMTP_TO", ""),
+		TLSMode:          strings.ToLower(getString("SMTP_TLS", SMTPTLSStartTLS)),
+		Timeout:          getDuration("SMTP_TIMEOUT", 30*time.Second),
+		RetryMaxAttempts: getInt("SMTP_RETRY_MAX_ATTEMPTS", 3),
+		RetryBaseDelay:   getDuration("SMTP_RETRY_BASE_DELAY", time.Second),
+		RetryMaxDelay:    getDuration("SMTP_RETRY_MAX_DELAY", 30*time.Second),
+	}
+
+	if cfg.Host == "" {
+		return nil, errors.New("smtp host required")
+	}
+	if cfg.From == "" {
+		return nil, errors.New("smtp sender required")
+	}
+	if len(cfg.To) == 0 {
+		return nil, errors.New("smtp recipients required")
+	}
+	switch cfg.TLSMode {
+	case SMTPTLSNone, SMTPTLSStartTLS, SMTPTLSImplicit:
+	default:
+		return nil, errors.New("unsupported smtp tls mode")
+	}
+	// net/smtp sends the password in the clear only to localhost, and
+	// refuses any other server on every single send.
+	if cfg.TLSMode == SMTPTLSNone && cfg.Username != "" && !slices.Contains([]string{"localhost", "127.0.0.1", "::1"}, cfg.Host) {
+		return nil, errors.New("smtp login requires tls unless the server is localhost")
+	}
+
+	return cfg, nil
+}
+
+func NewSlackConfig() (*SlackConfig, error) {
+	webhookURL := getString("SLACK_WEBHOOK_URL", "")
+	if webhookURL == "" {
+		return nil, errors.New("slack webhook url required")
+	}
+	u, err := url.Parse(webhookURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, errors.New("invalid slack webhook url")
+	}
+
+	return &SlackConfig{
+		WebhookURL:       webhookURL,
+		Timeout:          getDuration("SLACK_TIMEOUT", 10*time.Second),
+		RetryMaxAttempts: getInt("SLACK_RETRY_MAX_ATTEMPTS", 3),
+		RetryBaseDelay:   getDuration("SLACK_RETRY_BASE_DELAY", 500*time.Millisecond),
+		RetryMaxDelay:    getDuration("SLACK_RETRY_MAX_DELAY", 10*time.Second),
+	}, nil
+}
+
+func NewWebhookConfig() (*WebhookConfig, error) {
+	cfg := &WebhookConfig{
+		URLs:             getList("WEBHOOK_URLS", ""),
+		Secret:           getString("WEBHOOK_SECRET", ""),
+		Timeout:          getDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+		RetryMaxAttempts: getInt("WEBHOOK_RETRY_MAX_ATTEMPTS", 3),
+		RetryBaseDelay:   getDuration("WEBHOOK_RETRY_BASE_DELAY", 500*time.Millisecond),
+		RetryMaxDelay:    getDuration("WEBHOOK_RETRY_MAX_DELAY", 10*time.Second),
+	}
+
+	if len(cfg.URLs) == 0 {
+		return nil, errors.New("webhook urls required")
+	}
+	for _, raw := range cfg.URLs {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, errors.New("invalid webhook url")
+		}
+	}
+	if cfg.Secret == "" {
+		return nil, errors.New("webhook secret required")
+	}
+
+	return cfg, nil
+}
@@ -1,7 +1,52 @@
 package domain
 
+// Notification is a lead as posted by a form. Phone, company name and text
+// are required; everything after them is optional, so older clients that
+// only send those keep working.
 type Notification struct {
-	Phone            string `json:"phone"`
-	CompanyName      string `json:"company_name"`
-	NotificationText string `json:"notification_text"`
+	Phone            string `json:"phone" form:"phone"`
+	CompanyName      string `json:"company_name" form:"company_name"`
+	NotificationText string `json:"notification_text" form:"notification_text"`
+	Source           string `json:"source,omitempty" form:"source"`
+	ContactName      string `json:"contact_name,omitempty" form:"contact_name"`
+	Email            string `json:"email,omitempty" form:"email"`
+	// PreferredContact is how the client wants to be contacted, one of the
+	// Contact* values.
+	PreferredContact string `json:"preferred_contact,omitempty" form:"preferred_contact"`
+	PageURL          string `json:"page_url,omitempty" form:"page_url"`
+	UTMSource        string `json:"utm_source,omitempty" form:"utm_source"`
+	UTMMedium        string `json:"utm_medium,omitempty" form:"utm_medium"`
+	UTMCampaign      string `json:"utm_campaign,omitempty" form:"utm_campaign"`
+	UTMTerm          string `json:"utm_term,omitempty" form:"utm_term"`
+	UTMContent       string `json:"utm_content,omitempty" form:"utm_content"`
+	// CustomFields holds form-specific extras by name.
+	CustomFields map[string]string `json:"custom_fields,omitempty" form:"-"`
+}
+
+const (
+	ContactPhone    = "phone"
+	ContactEmail    = "email"
+	ContactTelegram = "telegram"
+	ContactWhatsApp = "whatsapp"
+)
+
+// ContactMethods lists the accepted values of PreferredContact.
+var ContactMethods = []string{ContactPhone, ContactEmail, ContactTelegram, ContactWhatsApp}
+
+// UTMParams returns the UTM parameters that are set, by parameter name, in
+// the usual order.
+func (n *Notification) UTMParams() [][2]string {
+	var params [][2]string
+	for _, param := range [][2]string{
+		{"utm_source", n.UTMSource},
+		{"utm_medium", n.UTMMedium},
+		{"utm_campaign", n.UTMCampaign},
+		{"utm_term", n.UTMTerm},
+		{"utm_content", n.UTMContent},
+	} {
+		if param[1] != "" {
+			params = append(params, param)
+		}
+	}
+	return params
 }
@@ -0,0 +1,116 @@
+package domain
+
+import "time"
+
+type NotificationStatus string
+
+const (
+	StatusQueued    NotificationStatus = "queued"
+	StatusDelivered NotificationStatus = "delivered"
+	StatusFailed    NotificationStatus = "failed"
+	StatusRetracted NotificationStatus = "retracted"
+	// StatusSkipped marks a delivery given up on because the notification
+	// fell back to the next channel of its chain.
+	StatusSkipped NotificationStatus = "skipped"
+)
+
+// Delivery tracks a notification for one recipient of one channel, such as
+// a Telegram chat.
+type Delivery struct {
+	Channel   string             `json:"channel"`
+	ChatID    int64              `json:"chat_id,omitempty"`
+	ThreadID  int                `json:"thread_id,omitempty"`
+	Recipient string             `json:"recipient,omitempty"`
+	Status    NotificationStatus `json:"status"`
+	Attempts  int                `json:"attempts"`
+	LastError string             `json:"last_error,omitempty"`
+	// ResponseStatus is the HTTP status of the last answer of a webhook.
+	ResponseStatus int `json:"response_status,omitempty"`
+	// MessageIDs are the Telegram messages the notification was sent as, one
+	// per chunk of a long message.
+	MessageIDs []int     `json:"message_ids,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	// Stage is 0 for the primary channels and n for the n-th fallback.
+	Stage int `json:"stage,omitempty"`
+	// AttachmentMessageIDs are the Telegram messages the attachments were
+	// sent as, kept apart from the text so edits leave them alone.
+	AttachmentMessageIDs []int `json:"attachment_message_ids,omitempty"`
+	// AttachmentError is why the attachments were not all sent. It does not
+	// fail the delivery: the lead itself went out.
+	AttachmentError string `json:"attachment_error,omitempty"`
+	// ContactMessageID is the contact card sent under the lead, if any.
+	ContactMessageID int `json:"contact_message_id,omitempty"`
+	// ContactError is why the contact card was not sent. Like
+	// AttachmentError, it does not fail the delivery.
+	ContactError string `json:"contact_error,omitempty"`
+	// History lists the attempts made, oldest first.
+	History []Attempt `json:"history,omitempty"`
+}
+
+// Attempt is one try to send a delivery.
+type Attempt struct {
+	At             time.Time `json:"at"`
+	Error          string    `json:"error,omitempty"`
+	ResponseStatus int       `json:"response_status,omitempty"`
+}
+
+// Attachment is a file sent along with a lead. Data is stored apart from the
+// record and only loaded when the file is sent.
+type Attachment struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Data        []byte `json:"-"`
+}
+
+// IdempotentRequest is a request made with an Idempotency-Key and the
+// response it got. Status is 0 while the request is still being handled.
+type IdempotentRequest struct {
+	Key    string `json:"key"`
+	Hash   string `json:"hash"`
+	Status int    `json:"status"`
+	Body   []byte `json:"body"`
+	// ContentType is the media type of Body, such as application/problem+json
+	// for validation errors.
+	ContentType string `json:"content_type,omitempty"`
+	// Location is where a redirect answer pointed, for form posts.
+	Location  string    `json:"location,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+const (
+	ActionTake   = "take"
+	ActionSpam   = "spam"
+	ActionCalled = "called"
+)
+
+// LeadAction is a button press on a lead message.
+type LeadAction struct {
+	Action   string    `json:"action"`
+	UserID   int64     `json:"user_id"`
+	Username string    `json:"username"`
+	ChatID   int64     `json:"chat_id"`
+	At       time.Time `json:"at"`
+}
+
+type NotificationRecord struct {
+	ID           string             `json:"id"`
+	Notification Notification       `json:"notification"`
+	ClientIP     string             `json:"client_ip"`
+	RequestID    string             `json:"request_id"`
+	Status       NotificationStatus `json:"status"`
+	Deliveries   []Delivery         `json:"deliveries"`
+	Actions      []LeadAction       `json:"actions,omitempty"`
+	Attempts     int                `json:"attempts"`
+	LastError    string             `json:"last_error,omitempty"`
+	NextAttempt  time.Time          `json:"next_attempt"`
+	CreatedAt    time.Time          `json:"created_at"`
+	UpdatedAt    time.Time          `json:"updated_at"`
+	// Fallback holds the channels still left to try, in order. The current
+	// stage is given up on at FallbackAt if nothing was delivered by then.
+	Fallback   []string  `json:"fallback,omitempty"`
+	FallbackAt time.Time `json:"fallback_at"`
+	// DeliveredVia lists the channels that delivered the notification.
+	DeliveredVia []string     `json:"delivered_via,omitempty"`
+	Attachments  []Attachment `json:"attachments,omitempty"`
+}
@@ -5,42 +5,161 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
+	"net/url"
 	"new-client-notification-bot/internal/domain"
+	"new-client-notification-bot/internal/services"
+	"new-client-notification-bot/internal/storage"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
 	"github.com/rs/zerolog"
 )
 
-type MockTelegramService struct {
-	shouldError  bool
-	errorMsg     string
-	sentMessages []string
+type MockNotificationStore struct {
+	shouldError bool
+	errorMsg    string
+	records     []*domain.NotificationRecord
+	idempotent  map[string]domain.IdempotentRequest
 }
 
-func (m *MockTelegramService) SendMessage(ctx context.Context, message string) error {
-	m.sentMessages = append(m.sentMessages, message)
+func (m *MockNotificationStore) Save(ctx context.Context, record *domain.NotificationRecord) error {
 	if m.shouldError {
 		return errors.New(m.errorMsg)
 	}
+	m.records = append(m.records, record)
 	return nil
 }
 
-func setupTestApp(telegramService *MockTelegramService) *fiber.App {
+func (m *MockNotificationStore) Modify(ctx context.Context, id string, fn func(record *domain.NotificationRecord) error) (*domain.NotificationRecord, error) {
+	record, err := m.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return record, fn(record)
+}
+
+func (m *MockNotificationStore) Get(ctx context.Context, id string) (*domain.NotificationRecord, error) {
+	for _, record := range m.records {
+		if record.ID == id {
+			return record, nil
+		}
+	}
+	return nil, storage.ErrNotFound
+}
+
+func (m *MockNotificationStore) Pending(ctx context.Context, now time.Time, limit int) ([]*domain.NotificationRecord, error) {
+	return nil, nil
+}
+
+func (m *MockNotificationStore) Recent(ctx context.Context, limit int, match func(record *domain.NotificationRecord) bool) ([]*domain.NotificationRecord, error) {
+	return nil, nil
+}
+
+func (m *MockNotificationStore) CountSince(ctx context.Context, since time.Time, match func(record *domain.NotificationRecord) bool) (int, error) {
+	return 0, nil
+}
+
+func (m *MockNotificationStore) Attachments(ctx context.Context, id string) ([]domain.Attachment, error) {
+	record, err := m.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return record.Attachments, nil
+}
+
+// Reserve ignores expiry; handler tests do not outlive a key.
+func (m *MockNotificationStore) Reserve(ctx context.Context, request domain.IdempotentRequest, now time.Time) (*domain.IdempotentRequest, error) {
+	if existing, ok := m.idempotent[request.Key]; ok {
+		return &existing, nil
+	}
+	if m.idempotent == nil {
+		m.idempotent = map[string]domain.IdempotentRequest{}
+	}
+	m.idempotent[request.Key] = request
+	return nil, nil
+}
+
+func (m *MockNotificationStore) Complete(ctx context.Context, request domain.IdempotentRequest) error {
+	m.idempotent[request.Key] = request
+	return nil
+}
+
+func (m *MockNotificationStore) Release(ctx context.Context, key string) error {
+	delete(m.idempotent, key)
+	return nil
+}
+
+type MockNotificationManager struct {
+	err     error
+	results []services.ChangeResult
+	updated map[string]domain.Notification
+	deleted []string
+}
+
+func (m *MockNotificationManager) Update(ctx context.Context, id string, notification domain.Notification) ([]services.ChangeResult, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.updated == nil {
+		m.updated = map[string]domain.Notification{}
+	}
+	m.updated[id] = notification
+	return m.results, nil
+}
+
+func (m *MockNotificationManager) Retract(ctx context.Context, id string) ([]services.ChangeResult, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	m.deleted = append(m.deleted, id)
+	return m.results, nil
+}
+
+// testAPIToken guards the batch, lookup and change routes of the test app.
+const testAPIToken = "test-token"
+
+func setupTestApp(store *MockNotificationStore) *fiber.App {
+	return setupTestAppWithManager(store, &MockNotificationManager{})
+}
+
+func setupTestAppWithManager(store *MockNotificationStore, manager *MockNotificationManager) *fiber.App {
 	app := fiber.New()
 
 	logger := zerolog.Nop()
 
 	handler := &Notification{
-		router:             app,
-		telegramBotService: telegramService,
-		logger:             &logger,
+		router:            app,
+		store:             store,
+		idempotency:       store,
+		manager:           manager,
+		requestTimeout:    time.Second,
+		idempotencyTTL:    time.Hour,
+		maxAttachments:    2,
+		maxAttachmentSize: 1024,
+		attachmentTypes:   []string{"image/png", "application/pdf", "text/plain"},
+		maxBodySize:       2048,
+		batchMaxItems:     3,
+		batchLimiter:      newItemLimiter(5, time.Minute),
+		apiToken:          testAPIToken,
+		logger:            &logger,
 	}
 
 	api := app.Group("/api/v1")
-	api.Post("/notification", handler.CreateNotification)
+	api.Post("/notification", handler.limitBody(true, handler.idempotent(handler.CreateNotification)))
+	api.Post("/notifications", handler.authorized(handler.limitBody(false, handler.idempotent(handler.CreateNotifications))))
+	api.Get("/notification/:id", handler.authorized(handler.GetNotification))
+	api.Patch("/notification/:id", handler.authorized(handler.limitBody(false, handler.UpdateNotification)))
+	api.Delete("/notification/:id", handler.authorized(handler.DeleteNotification))
 
 	return app
 }
@@ -49,7 +168,7 @@ func TestCreateNotification_Integration(t *testing.T) {
 	tests := []struct {
 		name             string
 		requestBody      domain.Notification
-		telegramError    bool
+		storeError       bool
 		expectedStatus   int
 		expectedResponse map[string]interface{}
 	}{
@@ -60,11 +179,11 @@ func TestCreateNotification_Integration(t *testing.T) {
 				CompanyName:      "Test Company",
 				NotificationText: "Test message",
 			},
-			telegramError:  false,
-			expectedStatus: http.StatusOK,
+			storeError:     false,
+			expectedStatus: http.StatusAccepted,
 			expectedResponse: map[string]interface{}{
 				"success": true,
-				"message": "sent message successfully",
+				"message": "notification accepted",
 			},
 		},
 		{
@@ -74,7 +193,7 @@ func TestCreateNotification_Integration(t *testing.T) {
 				CompanyName:      "Test Company",
 				NotificationText: "Test message",
 			},
-			telegramError:  false,
+			storeError:     false,
 			expectedStatus: http.StatusBadRequest,
 			expectedResponse: map[string]interface{}{
 				"success": false,
@@ -88,7 +207,7 @@ func TestCreateNotification_Integration(t *testing.T) {
 				CompanyName:      "Test Company",
 				NotificationText: "Test message",
 			},
-			telegramError:  false,
+			storeError:     false,
 			expectedStatus: http.StatusBadRequest,
 			expectedResponse: map[string]interface{}{
 				"success": false,
@@ -96,17 +215,17 @@ func TestCreateNotification_Integration(t *testing.T) {
 			},
 		},
 		{
-			name: "telegram service error",
+			name: "store error",
 			requestBody: domain.Notification{
 				Phone:            "+7 912 345 67 89",
 				CompanyName:      "Test Company",
 				NotificationText: "Test message",
 			},
-			telegramError:  true,
+			storeError:     true,
 			expectedStatus: http.StatusInternalServerError,
 			expectedResponse: map[string]interface{}{
 				"success": false,
-				"message": "failed to send message",
+				"message": "failed to store notification",
 			},
 		},
 		{
@@ -116,7 +235,7 @@ func TestCreateNotification_Integration(t *testing.T) {
 				CompanyName:      "Test Company",
 				NotificationText: string(make([]byte, 256)), // 256 символов
 			},
-			telegramError:  false,
+			storeError:     false,
 			expectedStatus: http.StatusBadRequest,
 			expectedResponse: map[string]interface{}{
 				"success": false,
@@ -127,12 +246,12 @@ func TestCreateNotification_Integration(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			mockTelegram := &MockTelegramService{
-				shouldError: tt.telegramError,
-				errorMsg:    "telegram API error",
+			mockStore := &MockNotificationStore{
+				shouldError: tt.storeError,
+				errorMsg:    "store error",
 			}
 
-			app := setupTestApp(mockTelegram)
+			app := setupTestApp(mockStore)
 
 			jsonBody, err := json.Marshal(tt.requestBody)
 			if err != nil {
@@ -165,14 +284,19 @@ func TestCreateNotification_Integration(t *testing.T) {
 				t.Errorf("Expected message %q, got %q", tt.expectedResponse["message"], response["message"])
 			}
 
-			if tt.expectedStatus == http.StatusOK {
-				if len(mockTelegram.sentMessages) == 0 {
-					t.Errorf("Expected message to be sent, but none was sent")
-				} else {
-					expectedMessage := "Клиент: Test Company;\nТелефон: +7 912 345 67 89;\nТекст обращение: Test message"
-					if mockTelegram.sentMessages[0] != expectedMessage {
-						t.Errorf("Expected message %q, got %q", expectedMessage, mockTelegram.sentMessages[0])
-					}
+			if tt.expectedStatus == http.StatusAccepted {
+				if len(mockStore.records) == 0 {
+					t.Fatalf("Expected notification to be stored, but none was stored")
+				}
+				record := mockStore.records[0]
+				if response["id"] != record.ID {
+					t.Errorf("Expected id %q, got %v", record.ID, response["id"])
+				}
+				if record.Status != domain.StatusQueued {
+					t.Errorf("Expected status %q, got %q", domain.StatusQueued, record.Status)
+				}
+				if !reflect.DeepEqual(record.Notification, tt.requestBody) {
+					t.Errorf("Expected notification %+v, got %+v", tt.requestBody, record.Notification)
 				}
 			}
 		})
@@ -180,8 +304,8 @@ func TestCreateNotification_Integration(t *testing.T) {
 }
 
 func TestCreateNotification_InvalidJSON(t *testing.T) {
-	mockTelegram := &MockTelegramService{}
-	app := setupTestApp(mockTelegram)
+	mockStore := &MockNotificationStore{}
+	app := setupTestApp(mockStore)
 
 	req := httptest.NewRequest(http.MethodPost, "/api/v1/notification", bytes.NewBufferString("invalid json"))
 	req.Header.Set("Content-Type", "application/json")
@@ -210,9 +334,563 @@ func TestCreateNotification_InvalidJSON(t *testing.T) {
 	}
 }
 
+func TestNotification_BodyLimit(t *testing.T) {
+	text := strings.Repeat("a", 2048)
+	lead := `{"phone":"+7 912 345 67 89","company_name":"Test Company","notification_text":"` + text + `"}`
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+	}{
+		{name: "json", method: http.MethodPost, path: "/api/v1/notification", contentType: "application/json", body: lead},
+		{name: "form", method: http.MethodPost, path: "/api/v1/notification", contentType: "application/x-www-form-urlencoded", body: "phone=%2B79123456789&company_name=Test&notification_text=" + text},
+		{name: "batch", method: http.MethodPost, path: "/api/v1/notifications", contentType: "application/json", body: "[" + lead + "]"},
+		{name: "change", method: http.MethodPatch, path: "/api/v1/notification/0001", contentType: "application/json", body: `{"notification_text":"` + text + `"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &MockNotificationStore{}
+			manager := &MockNotificationManager{}
+			app := setupTestAppWithManager(store, manager)
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			req.Header.Set("Authorization", "Bearer "+testAPIToken)
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusRequestEntityTooLarge {
+				t.Errorf("Expected status %d, got %d", http.StatusRequestEntityTooLarge, resp.StatusCode)
+			}
+			if len(store.records) != 0 || len(manager.updated) != 0 {
+				t.Errorf("expected nothing stored or changed")
+			}
+		})
+	}
+}
+
+type testFile struct {
+	name        string
+	contentType string
+	data        string
+}
+
+func newMultipartRequest(t *testing.T, files []testFile) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	fields := map[string]string{
+		"phone":             "+7 912 345 67 89",
+		"company_name":      "Test Company",
+		"notification_text": "Test message",
+	}
+	for name, value := range fields {
+		if err := writer.WriteField(name, value); err != nil {
+			t.Fatalf("Failed to write field: %v", err)
+		}
+	}
+	for _, file := range files {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="files"; filename="`+file.name+`"`)
+		header.Set("Content-Type", file.contentType)
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			t.Fatalf("Failed to create part: %v", err)
+		}
+		part.Write([]byte(file.data))
+	}
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/notification", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func TestCreateNotification_Attachments(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 16)
+	pdf := "%PDF-1.4\n%test"
+
+	tests := []struct {
+		name           string
+		files          []testFile
+		expectedStatus int
+		expectedFiles  []domain.Attachment
+	}{
+		{
+			name:           "no files",
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			name: "valid files",
+			files: []testFile{
+				{name: "../../brief.pdf", contentType: "application/pdf", data: pdf},
+				{name: "logo.png", contentType: "image/png", data: png},
+			},
+			expectedStatus: http.StatusAccepted,
+			expectedFiles: []domain.Attachment{
+				{Name: "brief.pdf", ContentType: "application/pdf", Size: int64(len(pdf))},
+				{Name: "logo.png", ContentType: "image/png", Size: int64(len(png))},
+			},
+		},
+		{
+			name: "body over the limit without files",
+			files: []testFile{
+				{name: "a.txt", contentType: "text/plain", data: strings.Repeat("a", 1024)},
+				{name: "b.txt", contentType: "text/plain", data: strings.Repeat("b", 1024)},
+			},
+			expectedStatus: http.StatusAccepted,
+			expectedFiles: []domain.Attachment{
+				{Name: "a.txt", ContentType: "text/plain", Size: 1024},
+				{Name: "b.txt", ContentType: "text/plain", Size: 1024},
+			},
+		},
+		{
+			name: "too many files",
+			files: []testFile{
+				{name: "a.txt", contentType: "text/plain", data: "a"},
+				{name: "b.txt", contentType: "text/plain", data: "b"},
+				{name: "c.txt", contentType: "text/plain", data: "c"},
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "file too large",
+			files:          []testFile{{name: "big.txt", contentType: "text/plain", data: strings.Repeat("a", 1025)}},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "type not allowed",
+			files:          []testFile{{name: "run.exe", contentType: "application/octet-stream", data: "MZ"}},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "content does not match type",
+			files:          []testFile{{name: "fake.pdf", contentType: "application/pdf", data: "<html></html>"}},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStore := &MockNotificationStore{}
+			app := setupTestApp(mockStore)
+
+			resp, err := app.Test(newMultipartRequest(t, tt.files))
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+			if tt.expectedStatus != http.StatusAccepted {
+				if len(mockStore.records) != 0 {
+					t.Errorf("Expected nothing to be stored, got %d records", len(mockStore.records))
+				}
+				return
+			}
+
+			if len(mockStore.records) != 1 {
+				t.Fatalf("Expected 1 stored record, got %d", len(mockStore.records))
+			}
+			record := mockStore.records[0]
+			if record.Notification.CompanyName != "Test Company" {
+				t.Errorf("Expected form fields to be parsed, got %+v", record.Notification)
+			}
+			if len(record.Attachments) != len(tt.expectedFiles) {
+				t.Fatalf("Expected %d attachments, got %d", len(tt.expectedFiles), len(record.Attachments))
+			}
+			for i, expected := range tt.expectedFiles {
+				got := record.Attachments[i]
+				if got.Name != expected.Name || got.ContentType != expected.ContentType || got.Size != expected.Size || int64(len(got.Data)) != expected.Size {
+					t.Errorf("Expected attachment %+v, got %+v", expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateNotifications_Integration(t *testing.T) {
+	valid := `{"phone":"+7 912 345 67 89","company_name":"Test Company","notification_text":"Test message"}`
+	invalid := `{"phone":"invalid phone","company_name":"Test Company","notification_text":"Test message"}`
+
+	tests := []struct {
+		name             string
+		body             string
+		storeError       bool
+		expectedStatus   int
+		expectedMessage  string
+		expectedResults  []bool
+		expectedAccepted int
+	}{
+		{
+			name:             "all accepted",
+			body:             "[" + valid + "," + valid + "]",
+			expectedStatus:   http.StatusAccepted,
+			expectedMessage:  "notifications accepted",
+			expectedResults:  []bool{true, true},
+			expectedAccepted: 2,
+		},
+		{
+			name:             "partial success",
+			body:             "[" + valid + "," + invalid + `,{"phone":42}]`,
+			expectedStatus:   http.StatusMultiStatus,
+			expectedMessage:  "some notifications accepted",
+			expectedResults:  []bool{true, false, false},
+			expectedAccepted: 1,
+		},
+		{
+			name:            "none valid",
+			body:            "[" + invalid + "]",
+			expectedStatus:  http.StatusBadRequest,
+			expectedMessage: "no notifications accepted",
+			expectedResults: []bool{false},
+		},
+		{
+			name:            "store error",
+			body:            "[" + valid + "]",
+			storeError:      true,
+			expectedStatus:  http.StatusInternalServerError,
+			expectedMessage: "failed to store notifications",
+			expectedResults: []bool{false},
+		},
+		{
+			name:            "too many items",
+			body:            "[" + strings.Repeat(valid+",", 3) + valid + "]",
+			expectedStatus:  http.StatusRequestEntityTooLarge,
+			expectedMessage: "batch too large, at most 3 notifications allowed",
+		},
+		{
+			name:            "empty batch",
+			body:            "[]",
+			expectedStatus:  http.StatusBadRequest,
+			expectedMessage: "failed to parse request",
+		},
+		{
+			name:            "not an array",
+			body:            valid,
+			expectedStatus:  http.StatusBadRequest,
+			expectedMessage: "failed to parse request",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStore := &MockNotificationStore{shouldError: tt.storeError, errorMsg: "store error"}
+			app := setupTestApp(mockStore)
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/notifications", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+testAPIToken)
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+
+			var response struct {
+				Success       bool          `json:"success"`
+				Message       string        `json:"message"`
+				Accepted      int           `json:"accepted"`
+				Notifications []batchResult `json:"notifications"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if response.Message != tt.expectedMessage {
+				t.Errorf("Expected message %q, got %q", tt.expectedMessage, response.Message)
+			}
+			if response.Accepted != tt.expectedAccepted || len(mockStore.records) != tt.expectedAccepted {
+				t.Errorf("Expected %d accepted, got %d with %d stored", tt.expectedAccepted, response.Accepted, len(mockStore.records))
+			}
+			if len(response.Notifications) != len(tt.expectedResults) {
+				t.Fatalf("Expected %d results, got %d", len(tt.expectedResults), len(response.Notifications))
+			}
+			for i, success := range tt.expectedResults {
+				result := response.Notifications[i]
+				if result.Index != i || result.Success != success || (result.ID != "") != success {
+					t.Errorf("Expected result %d success %v, got %+v", i, success, result)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateNotifications_ItemBudget(t *testing.T) {
+	valid := `{"phone":"+7 912 345 67 89","company_name":"Test Company","notification_text":"Test message"}`
+	mockStore := &MockNotificationStore{}
+	app := setupTestApp(mockStore)
+
+	// The budget of 5 leads a minute is charged per lead, not per batch.
+	for i, tt := range []struct {
+		items          int
+		expectedStatus int
+	}{
+		{items: 3, expectedStatus: http.StatusAccepted},
+		{items: 3, expectedStatus: http.StatusTooManyRequests},
+		{items: 2, expectedStatus: http.StatusAccepted},
+		{items: 1, expectedStatus: http.StatusTooManyRequests},
+	} {
+		body := "[" + strings.TrimSuffix(strings.Repeat(valid+",", tt.items), ",") + "]"
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/notifications", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+testAPIToken)
+		req.Header.Set("Idempotency-Key", "key-"+strconv.Itoa(i))
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Failed to execute request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.expectedStatus {
+			t.Errorf("batch %d: expected status %d, got %d", i, tt.expectedStatus, resp.StatusCode)
+		}
+	}
+
+	// A rate-limited batch can be retried with its key later.
+	if _, ok := mockStore.idempotent["key-1"]; ok {
+		t.Errorf("Expected the key of the rate-limited batch to be released")
+	}
+}
+
+func TestCreateNotification_Idempotency(t *testing.T) {
+	valid := `{"phone":"+7 912 345 67 89","company_name":"Test Company","notification_text":"Test message"}`
+	other := `{"phone":"+7 912 345 67 89","company_name":"Other Company","notification_text":"Test message"}`
+
+	post := func(app *fiber.App, key, body string) (*http.Response, map[string]interface{}) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/notification", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Failed to execute request: %v", err)
+		}
+		defer resp.Body.Close()
+		var response map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return resp, response
+	}
+
+	t.Run("repeat replays the response", func(t *testing.T) {
+		mockStore := &MockNotificationStore{}
+		app := setupTestApp(mockStore)
+
+		first, firstResponse := post(app, "key-1", valid)
+		second, secondResponse := post(app, "key-1", valid)
+		if first.StatusCode != http.StatusAccepted || second.StatusCode != http.StatusAccepted {
+			t.Fatalf("Expected both requests accepted, got %d and %d", first.StatusCode, second.StatusCode)
+		}
+		if secondResponse["id"] != firstResponse["id"] || second.Header.Get("Idempotent-Replayed") != "true" {
+			t.Errorf("Expected the first response replayed, got %v", secondResponse)
+		}
+		if len(mockStore.records) != 1 {
+			t.Errorf("Expected 1 stored record, got %d", len(mockStore.records))
+		}
+	})
+
+	t.Run("repeat replays a validation problem", func(t *testing.T) {
+		mockStore := &MockNotificationStore{}
+		app := setupTestApp(mockStore)
+		invalid := `{"phone":"12345","company_name":"Test Company","notification_text":"Test message"}`
+
+		first, firstResponse := post(app, "key-1", invalid)
+		second, secondResponse := post(app, "key-1", invalid)
+		if first.StatusCode != http.StatusBadRequest || second.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected both requests rejected, got %d and %d", first.StatusCode, second.StatusCode)
+		}
+		if contentType := second.Header.Get("Content-Type"); contentType != first.Header.Get("Content-Type") || contentType != mimeProblemJSON {
+			t.Errorf("Expected the replay as %s, got %q", mimeProblemJSON, contentType)
+		}
+		if second.Header.Get("Idempotent-Replayed") != "true" || secondResponse["detail"] != firstResponse["detail"] {
+			t.Errorf("Expected the first response replayed, got %v", secondResponse)
+		}
+	})
+
+	t.Run("different body", func(t *testing.T) {
+		mockStore := &MockNotificationStore{}
+		app := setupTestApp(mockStore)
+
+		post(app, "key-1", valid)
+		resp, response := post(app, "key-1", other)
+		if resp.StatusCode != http.StatusUnprocessableEntity || response["message"] != "idempotency key reused with a different request" {
+			t.Errorf("Expected 422, got %d %v", resp.StatusCode, response)
+		}
+		if len(mockStore.records) != 1 {
+			t.Errorf("Expected 1 stored record, got %d", len(mockStore.records))
+		}
+	})
+
+	t.Run("request in progress", func(t *testing.T) {
+		mockStore := &MockNotificationStore{}
+		app := setupTestApp(mockStore)
+
+		// Turn the stored response back into a reservation.
+		post(app, "key-1", valid)
+		hash := mockStore.idempotent["key-1"].Hash
+		mockStore.idempotent["key-1"] = domain.IdempotentRequest{Key: "key-1", Hash: hash}
+
+		resp, _ := post(app, "key-1", valid)
+		if resp.StatusCode != http.StatusConflict {
+			t.Errorf("Expected 409, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("server error is not kept", func(t *testing.T) {
+		mockStore := &MockNotificationStore{shouldError: true, errorMsg: "store error"}
+		app := setupTestApp(mockStore)
+
+		if resp, _ := post(app, "key-1", valid); resp.StatusCode != http.StatusInternalServerError {
+			t.Fatalf("Expected 500, got %d", resp.StatusCode)
+		}
+		mockStore.shouldError = false
+		if resp, _ := post(app, "key-1", valid); resp.StatusCode != http.StatusAccepted {
+			t.Errorf("Expected the retry to be accepted, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("multipart resent with a new boundary", func(t *testing.T) {
+		mockStore := &MockNotificationStore{}
+		app := setupTestApp(mockStore)
+		files := []testFile{{name: "brief.pdf", contentType: "application/pdf", data: "%PDF-1.4\n%test"}}
+
+		postMultipart := func(files []testFile) *http.Response {
+			t.Helper()
+			req := newMultipartRequest(t, files)
+			req.Header.Set("Idempotency-Key", "key-1")
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			resp.Body.Close()
+			return resp
+		}
+
+		// Every request gets its own random boundary.
+		postMultipart(files)
+		if resp := postMultipart(files); resp.StatusCode != http.StatusAccepted || resp.Header.Get("Idempotent-Replayed") != "true" {
+			t.Errorf("Expected the first response replayed, got %d", resp.StatusCode)
+		}
+		changed := []testFile{{name: "brief.pdf", contentType: "application/pdf", data: "%PDF-1.4\n%other"}}
+		if resp := postMultipart(changed); resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for a different file, got %d", resp.StatusCode)
+		}
+		if len(mockStore.records) != 1 {
+			t.Errorf("Expected 1 stored record, got %d", len(mockStore.records))
+		}
+	})
+
+	t.Run("json with reordered keys", func(t *testing.T) {
+		mockStore := &MockNotificationStore{}
+		app := setupTestApp(mockStore)
+
+		post(app, "key-1", valid)
+		reordered := `{ "notification_text":"Test message", "company_name":"Test Company", "phone":"+7 912 345 67 89" }`
+		if resp, _ := post(app, "key-1", reordered); resp.StatusCode != http.StatusAccepted || resp.Header.Get("Idempotent-Replayed") != "true" {
+			t.Errorf("Expected the first response replayed, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("without key", func(t *testing.T) {
+		mockStore := &MockNotificationStore{}
+		app := setupTestApp(mockStore)
+
+		post(app, "", valid)
+		post(app, "", valid)
+		if len(mockStore.records) != 2 || len(mockStore.idempotent) != 0 {
+			t.Errorf("Expected 2 records and no keys, got %d and %d", len(mockStore.records), len(mockStore.idempotent))
+		}
+	})
+}
+
+func TestCreateNotification_ValidationProblem(t *testing.T) {
+	tests := []struct {
+		name     string
+		request  func(t *testing.T) *http.Request
+		expected []fieldError
+	}{
+		{
+			name: "every invalid field is reported",
+			request: func(t *testing.T) *http.Request {
+				body := `{"phone":"12345","company_name":" ","notification_text":"` + strings.Repeat("a", 256) + `"}`
+				req := httptest.NewRequest(http.MethodPost, "/api/v1/notification", strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				return req
+			},
+			expected: []fieldError{
+				{Field: "company_name", Code: "required", Message: "company_name is required"},
+				{Field: "notification_text", Code: "too_long", Message: "notification_text too long"},
+				{Field: "phone", Code: "invalid_format", Message: "invalid phone"},
+			},
+		},
+		{
+			name: "attachments",
+			request: func(t *testing.T) *http.Request {
+				return newMultipartRequest(t, []testFile{
+					{name: "big.txt", contentType: "text/plain", data: strings.Repeat("a", 1025)},
+					{name: "fake.pdf", contentType: "application/pdf", data: "<html></html>"},
+				})
+			},
+			expected: []fieldError{
+				{Field: "files", Code: "too_large", Message: `file "big.txt" is larger than 1024 bytes`},
+				{Field: "files", Code: "content_mismatch", Message: `file "fake.pdf" is text/html, not application/pdf`},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := setupTestApp(&MockNotificationStore{})
+
+			resp, err := app.Test(tt.request(t))
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusBadRequest || resp.Header.Get("Content-Type") != "application/problem+json" {
+				t.Errorf("Expected 400 problem+json, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+			}
+
+			var problem struct {
+				Type   string       `json:"type"`
+				Title  string       `json:"title"`
+				Status int          `json:"status"`
+				Errors []fieldError `json:"errors"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&problem); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if problem.Type != "about:blank" || problem.Title != "Bad Request" || problem.Status != http.StatusBadRequest {
+				t.Errorf("Unexpected problem %+v", problem)
+			}
+			if !slices.Equal(problem.Errors, tt.expected) {
+				t.Errorf("Expected errors %+v, got %+v", tt.expected, problem.Errors)
+			}
+		})
+	}
+}
+
 func TestCreateNotification_WrongMethod(t *testing.T) {
-	mockTelegram := &MockTelegramService{}
-	app := setupTestApp(mockTelegram)
+	mockStore := &MockNotificationStore{}
+	app := setupTestApp(mockStore)
 
 	req := httptest.NewRequest(http.MethodGet, "/api/v1/notification", nil)
 
@@ -226,3 +904,512 @@ func TestCreateNotification_WrongMethod(t *testing.T) {
 		t.Errorf("Expected status %d, got %d", http.StatusMethodNotAllowed, resp.StatusCode)
 	}
 }
+
+func TestNotification_RequiresAPIToken(t *testing.T) {
+	manager := &MockNotificationManager{}
+	store := &MockNotificationStore{}
+	app := setupTestAppWithManager(store, manager)
+
+	for _, route := range []struct{ method, path string }{
+		{method: http.MethodPost, path: "/api/v1/notifications"},
+		{method: http.MethodGet, path: "/api/v1/notification/0001"},
+		{method: http.MethodPatch, path: "/api/v1/notification/0001"},
+		{method: http.MethodDelete, path: "/api/v1/notification/0001"},
+	} {
+		for _, header := range []string{"", "Bearer wrong-token", testAPIToken} {
+			body := `[{"phone":"+7 912 345 67 89","company_name":"Test Company","notification_text":"Test message"}]`
+			req := httptest.NewRequest(route.method, route.path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			if header != "" {
+				req.Header.Set("Authorization", header)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("%s %s with %q: expected status %d, got %d", route.method, route.path, header, http.StatusUnauthorized, resp.StatusCode)
+			}
+		}
+	}
+	if len(manager.updated) != 0 || len(manager.deleted) != 0 || len(store.records) != 0 {
+		t.Errorf("expected no changes, got %v, %v and %d stored", manager.updated, manager.deleted, len(store.records))
+	}
+}
+
+func TestAuthenticate_SkipsLimiterWithToken(t *testing.T) {
+	app := fiber.New()
+	app.Use(Authenticate(testAPIToken))
+	app.Use(limiter.New(limiter.Config{Max: 1, Expiration: time.Minute, Next: Authorized}))
+	app.Get("/api/v1/notification/:id", func(c *fiber.Ctx) error { return c.SendStatus(http.StatusOK) })
+
+	for i, tt := range []struct {
+		header         string
+		expectedStatus int
+	}{
+		{header: "Bearer wrong-token", expectedStatus: http.StatusOK},
+		{header: "Bearer wrong-token", expectedStatus: http.StatusTooManyRequests},
+		{header: "", expectedStatus: http.StatusTooManyRequests},
+		{header: "Bearer " + testAPIToken, expectedStatus: http.StatusOK},
+		{header: "Bearer " + testAPIToken, expectedStatus: http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/notification/0001", nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Failed to execute request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.expectedStatus {
+			t.Errorf("request %d with %q: expected status %d, got %d", i, tt.header, tt.expectedStatus, resp.StatusCode)
+		}
+	}
+}
+
+func TestChangeNotification_Integration(t *testing.T) {
+	validBody := `{"phone":"+79123456789","company_name":"Test Company","notification_text":"Corrected"}`
+
+	tests := []struct {
+		name            string
+		method          string
+		body            string
+		manager         *MockNotificationManager
+		expectedStatus  int
+		expectedMessage string
+	}{
+		{
+			name:            "update",
+			method:          http.MethodPatch,
+			body:            validBody,
+			manager:         &MockNotificationManager{results: []services.ChangeResult{{ChatID: 42, MessageIDs: []int{7}}}},
+			expectedStatus:  http.StatusOK,
+			expectedMessage: "notification updated",
+		},
+		{
+			name:            "update with invalid body",
+			method:          http.MethodPatch,
+			body:            `{"phone":"123","company_name":"Test Company","notification_text":"Corrected"}`,
+			manager:         &MockNotificationManager{},
+			expectedStatus:  http.StatusBadRequest,
+			expectedMessage: "failed to validate request",
+		},
+		{
+			name:            "update of retracted notification",
+			method:          http.MethodPatch,
+			body:            validBody,
+			manager:         &MockNotificationManager{err: services.ErrNotificationRetracted},
+			expectedStatus:  http.StatusConflict,
+			expectedMessage: "notification retracted",
+		},
+		{
+			name:            "telegram edit failed",
+			method:          http.MethodPatch,
+			body:            validBody,
+			manager:         &MockNotificationManager{results: []services.ChangeResult{{ChatID: 42, Error: "chat not found"}}},
+			expectedStatus:  http.StatusBadGateway,
+			expectedMessage: "failed to change telegram messages",
+		},
+		{
+			name:            "delete",
+			method:          http.MethodDelete,
+			manager:         &MockNotificationManager{results: []services.ChangeResult{{ChatID: 42, MessageIDs: []int{7}}}},
+			expectedStatus:  http.StatusOK,
+			expectedMessage: "notification retracted",
+		},
+		{
+			name:            "delete unknown notification",
+			method:          http.MethodDelete,
+			manager:         &MockNotificationManager{err: storage.ErrNotFound},
+			expectedStatus:  http.StatusNotFound,
+			expectedMessage: "notification not found",
+		},
+		{
+			name:            "store error",
+			method:          http.MethodDelete,
+			manager:         &MockNotificationManager{err: errors.New("store error")},
+			expectedStatus:  http.StatusInternalServerError,
+			expectedMessage: "failed to change notification",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := setupTestAppWithManager(&MockNotificationStore{}, tt.manager)
+
+			req := httptest.NewRequest(tt.method, "/api/v1/notification/0001", bytes.NewBufferString(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+testAPIToken)
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+
+			var response map[string]interface{}
+			if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if response["message"] != tt.expectedMessage {
+				t.Errorf("Expected message %q, got %q", tt.expectedMessage, response["message"])
+			}
+
+			if tt.expectedStatus == http.StatusOK {
+				if _, ok := response["deliveries"].([]interface{}); !ok {
+					t.Errorf("Expected deliveries in response, got %v", response)
+				}
+				updated := tt.manager.updated["0001"].NotificationText == "Corrected"
+				deleted := len(tt.manager.deleted) == 1 && tt.manager.deleted[0] == "0001"
+				if (tt.method == http.MethodPatch && !updated) || (tt.method == http.MethodDelete && !deleted) {
+					t.Errorf("Expected notification 0001 to be changed")
+				}
+			}
+		})
+	}
+}
+
+func TestGetNotification_Integration(t *testing.T) {
+	at := time.Date(2025, 1, 2, 10, 0, 0, 0, time.UTC)
+	store := &MockNotificationStore{records: []*domain.NotificationRecord{
+		{
+			ID:           "0001",
+			Status:       domain.StatusDelivered,
+			DeliveredVia: []string{"email"},
+			Deliveries: []domain.Delivery{
+				{Channel: "telegram", Status: domain.StatusFailed, LastError: "chat not found", Attempts: 1, History: []domain.Attempt{{At: at, Error: "chat not found"}}},
+				{Channel: "email", Stage: 1, Status: domain.StatusDelivered},
+				{Channel: "webhook", Stage: 1, Status: domain.StatusFailed, Recipient: "https://crm.example.com/hook", ResponseStatus: 502},
+			},
+		},
+		{ID: "0002", Status: domain.StatusQueued, Deliveries: []domain.Delivery{{Channel: "telegram", Status: domain.StatusQueued}}},
+		{ID: "0003", Status: domain.StatusQueued, Attempts: 1, Deliveries: []domain.Delivery{{Channel: "telegram", Status: domain.StatusQueued, Attempts: 1}}},
+		{ID: "0004", Status: domain.StatusRetracted},
+		{ID: "0005", Status: domain.StatusFailed},
+	}}
+
+	tests := []struct {
+		name           string
+		id             string
+		store          *MockNotificationStore
+		expectedStatus int
+		expectedBody   map[string]interface{}
+	}{
+		{
+			name:           "delivered through fallback",
+			id:             "0001",
+			store:          store,
+			expectedStatus: http.StatusOK,
+			expectedBody:   map[string]interface{}{"success": true, "id": "0001", "status": "delivered"},
+		},
+		{
+			name:           "queued",
+			id:             "0002",
+			store:          store,
+			expectedStatus: http.StatusOK,
+			expectedBody:   map[string]interface{}{"success": true, "status": "queued"},
+		},
+		{
+			name:           "retrying",
+			id:             "0003",
+			store:          store,
+			expectedStatus: http.StatusOK,
+			expectedBody:   map[string]interface{}{"success": true, "status": "sending"},
+		},
+		{
+			name:           "retracted",
+			id:             "0004",
+			store:          store,
+			expectedStatus: http.StatusOK,
+			expectedBody:   map[string]interface{}{"success": true, "status": "suppressed"},
+		},
+		{
+			name:           "failed",
+			id:             "0005",
+			store:          store,
+			expectedStatus: http.StatusOK,
+			expectedBody:   map[string]interface{}{"success": true, "status": "failed"},
+		},
+		{
+			name:           "unknown notification",
+			id:             "0009",
+			store:          store,
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   map[string]interface{}{"success": false, "message": "notification not found"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := setupTestApp(tt.store)
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/notification/"+tt.id, nil)
+			req.Header.Set("Authorization", "Bearer "+testAPIToken)
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+
+			var response map[string]interface{}
+			if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			for key, expected := range tt.expectedBody {
+				if response[key] != expected {
+					t.Errorf("Expected %s %v, got %v", key, expected, response[key])
+				}
+			}
+			if tt.id == "0001" {
+				via, _ := response["delivered_via"].([]interface{})
+				if len(via) != 1 || via[0] != "email" {
+					t.Errorf("Expected delivered via email, got %v", response["delivered_via"])
+				}
+
+				deliveries, _ := response["deliveries"].([]interface{})
+				if len(deliveries) != 3 {
+					t.Fatalf("Expected 3 deliveries, got %v", response["deliveries"])
+				}
+				telegram := deliveries[0].(map[string]interface{})
+				attempts, _ := telegram["attempts"].([]interface{})
+				if telegram["status"] != "failed" || len(attempts) != 1 {
+					t.Fatalf("Expected a failed telegram delivery with 1 attempt, got %v", telegram)
+				}
+				attempt := attempts[0].(map[string]interface{})
+				if attempt["at"] != "2025-01-02T10:00:00Z" || attempt["error"] != "chat not found" {
+					t.Errorf("Unexpected attempt %v", attempt)
+				}
+				if email := deliveries[1].(map[string]interface{}); email["stage"] != float64(1) {
+					t.Errorf("Expected the email delivery at stage 1, got %v", email)
+				}
+				if webhook := deliveries[2].(map[string]interface{}); webhook["response_status"] != float64(502) {
+					t.Errorf("Expected the webhook answer status 502, got %v", webhook)
+				}
+				if _, ok := telegram["response_status"]; ok {
+					t.Errorf("Expected no response status for telegram, got %v", telegram)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateNotification_FormRedirect(t *testing.T) {
+	valid := url.Values{
+		"phone":                 {"+7 912 345 67 89"},
+		"company_name":          {"Test Company"},
+		"notification_text":     {"Test message"},
+		"utm_source":            {"google"},
+		"custom_fields[budget]": {"100000"},
+	}
+	// with returns the valid form with the given key, value pairs set.
+	with := func(pairs ...string) url.Values {
+		form := url.Values{}
+		for k, v := range valid {
+			form[k] = v
+		}
+		for i := 0; i < len(pairs); i += 2 {
+			form.Set(pairs[i], pairs[i+1])
+		}
+		return form
+	}
+
+	tests := []struct {
+		name             string
+		form             url.Values
+		successURL       string
+		errorURL         string
+		storeError       bool
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{
+			name:             "accepted",
+			form:             valid,
+			successURL:       "https://example.com/thanks",
+			errorURL:         "https://example.com/oops",
+			expectedStatus:   http.StatusSeeOther,
+			expectedLocation: "https://example.com/thanks",
+		},
+		{
+			name:             "invalid fields",
+			form:             with("phone", "invalid phone"),
+			successURL:       "https://example.com/thanks",
+			errorURL:         "https://example.com/oops",
+			expectedStatus:   http.StatusSeeOther,
+			expectedLocation: "https://example.com/oops?error=validation_failed&fields=phone",
+		},
+		{
+			name:             "store failure",
+			form:             valid,
+			successURL:       "https://example.com/thanks",
+			errorURL:         "https://example.com/oops",
+			storeError:       true,
+			expectedStatus:   http.StatusSeeOther,
+			expectedLocation: "https://example.com/oops?error=internal_error",
+		},
+		{
+			name:             "error page defaults to success page",
+			form:             with("email", "not an email"),
+			successURL:       "https://example.com/thanks",
+			expectedStatus:   http.StatusSeeOther,
+			expectedLocation: "https://example.com/thanks?error=validation_failed&fields=email",
+		},
+		{
+			name:             "allowed redirect",
+			form:             with("company_name", "", formRedirectField, "https://promo.example.com/form?lang=ru"),
+			successURL:       "https://example.com/thanks",
+			expectedStatus:   http.StatusSeeOther,
+			expectedLocation: "https://promo.example.com/form?error=validation_failed&fields=company_name&lang=ru",
+		},
+		{
+			name:             "redirect to another host ignored",
+			form:             with(formRedirectField, "https://evil.example.net/"),
+			successURL:       "https://example.com/thanks",
+			expectedStatus:   http.StatusSeeOther,
+			expectedLocation: "https://example.com/thanks",
+		},
+		{
+			name:           "nowhere to redirect",
+			form:           valid,
+			expectedStatus: http.StatusAccepted,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStore := &MockNotificationStore{shouldError: tt.storeError, errorMsg: "store error"}
+			logger := zerolog.Nop()
+			handler := &Notification{
+				store:             mockStore,
+				idempotency:       mockStore,
+				requestTimeout:    time.Second,
+				formSuccessURL:    tt.successURL,
+				formErrorURL:      tt.errorURL,
+				formRedirectHosts: []string{"Promo.Example.com"},
+				logger:            &logger,
+			}
+			app := fiber.New()
+			app.Post("/api/v1/notification", handler.CreateNotification)
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/notification", strings.NewReader(tt.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+			if location := resp.Header.Get("Location"); location != tt.expectedLocation {
+				t.Errorf("Expected location %q, got %q", tt.expectedLocation, location)
+			}
+			if tt.expectedLocation == tt.successURL || tt.expectedStatus == http.StatusAccepted {
+				if len(mockStore.records) != 1 {
+					t.Fatalf("Expected notification to be stored, got %d", len(mockStore.records))
+				}
+				stored := mockStore.records[0].Notification
+				if stored.UTMSource != "google" || !reflect.DeepEqual(stored.CustomFields, map[string]string{"budget": "100000"}) {
+					t.Errorf("Unexpected notification %+v", stored)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateNotification_FormRedirectReplay(t *testing.T) {
+	form := url.Values{
+		"phone":             {"+7 912 345 67 89"},
+		"company_name":      {"Test Company"},
+		"notification_text": {"Test message"},
+	}
+	mockStore := &MockNotificationStore{}
+	logger := zerolog.Nop()
+	handler := &Notification{
+		store:          mockStore,
+		idempotency:    mockStore,
+		requestTimeout: time.Second,
+		idempotencyTTL: time.Hour,
+		formSuccessURL: "https://example.com/thanks",
+		logger:         &logger,
+	}
+	app := fiber.New()
+	app.Post("/api/v1/notification", handler.idempotent(handler.CreateNotification))
+
+	// A double-submitted form lands on the same page both times.
+	for i := range 2 {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/notification", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Idempotency-Key", "key-1")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Failed to execute request: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "https://example.com/thanks" {
+			t.Errorf("post %d: expected a redirect to the success page, got %d %q", i, resp.StatusCode, resp.Header.Get("Location"))
+		}
+		if replayed := resp.Header.Get("Idempotent-Replayed") == "true"; replayed != (i == 1) {
+			t.Errorf("post %d: unexpected Idempotent-Replayed %v", i, replayed)
+		}
+	}
+	if len(mockStore.records) != 1 {
+		t.Errorf("Expected 1 stored record, got %d", len(mockStore.records))
+	}
+}
+
+func TestCreateNotification_FormRedirectRetry(t *testing.T) {
+	form := url.Values{
+		"phone":             {"+7 912 345 67 89"},
+		"company_name":      {"Test Company"},
+		"notification_text": {"Test message"},
+	}
+	mockStore := &MockNotificationStore{shouldError: true, errorMsg: "store error"}
+	logger := zerolog.Nop()
+	handler := &Notification{
+		store:          mockStore,
+		idempotency:    mockStore,
+		requestTimeout: time.Second,
+		idempotencyTTL: time.Hour,
+		formSuccessURL: "https://example.com/thanks",
+		formErrorURL:   "https://example.com/error",
+		logger:         &logger,
+	}
+	app := fiber.New()
+	app.Post("/api/v1/notification", handler.idempotent(handler.CreateNotification))
+
+	// A form post that could not be stored is retried, not replayed.
+	for i, expectedLocation := range []string{"https://example.com/error?error=internal_error", "https://example.com/thanks"} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/notification", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Idempotency-Key", "key-1")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Failed to execute request: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != expectedLocation {
+			t.Errorf("post %d: expected a redirect to %q, got %d %q", i, expectedLocation, resp.StatusCode, resp.Header.Get("Location"))
+		}
+		if resp.Header.Get("Idempotent-Replayed") != "" {
+			t.Errorf("post %d: expected no replay", i)
+		}
+		mockStore.shouldError = false
+	}
+	if len(mockStore.records) != 1 {
+		t.Errorf("Expected 1 stored record, got %d", len(mockStore.records))
+	}
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// itemLimiter allows max items per window from one key. Unlike the request
+// limiter it charges a request by the items it carries, so a batch of a
+// hundred leads costs a hundred.
+type itemLimiter struct {
+	mu      sync.Mutex
+	max     int
+	window  time.Duration
+	windows map[string]*itemWindow
+}
+
+type itemWindow struct {
+	start time.Time
+	used  int
+}
+
+func newItemLimiter(max int, window time.Duration) *itemLimiter {
+	return &itemLimiter{
+		max:     max,
+		window:  window,
+		windows: make(map[string]*itemWindow),
+	}
+}
+
+// allow charges n items to key and reports whether they fit in its current
+// window. Items that do not fit are not charged.
+func (l *itemLimiter) allow(key string, n int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for k, w := range l.windows {
+		if now.Sub(w.start) >= l.window {
+			delete(l.windows, k)
+		}
+	}
+
+	w, ok := l.windows[key]
+	if !ok {
+		w = &itemWindow{start: now}
+		l.windows[key] = w
+	}
+	if w.used+n > l.max {
+		return false
+	}
+	w.used += n
+	return true
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestItemLimiter(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	limiter := newItemLimiter(5, time.Minute)
+
+	tests := []struct {
+		name     string
+		key      string
+		items    int
+		at       time.Time
+		expected bool
+	}{
+		{name: "batch within budget", key: "a", items: 3, at: start, expected: true},
+		{name: "batch over what is left", key: "a", items: 3, at: start.Add(time.Second), expected: false},
+		{name: "rejected batch is not charged", key: "a", items: 2, at: start.Add(2 * time.Second), expected: true},
+		{name: "budget used up", key: "a", items: 1, at: start.Add(3 * time.Second), expected: false},
+		{name: "other key has its own budget", key: "b", items: 5, at: start.Add(3 * time.Second), expected: true},
+		{name: "next window", key: "a", items: 5, at: start.Add(time.Minute), expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if allowed := limiter.allow(tt.key, tt.items, tt.at); allowed != tt.expected {
+				t.Errorf("allow() = %v, expected %v", allowed, tt.expected)
+			}
+		})
+	}
+}
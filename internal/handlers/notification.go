@@ -1,91 +1,1072 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"new-client-notification-bot/config"
 	"new-client-notification-bot/internal/domain"
 	"new-client-notification-bot/internal/services"
+	"new-client-notification-bot/internal/storage"
 	"regexp"
+	"slices"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 	"github.com/rs/zerolog"
 )
 
+// attachmentsField is the multipart field that carries the files.
+const attachmentsField = "files"
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// idempotentReplayedHeader marks a response replayed for a repeated
+	// Idempotency-Key.
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+)
+
+const (
+	// formRedirectField is the form field with the page to return to.
+	formRedirectField = "_redirect"
+	// customFieldPrefix starts the form fields that go to custom_fields, as
+	// in custom_fields[budget].
+	customFieldPrefix = "custom_fields["
+)
+
+// failedLocal marks a request that failed on the server although its answer,
+// a form redirect, does not say so with a 5xx status.
+const failedLocal = "failed"
+
+// Error codes put in the query string of a form redirect.
+const (
+	formErrorInvalid    = "invalid_request"
+	formErrorValidation = "validation_failed"
+	formErrorInternal   = "internal_error"
+)
+
 type Notification struct {
-	router             fiber.Router
-	telegramBotService services.TelegramBotServiceInterface
-	logger             *zerolog.Logger
+	router            fiber.Router
+	store             services.NotificationStoreInterface
+	idempotency       services.IdempotencyStoreInterface
+	manager           services.NotificationManagerInterface
+	requestTimeout    time.Duration
+	idempotencyTTL    time.Duration
+	maxAttachments    int
+	maxAttachmentSize int64
+	attachmentTypes   []string
+	// maxBodySize limits bodies without files; see limitBody.
+	maxBodySize   int
+	batchMaxItems int
+	// batchLimiter charges batches by the leads in them.
+	batchLimiter      *itemLimiter
+	formSuccessURL    string
+	formErrorURL      string
+	formRedirectHosts []string
+	apiToken          string
+	logger            *zerolog.Logger
 }
 
-func NewNotificationHandler(router fiber.Router, telegramBotService services.TelegramBotServiceInterface, logger *zerolog.Logger) {
+// mimeProblemJSON is the content type of RFC 7807 problem details.
+const mimeProblemJSON = "application/problem+json"
+
+// Codes of field errors, for clients to tell them apart.
+const (
+	codeRequired        = "required"
+	codeTooLong         = "too_long"
+	codeInvalidFormat   = "invalid_format"
+	codeInvalidValue    = "invalid_value"
+	codeTooMany         = "too_many"
+	codeTooLarge        = "too_large"
+	codeTypeNotAllowed  = "type_not_allowed"
+	codeContentMismatch = "content_mismatch"
+)
+
+// fieldError is a problem with one field of a request.
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// validationErrors lists every problem found in a request.
+type validationErrors []fieldError
+
+// fields lists the fields with problems, each once.
+func (e validationErrors) fields() []string {
+	var fields []string
+	for _, err := range e {
+		if !slices.Contains(fields, err.Field) {
+			fields = append(fields, err.Field)
+		}
+	}
+	return fields
+}
+
+func (e validationErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Notification states reported by GetNotification.
+const (
+	stateQueued     = "queued"
+	stateSending    = "sending"
+	stateDelivered  = "delivered"
+	stateFailed     = "failed"
+	stateSuppressed = "suppressed"
+)
+
+// deliveryView is a delivery as reported by GetNotification. Telegram
+// deliveries carry the chat, topic and messages they were sent as, webhooks
+// the status of their last answer.
+type deliveryView struct {
+	Channel              string           `json:"channel"`
+	Status               string           `json:"status"`
+	Stage                int              `json:"stage"`
+	ChatID               int64            `json:"chat_id,omitempty"`
+	ThreadID             int              `json:"thread_id,omitempty"`
+	Recipient            string           `json:"recipient,omitempty"`
+	ResponseStatus       int              `json:"response_status,omitempty"`
+	MessageIDs           []int            `json:"message_ids,omitempty"`
+	AttachmentMessageIDs []int            `json:"attachment_message_ids,omitempty"`
+	AttachmentError      string           `json:"attachment_error,omitempty"`
+	ContactMessageID     int              `json:"contact_message_id,omitempty"`
+	ContactError         string           `json:"contact_error,omitempty"`
+	LastError            string           `json:"last_error,omitempty"`
+	Attempts             []domain.Attempt `json:"attempts"`
+	UpdatedAt            time.Time        `json:"updated_at"`
+}
+
+// batchResult is the outcome of one lead of a batch, by its position.
+type batchResult struct {
+	Index   int              `json:"index"`
+	Success bool             `json:"success"`
+	ID      string           `json:"id,omitempty"`
+	Message string           `json:"message"`
+	Errors  validationErrors `json:"errors,omitempty"`
+}
+
+func NewNotificationHandler(router fiber.Router, store services.NotificationStoreInterface, idempotency services.IdempotencyStoreInterface, manager services.NotificationManagerInterface, cfg *config.ServerConfig, logger *zerolog.Logger) {
 	handler := &Notification{
-		router:             router,
-		telegramBotService: telegramBotService,
-		logger:             logger,
+		router:            router,
+		store:             store,
+		idempotency:       idempotency,
+		manager:           manager,
+		requestTimeout:    cfg.RequestTimeout,
+		idempotencyTTL:    cfg.IdempotencyTTL,
+		maxAttachments:    cfg.MaxAttachments,
+		maxAttachmentSize: cfg.MaxAttachmentSize,
+		attachmentTypes:   cfg.AttachmentTypes,
+		maxBodySize:       fiber.DefaultBodyLimit,
+		batchMaxItems:     cfg.BatchMaxItems,
+		batchLimiter:      newItemLimiter(cfg.BatchRateLimit, time.Minute),
+		formSuccessURL:    cfg.FormSuccessURL,
+		formErrorURL:      cfg.FormErrorURL,
+		formRedirectHosts: cfg.FormRedirectHosts,
+		apiToken:          cfg.APIToken,
+		logger:            logger,
 	}
 	api := handler.router.Group("/api/v1")
-	api.Post("/notification", handler.CreateNotification)
+	api.Post("/notification", handler.limitBody(true, handler.idempotent(handler.CreateNotification)))
+	if cfg.APIToken == "" {
+		logger.Warn().Msg("API_TOKEN is not set, batches, lookup and changes of notifications are off")
+		return
+	}
+	// Batches are for server-side callers, so they take the token too.
+	api.Post("/notifications", handler.authorized(handler.limitBody(false, handler.idempotent(handler.CreateNotifications))))
+	api.Get("/notification/:id", handler.authorized(handler.GetNotification))
+	if manager != nil {
+		api.Patch("/notification/:id", handler.authorized(handler.limitBody(false, handler.UpdateNotification)))
+		api.Delete("/notification/:id", handler.authorized(handler.DeleteNotification))
+	}
 
 }
 
+// CreateNotification accepts a lead as JSON, or as multipart/form-data with
+// files attached. A plain HTML form post is answered with a redirect instead
+// of JSON, when there is a page to redirect to.
 func (n *Notification) CreateNotification(c *fiber.Ctx) error {
 	var req domain.Notification
 	n.logger.Info().Str("ip", c.IP()).Msg("received request")
+	form := n.formRedirect(c)
 	if err := c.BodyParser(&req); err != nil {
 		n.logger.Error().Err(err).Msg("failed to parse request")
+		if form != nil {
+			return form.redirect(c, formErrorInvalid, nil)
+		}
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"success": false,
 			"message": "failed to parse request",
 		})
 	}
+	if isForm(c) {
+		req.CustomFields = formCustomFields(c)
+	}
 
-	if err := n.validateRequest(&req); err != nil {
-		n.logger.Error().Err(err).Msg("failed to validate request")
+	errs := n.validateRequest(&req)
+	attachments, err := n.readAttachments(c)
+	var attachmentErrs validationErrors
+	if errors.As(err, &attachmentErrs) {
+		errs = append(errs, attachmentErrs...)
+	} else if err != nil {
+		n.logger.Error().Err(err).Msg("failed to read attachments")
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"success": false,
-			"message": "failed to validate request",
+			"message": "failed to parse request",
 		})
 	}
+	if len(errs) > 0 {
+		if form != nil {
+			n.logger.Error().Err(errs).Msg("failed to validate request")
+			return form.redirect(c, formErrorValidation, errs.fields())
+		}
+		return n.validationProblem(c, errs)
+	}
 
-	message := n.createFormatNotification(&req)
+	ctx, cancel := context.WithTimeout(c.UserContext(), n.requestTimeout)
+	defer cancel()
 
-	if err := n.telegramBotService.SendMessage(c.Context(), message); err != nil {
-		n.logger.Error().Err(err).Msg("failed to send message")
+	record, err := n.accept(ctx, c, req, attachments)
+	if err != nil {
+		n.logger.Error().Err(err).Msg("failed to store notification")
+		if form != nil {
+			c.Locals(failedLocal, true)
+			return form.redirect(c, formErrorInternal, nil)
+		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"success": false,
-			"message": "failed to send message",
+			"message": "failed to store notification",
 		})
 	}
 
-	n.logger.Info().Interface("request", req).Msg("sent message successfully")
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+	if form != nil {
+		return form.redirect(c, "", nil)
+	}
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
 		"success": true,
-		"message": "sent message successfully",
+		"message": "notification accepted",
+		"id":      record.ID,
+	})
+}
+
+// formTargets are the pages a plain HTML form post is redirected to.
+type formTargets struct {
+	success string
+	failure string
+}
+
+// formRedirect returns where to redirect a url-encoded form post, or nil to
+// answer with JSON: the request is not such a form, or there is no page to
+// go to. _redirect is followed only to the allowed hosts, so the API cannot
+// be used as an open redirect.
+func (n *Notification) formRedirect(c *fiber.Ctx) *formTargets {
+	mediaType, _, _ := mime.ParseMediaType(c.Get(fiber.HeaderContentType))
+	if mediaType != fiber.MIMEApplicationForm {
+		return nil
+	}
+
+	targets := &formTargets{success: n.formSuccessURL, failure: n.formErrorURL}
+	if raw := c.FormValue(formRedirectField); raw != "" {
+		if n.redirectAllowed(raw) {
+			targets.success, targets.failure = raw, raw
+		} else {
+			n.logger.Warn().Str("redirect", raw).Msg("form redirect to a host that is not allowed")
+		}
+	}
+	if targets.success == "" {
+		targets.success = targets.failure
+	}
+	if targets.failure == "" {
+		targets.failure = targets.success
+	}
+	if targets.success == "" {
+		return nil
+	}
+	return targets
+}
+
+func (n *Notification) redirectAllowed(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return false
+	}
+	return slices.ContainsFunc(n.formRedirectHosts, func(host string) bool { return strings.EqualFold(host, u.Hostname()) })
+}
+
+// redirect sends the client to the success page when code is empty, and to
+// the error page with the code and the invalid fields in the query string
+// otherwise.
+func (t *formTargets) redirect(c *fiber.Ctx, code string, fields []string) error {
+	if code == "" {
+		return c.Redirect(t.success, fiber.StatusSeeOther)
+	}
+
+	// The error page comes from the config or the allowlist check, so it
+	// always parses.
+	u, _ := url.Parse(t.failure)
+	query := u.Query()
+	query.Set("error", code)
+	if len(fields) > 0 {
+		query.Set("fields", strings.Join(fields, ","))
+	}
+	u.RawQuery = query.Encode()
+	return c.Redirect(u.String(), fiber.StatusSeeOther)
+}
+
+// isForm reports whether the request is an HTML form, url-encoded or
+// multipart.
+func isForm(c *fiber.Ctx) bool {
+	mediaType, _, _ := mime.ParseMediaType(c.Get(fiber.HeaderContentType))
+	return mediaType == fiber.MIMEApplicationForm || mediaType == fiber.MIMEMultipartForm
+}
+
+// isMultipart reports whether the request is multipart/form-data, the only
+// kind that carries files.
+func isMultipart(c *fiber.Ctx) bool {
+	mediaType, _, _ := mime.ParseMediaType(c.Get(fiber.HeaderContentType))
+	return mediaType == fiber.MIMEMultipartForm
+}
+
+// formCustomFields collects the custom_fields[name] fields of a form, since
+// forms have no nested objects.
+func formCustomFields(c *fiber.Ctx) map[string]string {
+	fields := map[string]string{}
+	add := func(key, value string) {
+		name, ok := strings.CutPrefix(key, customFieldPrefix)
+		if name, closed := strings.CutSuffix(name, "]"); ok && closed {
+			fields[name] = value
+		}
+	}
+
+	if form, err := c.MultipartForm(); err == nil {
+		for key, values := range form.Value {
+			add(key, values[len(values)-1])
+		}
+	} else {
+		c.Request().PostArgs().VisitAll(func(key, value []byte) {
+			add(string(key), string(value))
+		})
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// CreateNotifications accepts a JSON array of leads. Every lead is checked
+// and stored on its own, so valid leads are accepted even if others are not;
+// the response reports each of them by position.
+func (n *Notification) CreateNotifications(c *fiber.Ctx) error {
+	var items []json.RawMessage
+	n.logger.Info().Str("ip", c.IP()).Msg("received batch request")
+	if err := json.Unmarshal(c.Body(), &items); err != nil || len(items) == 0 {
+		n.logger.Error().Err(err).Msg("failed to parse batch request")
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"message": "failed to parse request",
+		})
+	}
+	if len(items) > n.batchMaxItems {
+		n.logger.Error().Int("items", len(items)).Msg("batch too large")
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("batch too large, at most %d notifications allowed", n.batchMaxItems),
+		})
+	}
+	if !n.batchLimiter.allow(c.IP(), len(items), time.Now()) {
+		n.logger.Error().Str("ip", c.IP()).Int("items", len(items)).Msg("batch rate limit reached")
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"success": false,
+			"message": "too many requests",
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), n.requestTimeout)
+	defer cancel()
+
+	results := make([]batchResult, len(items))
+	accepted, failed := 0, 0
+	for i, item := range items {
+		results[i].Index = i
+
+		var req domain.Notification
+		if err := json.Unmarshal(item, &req); err != nil {
+			n.logger.Error().Err(err).Int("index", i).Msg("failed to parse request")
+			results[i].Message = "failed to parse request"
+			continue
+		}
+		if errs := n.validateRequest(&req); errs != nil {
+			n.logger.Error().Err(errs).Int("index", i).Msg("failed to validate request")
+			results[i].Message = "failed to validate request"
+			results[i].Errors = errs
+			continue
+		}
+
+		record, err := n.accept(ctx, c, req, nil)
+		if err != nil {
+			n.logger.Error().Err(err).Int("index", i).Msg("failed to store notification")
+			results[i].Message = "failed to store notification"
+			failed++
+			continue
+		}
+		results[i] = batchResult{Index: i, Success: true, ID: record.ID, Message: "notification accepted"}
+		accepted++
+	}
+
+	n.logger.Info().Int("items", len(items)).Int("accepted", accepted).Msg("batch processed")
+	status, message := fiber.StatusAccepted, "notifications accepted"
+	switch {
+	case accepted == 0 && failed > 0:
+		status, message = fiber.StatusInternalServerError, "failed to store notifications"
+	case accepted == 0:
+		status, message = fiber.StatusBadRequest, "no notifications accepted"
+	case accepted < len(items):
+		status, message = fiber.StatusMultiStatus, "some notifications accepted"
+	}
+	return c.Status(status).JSON(fiber.Map{
+		"success":       accepted == len(items),
+		"message":       message,
+		"accepted":      accepted,
+		"notifications": results,
+	})
+}
+
+// authorizedLocal marks a request that carries the API token.
+const authorizedLocal = "authorized"
+
+// Authenticate marks the requests that carry apiToken, for Authorized to
+// report. It rejects nothing: the routes that need the token check it.
+func Authenticate(apiToken string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if validToken(c, apiToken) {
+			c.Locals(authorizedLocal, true)
+		}
+		return c.Next()
+	}
+}
+
+// Authorized reports whether Authenticate found the API token on c.
+func Authorized(c *fiber.Ctx) bool {
+	authorized, _ := c.Locals(authorizedLocal).(bool)
+	return authorized
+}
+
+// validToken reports whether c carries apiToken, sent as
+// "Authorization: Bearer <token>". Without a token set nothing matches.
+func validToken(c *fiber.Ctx, apiToken string) bool {
+	token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	return ok && apiToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) == 1
+}
+
+// authorized lets only requests with the API token through to next.
+func (n *Notification) authorized(next fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !validToken(c, n.apiToken) {
+			n.logger.Warn().Str("ip", c.IP()).Str("path", c.Path()).Msg("unauthorized request")
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"success": false,
+				"message": "unauthorized",
+			})
+		}
+		return next(c)
+	}
+}
+
+// limitBody rejects bodies larger than maxBodySize before next reads them.
+// The server limit is sized for attachments, so only multipart requests to a
+// route that takes files, as files says, may go up to it.
+func (n *Notification) limitBody(files bool, next fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if len(c.Body()) > n.maxBodySize && !(files && isMultipart(c)) {
+			n.logger.Error().Str("ip", c.IP()).Int("size", len(c.Body())).Msg("request body too large")
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+				"success": false,
+				"message": "request body too large",
+			})
+		}
+		return next(c)
+	}
+}
+
+// idempotent makes next safe to repeat with the same Idempotency-Key: the
+// first response is kept for the TTL and replayed without running next again.
+// Server errors are not kept, so the request can be retried.
+func (n *Notification) idempotent(next fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := c.Get(idempotencyKeyHeader)
+		if key == "" {
+			return next(c)
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"message": "invalid idempotency key",
+			})
+		}
+
+		// While in progress the key expires with the request, so a crash
+		// does not lock it for the whole TTL.
+		now := time.Now()
+		request := domain.IdempotentRequest{Key: key, Hash: requestHash(c), ExpiresAt: now.Add(n.requestTimeout)}
+		ctx, cancel := context.WithTimeout(c.UserContext(), n.requestTimeout)
+		defer cancel()
+
+		existing, err := n.idempotency.Reserve(ctx, request, now)
+		if err != nil {
+			n.logger.Error().Err(err).Str("key", key).Msg("failed to reserve idempotency key")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"success": false,
+				"message": "failed to check idempotency key",
+			})
+		}
+		if existing != nil {
+			return n.replay(c, existing, request.Hash)
+		}
+
+		if err := next(c); err != nil {
+			n.release(ctx, key)
+			return err
+		}
+
+		// Server errors and rate limiting are passing, so the key is freed
+		// for a retry instead of replaying them.
+		request.Status = c.Response().StatusCode()
+		failed, _ := c.Locals(failedLocal).(bool)
+		if failed || request.Status >= fiber.StatusInternalServerError || request.Status == fiber.StatusTooManyRequests {
+			n.release(ctx, key)
+			return nil
+		}
+		request.Body = bytes.Clone(c.Response().Body())
+		request.ContentType = string(c.Response().Header.ContentType())
+		request.Location = string(c.Response().Header.Peek(fiber.HeaderLocation))
+		request.ExpiresAt = time.Now().Add(n.idempotencyTTL)
+		if err := n.idempotency.Complete(ctx, request); err != nil {
+			n.logger.Error().Err(err).Str("key", key).Msg("failed to store idempotent response")
+		}
+		return nil
+	}
+}
+
+// replay answers a repeated Idempotency-Key with the stored response.
+func (n *Notification) replay(c *fiber.Ctx, existing *domain.IdempotentRequest, hash string) error {
+	switch {
+	case existing.Hash != hash:
+		n.logger.Warn().Str("key", existing.Key).Msg("idempotency key reused with a different request")
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"success": false,
+			"message": "idempotency key reused with a different request",
+		})
+	case existing.Status == 0:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success": false,
+			"message": "request with this idempotency key is in progress",
+		})
+	}
+
+	n.logger.Info().Str("key", existing.Key).Msg("replaying idempotent response")
+	c.Set(idempotentReplayedHeader, "true")
+	// A form post was answered with a redirect and no body.
+	if existing.Location != "" {
+		return c.Redirect(existing.Location, existing.Status)
+	}
+	// Responses stored before the content type was kept were all JSON.
+	contentType := existing.ContentType
+	if contentType == "" {
+		contentType = fiber.MIMEApplicationJSON
+	}
+	c.Set(fiber.HeaderContentType, contentType)
+	return c.Status(existing.Status).Send(existing.Body)
+}
+
+func (n *Notification) release(ctx context.Context, key string) {
+	if err := n.idempotency.Release(ctx, key); err != nil {
+		n.logger.Error().Err(err).Str("key", key).Msg("failed to release idempotency key")
+	}
+}
+
+// requestHash identifies a request by its path, media type and content. The
+// content is hashed in a canonical form, so the same lead resent with a new
+// multipart boundary or reordered JSON keys still matches.
+func requestHash(c *fiber.Ctx) string {
+	mediaType, _, _ := mime.ParseMediaType(c.Get(fiber.HeaderContentType))
+	hash := sha256.New()
+	for _, part := range [][]byte{[]byte(c.Path()), []byte(mediaType), canonicalContent(c, mediaType)} {
+		hash.Write(part)
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// fileDigest stands for an uploaded file in the canonical content.
+type fileDigest struct {
+	Field  string `json:"field"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	SHA256 string `json:"sha256"`
+}
+
+// canonicalContent is the parsed request re-encoded as JSON: form fields by
+// name with each file as its name, type and digest, or the JSON body with
+// sorted keys. A body that does not parse is taken as is.
+func canonicalContent(c *fiber.Ctx, mediaType string) []byte {
+	var content struct {
+		Fields map[string][]string `json:"fields"`
+		Files  []fileDigest        `json:"files,omitempty"`
+	}
+
+	switch mediaType {
+	case fiber.MIMEMultipartForm:
+		form, err := c.MultipartForm()
+		if err != nil {
+			return c.Body()
+		}
+		content.Fields = form.Value
+		for _, field := range slices.Sorted(maps.Keys(form.File)) {
+			for _, header := range form.File[field] {
+				digest, err := fileSHA256(header)
+				if err != nil {
+					return c.Body()
+				}
+				content.Files = append(content.Files, fileDigest{
+					Field:  field,
+					Name:   header.Filename,
+					Type:   header.Header.Get(fiber.HeaderContentType),
+					SHA256: digest,
+				})
+			}
+		}
+	case fiber.MIMEApplicationForm:
+		content.Fields = map[string][]string{}
+		c.Request().PostArgs().VisitAll(func(key, value []byte) {
+			content.Fields[string(key)] = append(content.Fields[string(key)], string(value))
+		})
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(c.Body()))
+		decoder.UseNumber()
+		var body any
+		if err := decoder.Decode(&body); err != nil || decoder.More() {
+			return c.Body()
+		}
+		data, err := json.Marshal(body)
+		if err != nil {
+			return c.Body()
+		}
+		return data
+	}
+
+	data, err := json.Marshal(content)
+	if err != nil {
+		return c.Body()
+	}
+	return data
+}
+
+func fileSHA256(header *multipart.FileHeader) (string, error) {
+	file, err := header.Open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// accept stores a checked lead for delivery.
+func (n *Notification) accept(ctx context.Context, c *fiber.Ctx, req domain.Notification, attachments []domain.Attachment) (*domain.NotificationRecord, error) {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return nil, fmt.Errorf("generate notification id: %w", err)
+	}
+
+	now := time.Now()
+	record := &domain.NotificationRecord{
+		ID:           id.String(),
+		Notification: req,
+		ClientIP:     c.IP(),
+		RequestID:    requestID(c),
+		Status:       domain.StatusQueued,
+		Attachments:  attachments,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if err := n.store.Save(ctx, record); err != nil {
+		return nil, err
+	}
+
+	n.logger.Info().Str("id", record.ID).Interface("request", req).Msg("notification accepted")
+	return record, nil
+}
+
+// GetNotification reports how far delivery of a notification got: its state,
+// the attempts made for every channel and the messages it was sent as.
+func (n *Notification) GetNotification(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), n.requestTimeout)
+	defer cancel()
+
+	record, err := n.store.Get(ctx, id)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"success": false,
+			"message": "notification not found",
+		})
+	}
+	if err != nil {
+		n.logger.Error().Err(err).Str("id", id).Msg("failed to load notification")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"message": "failed to load notification",
+		})
+	}
+
+	deliveries := make([]deliveryView, 0, len(record.Deliveries))
+	for _, delivery := range record.Deliveries {
+		attempts := delivery.History
+		if attempts == nil {
+			attempts = []domain.Attempt{}
+		}
+		deliveries = append(deliveries, deliveryView{
+			Channel:              delivery.Channel,
+			Status:               string(delivery.Status),
+			Stage:                delivery.Stage,
+			ChatID:               delivery.ChatID,
+			ThreadID:             delivery.ThreadID,
+			Recipient:            delivery.Recipient,
+			ResponseStatus:       delivery.ResponseStatus,
+			MessageIDs:           delivery.MessageIDs,
+			AttachmentMessageIDs: delivery.AttachmentMessageIDs,
+			AttachmentError:      delivery.AttachmentError,
+			ContactMessageID:     delivery.ContactMessageID,
+			ContactError:         delivery.ContactError,
+			LastError:            delivery.LastError,
+			Attempts:             attempts,
+			UpdatedAt:            delivery.UpdatedAt,
+		})
+	}
+
+	response := fiber.Map{
+		"success":       true,
+		"id":            record.ID,
+		"status":        notificationState(record),
+		"delivered_via": record.DeliveredVia,
+		"deliveries":    deliveries,
+		"created_at":    record.CreatedAt,
+		"updated_at":    record.UpdatedAt,
+	}
+	if record.Status == domain.StatusQueued && !record.NextAttempt.IsZero() {
+		response["next_attempt"] = record.NextAttempt
+	}
+	return c.JSON(response)
+}
+
+// notificationState maps a record to the state callers see. A queued
+// notification is sending once the first attempt has been made, and a
+// retracted one is suppressed.
+func notificationState(record *domain.NotificationRecord) string {
+	switch record.Status {
+	case domain.StatusDelivered:
+		return stateDelivered
+	case domain.StatusFailed:
+		return stateFailed
+	case domain.StatusRetracted:
+		return stateSuppressed
+	}
+	if record.Attempts > 0 || slices.ContainsFunc(record.Deliveries, func(delivery domain.Delivery) bool {
+		return delivery.Attempts > 0
+	}) {
+		return stateSending
+	}
+	return stateQueued
+}
+
+// UpdateNotification replaces the lead and edits the Telegram messages
+// already sent for it.
+func (n *Notification) UpdateNotification(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var req domain.Notification
+	n.logger.Info().Str("ip", c.IP()).Str("id", id).Msg("received update request")
+	if err := c.BodyParser(&req); err != nil {
+		n.logger.Error().Err(err).Msg("failed to parse request")
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"message": "failed to parse request",
+		})
+	}
+
+	if errs := n.validateRequest(&req); errs != nil {
+		return n.validationProblem(c, errs)
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), n.requestTimeout)
+	defer cancel()
+
+	results, err := n.manager.Update(ctx, id, req)
+	if err != nil {
+		return n.changeError(c, id, err)
+	}
+	return n.changeResponse(c, id, "notification updated", results)
+}
+
+// DeleteNotification stops delivery of a notification and deletes the
+// Telegram messages already sent for it.
+func (n *Notification) DeleteNotification(c *fiber.Ctx) error {
+	id := c.Params("id")
+	n.logger.Info().Str("ip", c.IP()).Str("id", id).Msg("received delete request")
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), n.requestTimeout)
+	defer cancel()
+
+	results, err := n.manager.Retract(ctx, id)
+	if err != nil {
+		return n.changeError(c, id, err)
+	}
+	return n.changeResponse(c, id, "notification retracted", results)
+}
+
+func (n *Notification) changeError(c *fiber.Ctx, id string, err error) error {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"success": false,
+			"message": "notification not found",
+		})
+	case errors.Is(err, services.ErrNotificationRetracted):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success": false,
+			"message": "notification retracted",
+		})
+	default:
+		n.logger.Error().Err(err).Str("id", id).Msg("failed to change notification")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"message": "failed to change notification",
+		})
+	}
+}
+
+// changeResponse reports the outcome in every chat; a failure in any of them
+// turns the response into 502, so the caller knows to retry.
+func (n *Notification) changeResponse(c *fiber.Ctx, id, message string, results []services.ChangeResult) error {
+	for _, result := range results {
+		if result.Error != "" {
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+				"success":    false,
+				"message":    "failed to change telegram messages",
+				"id":         id,
+				"deliveries": results,
+			})
+		}
+	}
+
+	n.logger.Info().Str("id", id).Msg(message)
+	return c.JSON(fiber.Map{
+		"success":    true,
+		"message":    message,
+		"id":         id,
+		"deliveries": results,
 	})
 }
 
-func (n *Notification) validateRequest(req *domain.Notification) error {
-	if err := emptyStringValidator(req.Phone, "phone"); err != nil {
-		return err
+// readAttachments reads the files of a multipart request. The declared type
+// has to be allowed, and images and PDFs have to really be what they claim,
+// since Telegram renders them. Problems with the files are returned as
+// validationErrors.
+func (n *Notification) readAttachments(c *fiber.Ctx) ([]domain.Attachment, error) {
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+		return nil, nil
 	}
 
-	if err := emptyStringValidator(req.CompanyName, "company_name"); err != nil {
-		return err
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil, err
+	}
+	files := form.File[attachmentsField]
+	if len(files) > n.maxAttachments {
+		return nil, validationErrors{{
+			Field:   attachmentsField,
+			Code:    codeTooMany,
+			Message: fmt.Sprintf("%d files sent, at most %d allowed", len(files), n.maxAttachments),
+		}}
 	}
 
-	if err := emptyStringValidator(req.NotificationText, "notification_text"); err != nil {
-		return err
+	var attachments []domain.Attachment
+	var errs validationErrors
+	for _, header := range files {
+		name := header.Filename[strings.LastIndexAny(header.Filename, `/\`)+1:]
+		if header.Size > n.maxAttachmentSize {
+			errs = append(errs, fieldError{Field: attachmentsField, Code: codeTooLarge, Message: fmt.Sprintf("file %q is larger than %d bytes", name, n.maxAttachmentSize)})
+			continue
+		}
+
+		contentType, _, err := mime.ParseMediaType(header.Header.Get(fiber.HeaderContentType))
+		if err != nil || !slices.Contains(n.attachmentTypes, contentType) {
+			errs = append(errs, fieldError{Field: attachmentsField, Code: codeTypeNotAllowed, Message: fmt.Sprintf("file %q has a type that is not allowed", name)})
+			continue
+		}
+
+		data, err := readFile(header)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(contentType, "image/") || contentType == "application/pdf" {
+			if detected, _, _ := mime.ParseMediaType(http.DetectContentType(data)); detected != contentType {
+				errs = append(errs, fieldError{Field: attachmentsField, Code: codeContentMismatch, Message: fmt.Sprintf("file %q is %s, not %s", name, detected, contentType)})
+				continue
+			}
+		}
+
+		attachments = append(attachments, domain.Attachment{
+			Name:        name,
+			ContentType: contentType,
+			Size:        int64(len(data)),
+			Data:        data,
+		})
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return attachments, nil
+}
+
+func readFile(header *multipart.FileHeader) ([]byte, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// Limits of the lead fields.
+const (
+	maxCompanyNameLength = 255
+	maxSourceLength      = 100
+	maxContactNameLength = 100
+	maxEmailLength       = 254
+	maxPageURLLength     = 2048
+	maxUTMLength         = 255
+	maxCustomFields      = 20
+	maxCustomFieldLength = 500
+)
+
+var customFieldName = regexp.MustCompile(`^[A-Za-z0-9_]{1,64}$`)
+
+// validateRequest checks every field of req and returns all the problems
+// found, or nil.
+func (n *Notification) validateRequest(req *domain.Notification) validationErrors {
+	var errs validationErrors
+	fields := []struct{ name, value string }{
+		{"phone", req.Phone},
+		{"company_name", req.CompanyName},
+		{"notification_text", req.NotificationText},
+	}
+	for _, field := range fields {
+		if err := emptyStringValidator(field.value, field.name); err != nil {
+			errs = append(errs, fieldError{Field: field.name, Code: codeRequired, Message: err.Error()})
+		}
 	}
 
 	if len(req.NotificationText) > 255 {
-		return errors.New("notification_text too long")
+		errs = append(errs, fieldError{Field: "notification_text", Code: codeTooLong, Message: "notification_text too long"})
+	}
+	if utf8.RuneCountInString(req.CompanyName) > maxCompanyNameLength {
+		errs = append(errs, fieldError{Field: "company_name", Code: codeTooLong, Message: fmt.Sprintf("company_name is longer than %d characters", maxCompanyNameLength)})
 	}
-	if !phoneValidation(req.Phone) {
-		return errors.New("invalid phone")
+	if strings.TrimSpace(req.Phone) != "" && !phoneValidation(req.Phone) {
+		errs = append(errs, fieldError{Field: "phone", Code: codeInvalidFormat, Message: "invalid phone"})
 	}
 
-	return nil
+	return append(errs, validateDetails(req)...)
+}
+
+// validateDetails checks the optional fields of a lead.
+func validateDetails(req *domain.Notification) validationErrors {
+	var errs validationErrors
+	tooLong := func(field, value string, limit int) bool {
+		if utf8.RuneCountInString(value) <= limit {
+			return false
+		}
+		errs = append(errs, fieldError{Field: field, Code: codeTooLong, Message: fmt.Sprintf("%s is longer than %d characters", field, limit)})
+		return true
+	}
+
+	tooLong("source", req.Source, maxSourceLength)
+	tooLong("contact_name", req.ContactName, maxContactNameLength)
+	if req.Email != "" && !tooLong("email", req.Email, maxEmailLength) {
+		if address, err := mail.ParseAddress(req.Email); err != nil || address.Address != req.Email {
+			errs = append(errs, fieldError{Field: "email", Code: codeInvalidFormat, Message: "invalid email"})
+		}
+	}
+	if req.PreferredContact != "" && !slices.Contains(domain.ContactMethods, req.PreferredContact) {
+		errs = append(errs, fieldError{Field: "preferred_contact", Code: codeInvalidValue, Message: "preferred_contact must be one of " + strings.Join(domain.ContactMethods, ", ")})
+	}
+	if req.PreferredContact == domain.ContactEmail && req.Email == "" {
+		errs = append(errs, fieldError{Field: "email", Code: codeRequired, Message: "email is required to be contacted by email"})
+	}
+	if req.PageURL != "" && !tooLong("page_url", req.PageURL, maxPageURLLength) {
+		if u, err := url.Parse(req.PageURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			errs = append(errs, fieldError{Field: "page_url", Code: codeInvalidFormat, Message: "invalid page_url"})
+		}
+	}
+	for _, param := range req.UTMParams() {
+		tooLong(param[0], param[1], maxUTMLength)
+	}
+
+	if len(req.CustomFields) > maxCustomFields {
+		errs = append(errs, fieldError{Field: "custom_fields", Code: codeTooMany, Message: fmt.Sprintf("at most %d custom fields allowed", maxCustomFields)})
+		return errs
+	}
+	names := slices.Sorted(maps.Keys(req.CustomFields))
+	for _, name := range names {
+		field := "custom_fields." + name
+		if !customFieldName.MatchString(name) {
+			errs = append(errs, fieldError{Field: field, Code: codeInvalidFormat, Message: "custom field names may only contain letters, digits and underscores"})
+			continue
+		}
+		tooLong(field, req.CustomFields[name], maxCustomFieldLength)
+	}
+	return errs
+}
+
+// validationProblem answers with the field errors as RFC 7807 problem
+// details. success and message are kept for older clients.
+func (n *Notification) validationProblem(c *fiber.Ctx, errs validationErrors) error {
+	n.logger.Error().Err(errs).Msg("failed to validate request")
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		"type":    "about:blank",
+		"title":   "Bad Request",
+		"status":  fiber.StatusBadRequest,
+		"detail":  "request has invalid fields",
+		"errors":  errs,
+		"success": false,
+		"message": "failed to validate request",
+	}, mimeProblemJSON)
 }
 
 func emptyStringValidator(s, stringName string) error {
@@ -99,14 +1080,9 @@ func emptyStringValidator(s, stringName string) error {
 	return nil
 }
 
-func (n *Notification) createFormatNotification(req *domain.Notification) string {
-	formatMessage := fmt.Sprintf(
-		"Клиент: %s;\nТелефон: %s;\nТекст обращение: %s",
-		req.CompanyName,
-		req.Phone,
-		req.NotificationText,
-	)
-	return formatMessage
+func requestID(c *fiber.Ctx) string {
+	id, _ := c.Locals("requestid").(string)
+	return id
 }
 
 func phoneValidation(phone string) bool {
@@ -1,7 +1,9 @@
 package handlers
 
 import (
+	"fmt"
 	"new-client-notification-bot/internal/domain"
+	"strings"
 	"testing"
 )
 
@@ -109,39 +111,104 @@ func TestPhoneValidation(t *testing.T) {
 	}
 }
 
-func TestCreateFormatNotification(t *testing.T) {
+func TestValidateRequest_CollectsAllErrors(t *testing.T) {
 	handler := &Notification{}
 
+	errs := handler.validateRequest(&domain.Notification{Phone: "invalid phone"})
+	codes := map[string]string{}
+	for _, err := range errs {
+		codes[err.Field] = err.Code
+	}
+	expected := map[string]string{"phone": "invalid_format", "company_name": "required", "notification_text": "required"}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %+v", len(expected), errs)
+	}
+	for field, code := range expected {
+		if codes[field] != code {
+			t.Errorf("expected %s: %s, got %q", field, code, codes[field])
+		}
+	}
+}
+
+func TestValidateRequest_Details(t *testing.T) {
+	handler := &Notification{}
+	manyFields := map[string]string{}
+	for i := range maxCustomFields + 1 {
+		manyFields[fmt.Sprintf("field_%d", i)] = "value"
+	}
+
 	tests := []struct {
 		name     string
-		input    domain.Notification
-		expected string
+		modify   func(n *domain.Notification)
+		expected map[string]string
 	}{
 		{
-			name: "valid notification formatting",
-			input: domain.Notification{
-				Phone:            "+7 912 345 67 89",
-				CompanyName:      "Test Company",
-				NotificationText: "Test message",
+			name: "all fields valid",
+			modify: func(n *domain.Notification) {
+				n.CompanyName = strings.Repeat("я", maxCompanyNameLength)
+				n.Source = strings.Repeat("s", maxSourceLength)
+				n.ContactName = "Иван Петров"
+				n.Email = "ivan@example.com"
+				n.PreferredContact = domain.ContactEmail
+				n.PageURL = "https://example.com/pricing?plan=pro"
+				n.UTMSource = "google"
+				n.UTMCampaign = "spring"
+				n.CustomFields = map[string]string{"budget": "100000", "employees_2": "15"}
 			},
-			expected: "Клиент: Test Company;\nТелефон: +7 912 345 67 89;\nТекст обращение: Test message",
 		},
 		{
-			name: "notification with special characters",
-			input: domain.Notification{
-				Phone:            "8 912 345 67 89",
-				CompanyName:      "ООО \"Рога и копыта\"",
-				NotificationText: "Сообщение с переносами\nстрок",
+			name: "invalid values",
+			modify: func(n *domain.Notification) {
+				n.CompanyName = strings.Repeat("я", maxCompanyNameLength+1)
+				n.Source = strings.Repeat("s", maxSourceLength+1)
+				n.ContactName = strings.Repeat("я", maxContactNameLength+1)
+				n.Email = "Ivan <ivan@example.com>"
+				n.PreferredContact = "pigeon"
+				n.PageURL = "javascript:alert(1)"
+				n.UTMTerm = strings.Repeat("a", maxUTMLength+1)
+				n.CustomFields = map[string]string{"bad key": "x", "note": strings.Repeat("a", maxCustomFieldLength+1)}
+			},
+			expected: map[string]string{
+				"company_name":          codeTooLong,
+				"source":                codeTooLong,
+				"contact_name":          codeTooLong,
+				"email":                 codeInvalidFormat,
+				"preferred_contact":     codeInvalidValue,
+				"page_url":              codeInvalidFormat,
+				"utm_term":              codeTooLong,
+				"custom_fields.bad key": codeInvalidFormat,
+				"custom_fields.note":    codeTooLong,
 			},
-			expected: "Клиент: ООО \"Рога и копыта\";\nТелефон: 8 912 345 67 89;\nТекст обращение: Сообщение с переносами\nстрок",
+		},
+		{
+			name:     "email required to be contacted by email",
+			modify:   func(n *domain.Notification) { n.PreferredContact = domain.ContactEmail },
+			expected: map[string]string{"email": codeRequired},
+		},
+		{
+			name:     "too many custom fields",
+			modify:   func(n *domain.Notification) { n.CustomFields = manyFields },
+			expected: map[string]string{"custom_fields": codeTooMany},
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := handler.createFormatNotification(&tt.input)
-			if result != tt.expected {
-				t.Errorf("createFormatNotification() = %q, expected %q", result, tt.expected)
+			input := domain.Notification{
+				Phone:            "+7 912 345 67 89",
+				CompanyName:      "Test Company",
+				NotificationText: "Test message",
+			}
+			tt.modify(&input)
+
+			errs := handler.validateRequest(&input)
+			if len(errs) != len(tt.expected) {
+				t.Fatalf("expected %d errors, got %+v", len(tt.expected), errs)
+			}
+			for _, err := range errs {
+				if tt.expected[err.Field] != err.Code {
+					t.Errorf("expected %s: %q, got %q", err.Field, tt.expected[err.Field], err.Code)
+				}
 			}
 		})
 	}
@@ -235,4 +302,3 @@ func TestValidateRequest(t *testing.T) {
 		})
 	}
 }
-
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"new-client-notification-bot/internal/domain"
+	"slices"
+	"strconv"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// telegramMediaGroupLimit is the most files one media group can take.
+const telegramMediaGroupLimit = 10
+
+// telegramPhotoLimit is the largest photo the Bot API takes; bigger images
+// go as documents.
+const telegramPhotoLimit = 10 << 20
+
+// inputMedia is a file of a media group, uploaded under the attach:// name.
+type inputMedia struct {
+	Type  string `json:"type"`
+	Media string `json:"media"`
+}
+
+func (t *TelegramBotService) SendAttachments(ctx context.Context, msg Message, attachments []domain.Attachment) (SentMessage, error) {
+	t.logger.Info().Int64("chat_id", msg.ChatID).Int("files", len(attachments)).Int("sent_files", len(msg.SentChunks)).Msg("sending attachments")
+
+	sent := SentMessage{ChatID: msg.ChatID, MessageIDs: slices.Clone(msg.SentChunks)}
+	for batch := range slices.Chunk(attachments[min(len(msg.SentChunks), len(attachments)):], telegramMediaGroupLimit) {
+		messageIDs, err := t.sendFiles(ctx, msg, batch)
+		if err != nil {
+			return sent, err
+		}
+		sent.MessageIDs = append(sent.MessageIDs, messageIDs...)
+	}
+
+	t.logger.Info().Int64("chat_id", msg.ChatID).Ints("message_ids", sent.MessageIDs).Msg("attachments sent")
+	return sent, nil
+}
+
+// sendFiles sends a single file as a photo or a document and several files
+// as one media group. Telegram groups photos only with photos and documents
+// only with documents, so a mixed batch goes as documents.
+func (t *TelegramBotService) sendFiles(ctx context.Context, msg Message, files []domain.Attachment) ([]int, error) {
+	params := replyParams(msg)
+
+	kind, endpoint := "document", "sendDocument"
+	if !slices.ContainsFunc(files, func(file domain.Attachment) bool { return !isPhoto(file) }) {
+		kind, endpoint = "photo", "sendPhoto"
+	}
+
+	var uploads []tgbotapi.RequestFile
+	if len(files) == 1 {
+		uploads = append(uploads, tgbotapi.RequestFile{Name: kind, Data: tgbotapi.FileBytes{Name: files[0].Name, Bytes: files[0].Data}})
+		var message tgbotapi.Message
+		if err := t.upload(ctx, endpoint, params, uploads, &message); err != nil {
+			return nil, err
+		}
+		return []int{message.MessageID}, nil
+	}
+
+	var media []inputMedia
+	for i, file := range files {
+		name := "file-" + strconv.Itoa(i)
+		media = append(media, inputMedia{Type: kind, Media: "attach://" + name})
+		uploads = append(uploads, tgbotapi.RequestFile{Name: name, Data: tgbotapi.FileBytes{Name: file.Name, Bytes: file.Data}})
+	}
+	if err := params.AddInterface("media", media); err != nil {
+		return nil, err
+	}
+
+	var messages []tgbotapi.Message
+	if err := t.upload(ctx, "sendMediaGroup", params, uploads, &messages); err != nil {
+		return nil, err
+	}
+	var messageIDs []int
+	for _, message := range messages {
+		messageIDs = append(messageIDs, message.MessageID)
+	}
+	return messageIDs, nil
+}
+
+// upload posts files to endpoint with retries and decodes the result into v.
+func (t *TelegramBotService) upload(ctx context.Context, endpoint string, params tgbotapi.Params, files []tgbotapi.RequestFile, v any) error {
+	resp, err := t.call(ctx, func(bot *tgbotapi.BotAPI) (*tgbotapi.APIResponse, error) {
+		return bot.UploadFiles(endpoint, params, files)
+	})
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(resp.Result, v); err != nil {
+		return fmt.Errorf("decode sent files: %w", err)
+	}
+	return nil
+}
+
+// isPhoto reports whether Telegram can show the file as a photo.
+func isPhoto(file domain.Attachment) bool {
+	return (file.ContentType == "image/jpeg" || file.ContentType == "image/png") && file.Size <= telegramPhotoLimit
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"new-client-notification-bot/internal/domain"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTelegramBotService_SendAttachments(t *testing.T) {
+	pdf := domain.Attachment{Name: "brief.pdf", ContentType: "application/pdf", Size: 4, Data: []byte("%PDF")}
+	png := domain.Attachment{Name: "logo.png", ContentType: "image/png", Size: 4, Data: []byte("\x89PNG")}
+
+	tests := []struct {
+		name          string
+		attachments   []domain.Attachment
+		expectedCall  string
+		expectedFiles map[string]string
+		expectedMedia []inputMedia
+	}{
+		{
+			name:          "single document",
+			attachments:   []domain.Attachment{pdf},
+			expectedCall:  "sendDocument",
+			expectedFiles: map[string]string{"document": "brief.pdf"},
+		},
+		{
+			name:          "single photo",
+			attachments:   []domain.Attachment{png},
+			expectedCall:  "sendPhoto",
+			expectedFiles: map[string]string{"photo": "logo.png"},
+		},
+		{
+			name:          "mixed group goes as documents",
+			attachments:   []domain.Attachment{pdf, png},
+			expectedCall:  "sendMediaGroup",
+			expectedFiles: map[string]string{"file-0": "brief.pdf", "file-1": "logo.png"},
+			expectedMedia: []inputMedia{{Type: "document", Media: "attach://file-0"}, {Type: "document", Media: "attach://file-1"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &botAPIRecorder{}
+			service := newTestTelegramBotService(t, func(w http.ResponseWriter, req *http.Request) {
+				if recorder.record(req) == "sendMediaGroup" {
+					w.Write([]byte(`{"ok":true,"result":[{"message_id":8,"chat":{"id":-100}},{"message_id":9,"chat":{"id":-100}}]}`))
+					return
+				}
+				w.Write([]byte(`{"ok":true,"result":{"message_id":8,"chat":{"id":-100}}}`))
+			})
+
+			sent, err := service.SendAttachments(context.Background(), Message{ChatID: -100, ThreadID: 5, ReplyTo: 7}, tt.attachments)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(sent.MessageIDs) != len(tt.attachments) || sent.MessageIDs[0] != 8 {
+				t.Errorf("expected a message per file, got %+v", sent)
+			}
+
+			call := recorder.call(tt.expectedCall)
+			if call == nil {
+				t.Fatalf("expected %s call", tt.expectedCall)
+			}
+			expected := map[string]string{"chat_id": "-100", "message_thread_id": "5", "reply_to_message_id": "7"}
+			for key, value := range expected {
+				if call.params.Get(key) != value {
+					t.Errorf("expected %s %q, got %q", key, value, call.params.Get(key))
+				}
+			}
+			for field, name := range tt.expectedFiles {
+				if call.files[field] != name {
+					t.Errorf("expected %s uploaded as %q, got %q", name, field, call.files[field])
+				}
+			}
+			if tt.expectedMedia != nil {
+				var media []inputMedia
+				if err := json.Unmarshal([]byte(call.params.Get("media")), &media); err != nil {
+					t.Fatalf("failed to decode media: %v", err)
+				}
+				if !slices.Equal(media, tt.expectedMedia) {
+					t.Errorf("expected media %+v, got %+v", tt.expectedMedia, media)
+				}
+			}
+		})
+	}
+}
+
+func TestTelegramBotService_SendAttachmentsResumes(t *testing.T) {
+	attachments := make([]domain.Attachment, telegramMediaGroupLimit+1)
+	for i := range attachments {
+		attachments[i] = domain.Attachment{Name: "brief.pdf", ContentType: "application/pdf", Size: 4, Data: []byte("%PDF")}
+	}
+
+	failDocuments := true
+	recorder := &botAPIRecorder{}
+	service := newTestTelegramBotService(t, func(w http.ResponseWriter, req *http.Request) {
+		if recorder.record(req) == "sendMediaGroup" {
+			var result []string
+			for i := range telegramMediaGroupLimit {
+				result = append(result, fmt.Sprintf(`{"message_id":%d,"chat":{"id":-100}}`, 10+i))
+			}
+			w.Write([]byte(`{"ok":true,"result":[` + strings.Join(result, ",") + `]}`))
+			return
+		}
+		if failDocuments {
+			w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: file is empty"}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"result":{"message_id":30,"chat":{"id":-100}}}`))
+	})
+
+	// The first batch went out before the second failed.
+	sent, err := service.SendAttachments(context.Background(), Message{ChatID: -100, ReplyTo: 7}, attachments)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(sent.MessageIDs) != telegramMediaGroupLimit || sent.MessageIDs[0] != 10 {
+		t.Fatalf("expected the first batch returned with the error, got %+v", sent)
+	}
+
+	failDocuments = false
+	calls := len(recorder.calls)
+	sent, err = service.SendAttachments(context.Background(), Message{ChatID: -100, ReplyTo: 7, SentChunks: sent.MessageIDs}, attachments)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(recorder.calls) != calls+1 || recorder.calls[calls].method != "sendDocument" {
+		t.Errorf("expected only the last file sent again, got %+v", recorder.calls[calls:])
+	}
+	if len(sent.MessageIDs) != len(attachments) || sent.MessageIDs[telegramMediaGroupLimit] != 30 {
+		t.Errorf("expected a message per file, got %+v", sent)
+	}
+}
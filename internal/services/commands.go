@@ -0,0 +1,236 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"new-client-notification-bot/internal/domain"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultLastLeads = 5
+	maxLastLeads     = 20
+)
+
+type command struct {
+	name        string
+	description string
+	handle      func(ctx context.Context, msg chatMessage) string
+	// anyChat lets the command run outside the lead chats.
+	anyChat bool
+}
+
+// chatMessage is an incoming message with its forum topic, which tgbotapi
+// v5.5 does not decode. ThreadID is 0 outside topics.
+type chatMessage struct {
+	*tgbotapi.Message
+	ThreadID int
+}
+
+// Commands serves bot commands in the chats the bot delivers leads to.
+// Other chats only get the commands marked anyChat.
+type Commands struct {
+	telegram  *TelegramBotService
+	store     NotificationStoreInterface
+	formatter *MessageFormatter
+	mute      *Mute
+	chatIDs   []int64
+	startedAt time.Time
+	commands  []command
+	logger    *zerolog.Logger
+}
+
+func NewCommands(telegram *TelegramBotService, store NotificationStoreInterface, router *Router, formatter *MessageFormatter, mute *Mute, logger *zerolog.Logger) *Commands {
+	c := &Commands{
+		telegram:  telegram,
+		store:     store,
+		formatter: formatter,
+		mute:      mute,
+		chatIDs:   router.ChatIDs(),
+		startedAt: time.Now(),
+		logger:    logger,
+	}
+	c.commands = []command{
+		{name: "status", description: "Состояние бота и Telegram", handle: c.status},
+		{name: "stats", description: "Число заявок за сегодня и неделю", handle: c.stats},
+		{name: "last", description: "Повторить последние N заявок", handle: c.last},
+		{name: "mute", description: "Приостановить уведомления, например /mute 1h", handle: c.muteDelivery},
+		{name: "chatid", description: "ID этого чата и темы для маршрутов", handle: c.chatID, anyChat: true},
+	}
+	return c
+}
+
+// Register publishes the command list with setMyCommands, so Telegram
+// suggests the commands in the chat UI.
+func (c *Commands) Register(ctx context.Context) error {
+	var botCommands []tgbotapi.BotCommand
+	for _, cmd := range c.commands {
+		botCommands = append(botCommands, tgbotapi.BotCommand{Command: cmd.name, Description: cmd.description})
+	}
+	return c.telegram.send(ctx, tgbotapi.NewSetMyCommands(botCommands...))
+}
+
+func (c *Commands) Handle(ctx context.Context, msg chatMessage) {
+	if !msg.IsCommand() {
+		return
+	}
+
+	idx := slices.IndexFunc(c.commands, func(cmd command) bool { return cmd.name == msg.Command() })
+	if idx == -1 {
+		return
+	}
+	if !c.commands[idx].anyChat && !slices.Contains(c.chatIDs, msg.Chat.ID) {
+		return
+	}
+
+	c.logger.Info().Str("command", msg.Command()).Int64("chat_id", msg.Chat.ID).Int("thread_id", msg.ThreadID).Msg("handling bot command")
+	reply := c.commands[idx].handle(ctx, msg)
+	if reply == "" {
+		return
+	}
+
+	out := tgbotapi.NewMessage(msg.Chat.ID, reply)
+	out.ReplyToMessageID = msg.MessageID
+	if _, err := c.telegram.sendText(ctx, out, msg.ThreadID); err != nil {
+		c.logger.Error().Err(err).Str("command", msg.Command()).Msg("failed to reply to bot command")
+	}
+}
+
+func (c *Commands) status(ctx context.Context, msg chatMessage) string {
+	now := time.Now()
+	lines := []string{
+		fmt.Sprintf("Работает %s (с %s)", now.Sub(c.startedAt).Round(time.Second), c.startedAt.Format("02.01.2006 15:04")),
+	}
+
+	if err := c.telegram.Ping(ctx); err != nil {
+		lines = append(lines, "Telegram: недоступен ("+err.Error()+")")
+	} else {
+		lines = append(lines, "Telegram: доступен")
+	}
+
+	if until, muted := c.mute.Until(now); muted {
+		lines = append(lines, "Уведомления: приостановлены до "+until.Format("02.01 15:04"))
+	} else {
+		lines = append(lines, "Уведомления: включены")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (c *Commands) stats(ctx context.Context, msg chatMessage) string {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	// Weeks start on Monday.
+	week := today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+
+	match := sentTo(msg)
+	todayCount, err := c.store.CountSince(ctx, today, match)
+	if err != nil {
+		c.logger.Error().Err(err).Msg("failed to count leads")
+		return "Не удалось посчитать заявки"
+	}
+	weekCount, err := c.store.CountSince(ctx, week, match)
+	if err != nil {
+		c.logger.Error().Err(err).Msg("failed to count leads")
+		return "Не удалось посчитать заявки"
+	}
+
+	return fmt.Sprintf("Заявок сегодня: %d\nЗа неделю: %d", todayCount, weekCount)
+}
+
+func (c *Commands) last(ctx context.Context, msg chatMessage) string {
+	limit := defaultLastLeads
+	if args := strings.TrimSpace(msg.CommandArguments()); args != "" {
+		n, err := strconv.Atoi(args)
+		if err != nil || n < 1 {
+			return "Использование: /last N, например /last 5"
+		}
+		limit = min(n, maxLastLeads)
+	}
+
+	records, err := c.store.Recent(ctx, limit, sentTo(msg))
+	if err != nil {
+		c.logger.Error().Err(err).Msg("failed to load recent leads")
+		return "Не удалось загрузить заявки"
+	}
+	if len(records) == 0 {
+		return "Заявок пока нет"
+	}
+
+	// Oldest first, so the newest lead ends up at the bottom of the chat.
+	for _, record := range slices.Backward(records) {
+		if record.Status == domain.StatusRetracted {
+			continue
+		}
+		sent, err := c.telegram.SendMessage(ctx, Message{
+			ChatID:         msg.Chat.ID,
+			ThreadID:       msg.ThreadID,
+			Text:           c.formatter.Format(record),
+			NotificationID: record.ID,
+		})
+		if err == nil && len(record.Attachments) > 0 {
+			_, err = sendAttachments(ctx, c.telegram, c.store, record.ID, Message{
+				ChatID:   msg.Chat.ID,
+				ThreadID: msg.ThreadID,
+				ReplyTo:  sent.MessageIDs[0],
+			})
+		}
+		if err != nil {
+			c.logger.Error().Err(err).Str("id", record.ID).Msg("failed to repost lead")
+			return "Не удалось отправить заявки"
+		}
+	}
+	return ""
+}
+
+// sentTo matches the records routed to the chat of msg, and to its topic when
+// msg was sent in one, so one team does not see the leads of another.
+func sentTo(msg chatMessage) func(record *domain.NotificationRecord) bool {
+	return func(record *domain.NotificationRecord) bool {
+		return slices.ContainsFunc(record.Deliveries, func(delivery domain.Delivery) bool {
+			// Deliveries stored before channels existed have no channel.
+			if delivery.Channel != ChannelTelegram && delivery.Channel != "" {
+				return false
+			}
+			return delivery.ChatID == msg.Chat.ID && (msg.ThreadID == 0 || delivery.ThreadID == msg.ThreadID)
+		})
+	}
+}
+
+func (c *Commands) muteDelivery(ctx context.Context, msg chatMessage) string {
+	args := strings.TrimSpace(msg.CommandArguments())
+	if args == "off" {
+		if err := c.mute.Set(ctx, time.Time{}); err != nil {
+			c.logger.Error().Err(err).Msg("failed to lift mute")
+			return "Не удалось включить уведомления"
+		}
+		return "Уведомления снова включены"
+	}
+
+	duration, err := time.ParseDuration(args)
+	if err != nil || duration <= 0 {
+		return "Использование: /mute 1h или /mute off"
+	}
+
+	until := time.Now().Add(duration)
+	if err := c.mute.Set(ctx, until); err != nil {
+		c.logger.Error().Err(err).Msg("failed to save mute")
+		return "Не удалось приостановить уведомления"
+	}
+	return "Уведомления приостановлены до " + until.Format("02.01 15:04") + ". Новые заявки ждут в очереди."
+}
+
+// chatID prints the IDs of the chat and topic the command was sent in, in
+// the form the routes file takes.
+func (c *Commands) chatID(ctx context.Context, msg chatMessage) string {
+	if msg.ThreadID == 0 {
+		return fmt.Sprintf("Чат: %d\nТема: нет\n\nДля маршрутов: {\"chat_id\": %d}", msg.Chat.ID, msg.Chat.ID)
+	}
+	return fmt.Sprintf("Чат: %d\nТема: %d\n\nДля маршрутов: {\"chat_id\": %d, \"thread_id\": %d}", msg.Chat.ID, msg.ThreadID, msg.Chat.ID, msg.ThreadID)
+}
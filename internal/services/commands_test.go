@@ -0,0 +1,289 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"new-client-notification-bot/config"
+	"new-client-notification-bot/internal/domain"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog"
+)
+
+func newTestCommands(t *testing.T, recorder *botAPIRecorder, store *MockNotificationStore) *Commands {
+	t.Helper()
+
+	service := newTestTelegramBotService(t, recorder.handler)
+	router, err := NewRouter(&config.RoutingConfig{DefaultChatIDs: []int64{42}})
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	logger := zerolog.Nop()
+	formatter := NewMessageFormatter(&config.BotConfig{}, &config.TemplateConfig{}, &logger)
+	return NewCommands(service, store, router, formatter, &Mute{}, &logger)
+}
+
+func commandMessage(chatID int64, text string) chatMessage {
+	return topicCommandMessage(chatID, 0, text)
+}
+
+func topicCommandMessage(chatID int64, threadID int, text string) chatMessage {
+	command := strings.Fields(text)[0]
+	return chatMessage{
+		Message: &tgbotapi.Message{
+			MessageID: 3,
+			Chat:      &tgbotapi.Chat{ID: chatID},
+			Text:      text,
+			Entities:  []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len(command)}},
+		},
+		ThreadID: threadID,
+	}
+}
+
+func TestCommands_Register(t *testing.T) {
+	recorder := &botAPIRecorder{}
+	commands := newTestCommands(t, recorder, &MockNotificationStore{})
+
+	if err := commands.Register(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	call := recorder.call("setMyCommands")
+	if call == nil {
+		t.Fatalf("expected setMyCommands call")
+	}
+	for _, name := range []string{"status", "stats", "last", "mute", "chatid"} {
+		if !strings.Contains(call.params.Get("commands"), `"command":"`+name+`"`) {
+			t.Errorf("expected command %q to be registered, got %s", name, call.params.Get("commands"))
+		}
+	}
+}
+
+func TestCommands_Handle(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name  string
+		text  string
+		reply string
+	}{
+		{name: "status", text: "/status", reply: "Telegram: доступен"},
+		{name: "stats", text: "/stats", reply: "Заявок сегодня: 1"},
+		{name: "mute", text: "/mute 1h", reply: "Уведомления приостановлены до"},
+		{name: "mute off", text: "/mute off", reply: "Уведомления снова включены"},
+		{name: "mute usage", text: "/mute soon", reply: "Использование: /mute 1h"},
+		{name: "last usage", text: "/last many", reply: "Использование: /last N"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &botAPIRecorder{}
+			store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{
+				"0001": {ID: "0001", Notification: testNotification, CreatedAt: now, Deliveries: []domain.Delivery{{Channel: ChannelTelegram, ChatID: 42}}},
+				"0002": {ID: "0002", Notification: testNotification, CreatedAt: now, Deliveries: []domain.Delivery{{Channel: ChannelTelegram, ChatID: 43}}},
+			}}
+			commands := newTestCommands(t, recorder, store)
+
+			commands.Handle(context.Background(), commandMessage(42, tt.text))
+
+			call := recorder.call("sendMessage")
+			if call == nil {
+				t.Fatalf("expected a reply")
+			}
+			if text := call.params.Get("text"); !strings.Contains(text, tt.reply) {
+				t.Errorf("expected reply containing %q, got %q", tt.reply, text)
+			}
+			if call.params.Get("reply_to_message_id") != "3" {
+				t.Errorf("expected reply to the command message")
+			}
+		})
+	}
+}
+
+func TestCommands_MuteAndResume(t *testing.T) {
+	recorder := &botAPIRecorder{}
+	commands := newTestCommands(t, recorder, &MockNotificationStore{})
+
+	commands.Handle(context.Background(), commandMessage(42, "/mute 30m"))
+	if _, muted := commands.mute.Until(time.Now()); !muted {
+		t.Fatalf("expected delivery to be muted")
+	}
+
+	commands.Handle(context.Background(), commandMessage(42, "/mute off"))
+	if _, muted := commands.mute.Until(time.Now()); muted {
+		t.Errorf("expected delivery to be resumed")
+	}
+}
+
+// mockMuteStore keeps the saved mute in memory.
+type mockMuteStore struct {
+	until time.Time
+	err   error
+}
+
+func (m *mockMuteStore) MuteUntil(ctx context.Context) (time.Time, error) {
+	return m.until, nil
+}
+
+func (m *mockMuteStore) SetMuteUntil(ctx context.Context, until time.Time) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.until = until
+	return nil
+}
+
+func TestCommands_MuteSurvivesRestart(t *testing.T) {
+	recorder := &botAPIRecorder{}
+	commands := newTestCommands(t, recorder, &MockNotificationStore{})
+	muteStore := &mockMuteStore{}
+	mute, err := NewMute(context.Background(), muteStore)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	commands.mute = mute
+
+	commands.Handle(context.Background(), commandMessage(42, "/mute 30m"))
+	restored, err := NewMute(context.Background(), muteStore)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, muted := restored.Until(time.Now()); !muted {
+		t.Fatalf("expected the mute to be restored")
+	}
+
+	muteStore.err = errors.New("disk full")
+	commands.Handle(context.Background(), commandMessage(42, "/mute off"))
+	if _, muted := commands.mute.Until(time.Now()); !muted {
+		t.Errorf("expected the mute to stay when it cannot be saved")
+	}
+	if reply := recorder.calls[len(recorder.calls)-1].params.Get("text"); !strings.Contains(reply, "Не удалось") {
+		t.Errorf("expected a failure reply, got %q", reply)
+	}
+}
+
+func TestCommands_Last(t *testing.T) {
+	deliveredTo := func(chatID int64, threadID int) []domain.Delivery {
+		return []domain.Delivery{{Channel: ChannelTelegram, ChatID: chatID, ThreadID: threadID}}
+	}
+	tests := []struct {
+		name     string
+		records  map[string]*domain.NotificationRecord
+		msg      chatMessage
+		reposted []string
+	}{
+		{
+			name: "newest first",
+			records: map[string]*domain.NotificationRecord{
+				"0001": {ID: "0001", Notification: testNotification, Deliveries: deliveredTo(42, 0)},
+				"0002": {ID: "0002", Notification: testNotification, Deliveries: deliveredTo(42, 0)},
+				"0003": {ID: "0003", Notification: testNotification, Deliveries: deliveredTo(42, 0)},
+			},
+			msg:      commandMessage(42, "/last 2"),
+			reposted: []string{"0002", "0003"},
+		},
+		{
+			name: "only leads of this chat",
+			records: map[string]*domain.NotificationRecord{
+				"0001": {ID: "0001", Notification: testNotification, Deliveries: deliveredTo(42, 0)},
+				"0002": {ID: "0002", Notification: testNotification, Deliveries: deliveredTo(43, 0)},
+				"0003": {ID: "0003", Notification: testNotification, Deliveries: deliveredTo(43, 0)},
+			},
+			msg:      commandMessage(42, "/last 2"),
+			reposted: []string{"0001"},
+		},
+		{
+			name: "only leads of this topic",
+			records: map[string]*domain.NotificationRecord{
+				"0001": {ID: "0001", Notification: testNotification, Deliveries: deliveredTo(42, 7)},
+				"0002": {ID: "0002", Notification: testNotification, Deliveries: deliveredTo(42, 8)},
+			},
+			msg:      topicCommandMessage(42, 7, "/last"),
+			reposted: []string{"0001"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &botAPIRecorder{}
+			commands := newTestCommands(t, recorder, &MockNotificationStore{records: tt.records})
+
+			commands.Handle(context.Background(), tt.msg)
+
+			var reposted []string
+			for _, call := range recorder.calls {
+				if call.method == "sendMessage" {
+					reposted = append(reposted, call.params.Get("reply_markup"))
+				}
+			}
+			if len(reposted) != len(tt.reposted) {
+				t.Fatalf("expected leads %v reposted, got %v", tt.reposted, reposted)
+			}
+			for i, id := range tt.reposted {
+				if !strings.Contains(reposted[i], id) {
+					t.Errorf("expected leads %v reposted oldest first, got %v", tt.reposted, reposted)
+				}
+			}
+		})
+	}
+}
+
+func TestCommands_IgnoresForeignChats(t *testing.T) {
+	recorder := &botAPIRecorder{}
+	commands := newTestCommands(t, recorder, &MockNotificationStore{})
+
+	commands.Handle(context.Background(), commandMessage(99, "/mute 1h"))
+
+	if _, muted := commands.mute.Until(time.Now()); muted {
+		t.Errorf("expected command from a foreign chat to be ignored")
+	}
+	if recorder.call("sendMessage") != nil {
+		t.Errorf("expected no reply to a foreign chat")
+	}
+}
+
+func TestCommands_ChatID(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      chatMessage
+		reply    string
+		threadID string
+	}{
+		{
+			name:  "lead chat",
+			msg:   commandMessage(42, "/chatid"),
+			reply: `{"chat_id": 42}`,
+		},
+		{
+			name:     "topic of a new chat",
+			msg:      topicCommandMessage(-100, 7, "/chatid"),
+			reply:    `{"chat_id": -100, "thread_id": 7}`,
+			threadID: "7",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &botAPIRecorder{}
+			commands := newTestCommands(t, recorder, &MockNotificationStore{})
+
+			commands.Handle(context.Background(), tt.msg)
+
+			call := recorder.call("sendMessage")
+			if call == nil {
+				t.Fatalf("expected a reply")
+			}
+			if text := call.params.Get("text"); !strings.Contains(text, tt.reply) {
+				t.Errorf("expected reply containing %q, got %q", tt.reply, text)
+			}
+			if call.params.Get("message_thread_id") != tt.threadID {
+				t.Errorf("expected reply in topic %q, got %q", tt.threadID, call.params.Get("message_thread_id"))
+			}
+			if call.params.Get("reply_to_message_id") != "3" {
+				t.Errorf("expected reply to the command message")
+			}
+		})
+	}
+}
@@ -0,0 +1,404 @@
+package services
+
+import (
+	"context"
+	"new-client-notification-bot/config"
+	"new-client-notification-bot/internal/domain"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type Dispatcher struct {
+	store    NotificationStoreInterface
+	channels *Registry
+	// router gives the fallback chains; without it there are none.
+	router *Router
+	mute   *Mute
+	cfg    *config.DispatcherConfig
+	logger *zerolog.Logger
+}
+
+func NewDispatcher(store NotificationStoreInterface, channels *Registry, router *Router, mute *Mute, cfg *config.DispatcherConfig, logger *zerolog.Logger) *Dispatcher {
+	return &Dispatcher{
+		store:    store,
+		channels: channels,
+		router:   router,
+		mute:     mute,
+		cfg:      cfg,
+		logger:   logger,
+	}
+}
+
+// channelResult sums up one dispatch round in one channel.
+type channelResult struct {
+	channel     string
+	delivered   int
+	failed      int
+	lastErr     error
+	interrupted bool
+	// sent lists the deliveries that went out in this round.
+	sent []int
+}
+
+// Run drains queued notifications until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		d.dispatchPending(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Dispatcher) dispatchPending(ctx context.Context) {
+	now := time.Now()
+	if _, muted := d.mute.Until(now); muted {
+		return
+	}
+
+	records, err := d.store.Pending(ctx, now, d.cfg.BatchSize)
+	if err != nil {
+		d.logger.Error().Err(err).Msg("failed to load pending notifications")
+		return
+	}
+
+	for _, record := range records {
+		if ctx.Err() != nil {
+			return
+		}
+		d.dispatch(ctx, record)
+	}
+}
+
+// dispatch sends a notification to every primary channel in parallel.
+// Within a channel recipients are served one by one. When nothing gets
+// delivered, the notification moves down its fallback chain.
+func (d *Dispatcher) dispatch(ctx context.Context, record *domain.NotificationRecord) {
+	if len(record.Deliveries) == 0 {
+		d.plan(record, time.Now())
+	}
+
+	// Deliveries stored before channels existed all went to Telegram.
+	for i := range record.Deliveries {
+		if record.Deliveries[i].Channel == "" {
+			record.Deliveries[i].Channel = ChannelTelegram
+		}
+	}
+
+	results, interrupted := d.dispatchQueued(ctx, record)
+	for !interrupted && d.shouldFallBack(record, time.Now()) {
+		d.fallBack(record, time.Now())
+		var round []channelResult
+		round, interrupted = d.dispatchQueued(ctx, record)
+		results = append(results, round...)
+	}
+
+	var lastErr error
+	for _, result := range results {
+		if result.lastErr != nil {
+			lastErr = result.lastErr
+		}
+	}
+
+	if !interrupted {
+		record.Attempts++
+		record.UpdatedAt = time.Now()
+		record.Status = deliveryStatus(record.Deliveries)
+		record.LastError = ""
+		if lastErr != nil {
+			record.LastError = lastErr.Error()
+		}
+		if len(record.Deliveries) == 0 {
+			record.LastError = "no recipients"
+			d.logger.Error().Str("id", record.ID).Msg("no enabled channel has a recipient for the notification")
+		}
+		switch record.Status {
+		case domain.StatusQueued:
+			record.NextAttempt = record.UpdatedAt.Add(d.retryDelay(record.Attempts))
+			// Come back in time to fall back.
+			if len(record.Fallback) > 0 && record.FallbackAt.Before(record.NextAttempt) {
+				record.NextAttempt = record.FallbackAt
+			}
+		case domain.StatusDelivered:
+			record.DeliveredVia = deliveredVia(record.Deliveries)
+			if len(record.DeliveredVia) > 0 {
+				d.logger.Info().Str("id", record.ID).Strs("channels", record.DeliveredVia).Bool("fallback", currentStage(record.Deliveries) > 0).Msg("notification delivered via")
+			}
+		}
+	}
+
+	// Only the delivery fields are written back, so lead actions recorded
+	// while the message was being sent are kept.
+	retracted := false
+	_, err := d.store.Modify(ctx, record.ID, func(stored *domain.NotificationRecord) error {
+		if stored.Status == domain.StatusRetracted {
+			retracted = true
+			return nil
+		}
+		stored.Status = record.Status
+		stored.Deliveries = record.Deliveries
+		stored.Fallback = record.Fallback
+		stored.FallbackAt = record.FallbackAt
+		stored.DeliveredVia = record.DeliveredVia
+		stored.Attempts = record.Attempts
+		stored.LastError = record.LastError
+		stored.NextAttempt = record.NextAttempt
+		stored.UpdatedAt = record.UpdatedAt
+		return nil
+	})
+	if err != nil {
+		d.logger.Error().Err(err).Str("id", record.ID).Msg("failed to update notification")
+	}
+
+	// The notification was retracted while it was being sent, so take back
+	// what went out in the meantime.
+	if retracted {
+		for _, result := range results {
+			d.retract(ctx, record, result)
+		}
+	}
+}
+
+// plan creates the deliveries of the primary channels: every enabled channel
+// that is not held back in the fallback chain of the notification.
+func (d *Dispatcher) plan(record *domain.NotificationRecord, now time.Time) {
+	var chain []string
+	if d.router != nil {
+		chain = d.router.Fallback(&record.Notification)
+	}
+
+	for _, name := range d.channels.Names() {
+		if slices.Contains(chain, name) {
+			continue
+		}
+		notifier, _ := d.channels.Get(name)
+		for _, delivery := range notifier.Deliveries(&record.Notification) {
+			delivery.Channel = name
+			record.Deliveries = append(record.Deliveries, delivery)
+		}
+	}
+
+	if len(chain) > 0 {
+		record.Fallback = chain
+		record.FallbackAt = now.Add(d.cfg.FallbackAfter)
+	}
+}
+
+// dispatchQueued sends the queued deliveries, each channel in its own
+// goroutine, and reports whether the round was cut short.
+func (d *Dispatcher) dispatchQueued(ctx context.Context, record *domain.NotificationRecord) ([]channelResult, bool) {
+	queued := map[string][]int{}
+	var names []string
+	for i, delivery := range record.Deliveries {
+		if delivery.Status != domain.StatusQueued {
+			continue
+		}
+		if _, ok := queued[delivery.Channel]; !ok {
+			names = append(names, delivery.Channel)
+		}
+		queued[delivery.Channel] = append(queued[delivery.Channel], i)
+	}
+
+	results := make([]channelResult, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = d.dispatchChannel(ctx, record, name, queued[name])
+		}()
+	}
+	wg.Wait()
+
+	interrupted := false
+	for _, result := range results {
+		interrupted = interrupted || result.interrupted
+		d.logger.Info().Str("id", record.ID).Str("channel", result.channel).Int("delivered", result.delivered).Int("failed", result.failed).Msg("channel dispatched")
+	}
+	return results, interrupted
+}
+
+// shouldFallBack reports whether the current stage is lost: nothing was
+// delivered, and every delivery failed or the stage ran past its deadline.
+func (d *Dispatcher) shouldFallBack(record *domain.NotificationRecord, now time.Time) bool {
+	if len(record.Fallback) == 0 {
+		return false
+	}
+
+	pending := false
+	for _, delivery := range record.Deliveries {
+		switch delivery.Status {
+		case domain.StatusDelivered:
+			return false
+		case domain.StatusQueued:
+			pending = true
+		}
+	}
+	return !pending || !now.Before(record.FallbackAt)
+}
+
+// fallBack gives up on the current stage and hands the notification to the
+// next channel of the chain.
+func (d *Dispatcher) fallBack(record *domain.NotificationRecord, now time.Time) {
+	name := record.Fallback[0]
+	record.Fallback = record.Fallback[1:]
+	stage := currentStage(record.Deliveries) + 1
+
+	var from []string
+	for i := range record.Deliveries {
+		delivery := &record.Deliveries[i]
+		if !slices.Contains(from, delivery.Channel) && delivery.Stage == stage-1 {
+			from = append(from, delivery.Channel)
+		}
+		if delivery.Status == domain.StatusQueued {
+			delivery.Status = domain.StatusSkipped
+			delivery.UpdatedAt = now
+		}
+	}
+
+	var deliveries []domain.Delivery
+	reason := "channel " + name + " is not enabled"
+	if notifier, ok := d.channels.Get(name); ok {
+		deliveries = notifier.Deliveries(&record.Notification)
+		reason = "channel " + name + " has no recipients"
+	}
+	// A channel that cannot take the lead still shows up in the record.
+	if len(deliveries) == 0 {
+		deliveries = []domain.Delivery{{Status: domain.StatusFailed, LastError: reason, UpdatedAt: now}}
+	}
+	for _, delivery := range deliveries {
+		delivery.Channel = name
+		delivery.Stage = stage
+		record.Deliveries = append(record.Deliveries, delivery)
+	}
+	record.FallbackAt = now.Add(d.cfg.FallbackAfter)
+
+	d.logger.Warn().Str("id", record.ID).Strs("from", from).Str("channel", name).Int("stage", stage).Msg("falling back to the next channel")
+}
+
+// dispatchChannel sends the queued deliveries at the given indexes through
+// one channel.
+func (d *Dispatcher) dispatchChannel(ctx context.Context, record *domain.NotificationRecord, name string, indexes []int) channelResult {
+	result := channelResult{channel: name}
+	notifier, ok := d.channels.Get(name)
+
+	for _, i := range indexes {
+		delivery := &record.Deliveries[i]
+		if !ok {
+			delivery.Status = domain.StatusFailed
+			delivery.LastError = "channel " + name + " is not enabled"
+			delivery.UpdatedAt = time.Now()
+			result.failed++
+			continue
+		}
+
+		err := notifier.Send(ctx, record, delivery)
+		if err != nil && ctx.Err() != nil {
+			d.logger.Warn().Err(err).Str("id", record.ID).Str("channel", name).Int64("chat_id", delivery.ChatID).Msg("dispatch interrupted, delivery stays queued")
+			result.interrupted = true
+			break
+		}
+
+		delivery.Attempts++
+		delivery.UpdatedAt = time.Now()
+		attempt := domain.Attempt{At: delivery.UpdatedAt, ResponseStatus: delivery.ResponseStatus}
+		if err != nil {
+			attempt.Error = err.Error()
+		}
+		delivery.History = append(delivery.History, attempt)
+
+		if err != nil {
+			result.lastErr = err
+			delivery.LastError = err.Error()
+			if delivery.Attempts >= d.cfg.MaxAttempts || isPermanentError(err) {
+				delivery.Status = domain.StatusFailed
+				result.failed++
+			}
+			d.logger.Error().Err(err).Str("id", record.ID).Str("channel", name).Int64("chat_id", delivery.ChatID).Int("attempts", delivery.Attempts).Msg("failed to deliver notification")
+		} else {
+			delivery.Status = domain.StatusDelivered
+			delivery.LastError = ""
+			result.delivered++
+			result.sent = append(result.sent, i)
+			d.logger.Info().Str("id", record.ID).Str("channel", name).Int64("chat_id", delivery.ChatID).Msg("notification delivered")
+		}
+	}
+
+	return result
+}
+
+func (d *Dispatcher) retract(ctx context.Context, record *domain.NotificationRecord, result channelResult) {
+	notifier, _ := d.channels.Get(result.channel)
+	retractor, ok := notifier.(Retractor)
+	if !ok {
+		return
+	}
+	for _, i := range result.sent {
+		if err := retractor.Retract(ctx, &record.Deliveries[i]); err != nil {
+			d.logger.Error().Err(err).Str("id", record.ID).Str("channel", result.channel).Msg("failed to retract notification")
+		}
+	}
+}
+
+// deliveryStatus sums up the deliveries of the current stage: queued while
+// any recipient still waits for a retry, delivered when every recipient got
+// it, failed otherwise, including when there is no recipient at all.
+func deliveryStatus(deliveries []domain.Delivery) domain.NotificationStatus {
+	if len(deliveries) == 0 {
+		return domain.StatusFailed
+	}
+
+	stage := currentStage(deliveries)
+	status := domain.StatusDelivered
+	for _, delivery := range deliveries {
+		if delivery.Stage != stage {
+			continue
+		}
+		switch delivery.Status {
+		case domain.StatusQueued:
+			return domain.StatusQueued
+		case domain.StatusFailed:
+			status = domain.StatusFailed
+		}
+	}
+	return status
+}
+
+// currentStage is the last fallback stage the notification reached.
+func currentStage(deliveries []domain.Delivery) int {
+	stage := 0
+	for _, delivery := range deliveries {
+		stage = max(stage, delivery.Stage)
+	}
+	return stage
+}
+
+// deliveredVia lists the channels with a delivered delivery, in order.
+func deliveredVia(deliveries []domain.Delivery) []string {
+	var channels []string
+	for _, delivery := range deliveries {
+		if delivery.Status == domain.StatusDelivered && !slices.Contains(channels, delivery.Channel) {
+			channels = append(channels, delivery.Channel)
+		}
+	}
+	return channels
+}
+
+// retryDelay doubles the dispatch interval with every failed attempt, so a
+// long Telegram outage does not burn through the attempt budget.
+func (d *Dispatcher) retryDelay(attempts int) time.Duration {
+	delay := d.cfg.Interval
+	for i := 1; i < attempts && delay < d.cfg.RetryCap; i++ {
+		delay *= 2
+	}
+	return min(delay, d.cfg.RetryCap)
+}
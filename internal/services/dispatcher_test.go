@@ -0,0 +1,495 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"new-client-notification-bot/config"
+	"new-client-notification-bot/internal/domain"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog"
+)
+
+type MockNotificationStore struct {
+	records map[string]*domain.NotificationRecord
+}
+
+func (m *MockNotificationStore) Save(ctx context.Context, record *domain.NotificationRecord) error {
+	m.records[record.ID] = record
+	return nil
+}
+
+func (m *MockNotificationStore) Modify(ctx context.Context, id string, fn func(record *domain.NotificationRecord) error) (*domain.NotificationRecord, error) {
+	record, ok := m.records[id]
+	if !ok {
+		return nil, errors.New("notification not found")
+	}
+	return record, fn(record)
+}
+
+func (m *MockNotificationStore) Get(ctx context.Context, id string) (*domain.NotificationRecord, error) {
+	return m.records[id], nil
+}
+
+func (m *MockNotificationStore) Pending(ctx context.Context, now time.Time, limit int) ([]*domain.NotificationRecord, error) {
+	var records []*domain.NotificationRecord
+	for _, record := range m.records {
+		if record.Status == domain.StatusQueued && !record.NextAttempt.After(now) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+var testNotification = domain.Notification{
+	Phone:            "+7 912 345 67 89",
+	CompanyName:      "Test Company",
+	NotificationText: "Test message",
+}
+
+// Recent returns records newest first; IDs in tests sort by creation.
+func (m *MockNotificationStore) Recent(ctx context.Context, limit int, match func(record *domain.NotificationRecord) bool) ([]*domain.NotificationRecord, error) {
+	var records []*domain.NotificationRecord
+	for _, record := range m.records {
+		if match(record) {
+			records = append(records, record)
+		}
+	}
+	slices.SortFunc(records, func(a, b *domain.NotificationRecord) int { return strings.Compare(b.ID, a.ID) })
+	return records[:min(limit, len(records))], nil
+}
+
+// Attachments returns the attachments as stored in the record, data included.
+func (m *MockNotificationStore) Attachments(ctx context.Context, id string) ([]domain.Attachment, error) {
+	record, ok := m.records[id]
+	if !ok {
+		return nil, errors.New("notification not found")
+	}
+	return record.Attachments, nil
+}
+
+func (m *MockNotificationStore) CountSince(ctx context.Context, since time.Time, match func(record *domain.NotificationRecord) bool) (int, error) {
+	count := 0
+	for _, record := range m.records {
+		if !record.CreatedAt.Before(since) && match(record) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func newTestDispatcher(store NotificationStoreInterface, telegram TelegramBotServiceInterface) *Dispatcher {
+	router, _ := NewRouter(&config.RoutingConfig{DefaultChatIDs: []int64{42}})
+	return newTestDispatcherWithRouter(store, telegram, router)
+}
+
+func newTestDispatcherWithRouter(store NotificationStoreInterface, telegram TelegramBotServiceInterface, router *Router) *Dispatcher {
+	logger := zerolog.Nop()
+	channels := NewRegistry()
+	channels.Register(ChannelTelegram, NewTelegramNotifier(telegram, store, router, NewMessageFormatter(&config.BotConfig{}, &config.TemplateConfig{}, &logger)))
+	return newTestDispatcherWithFallback(store, channels, router)
+}
+
+func newTestDispatcherWithChannels(store NotificationStoreInterface, channels *Registry) *Dispatcher {
+	return newTestDispatcherWithFallback(store, channels, nil)
+}
+
+func newTestDispatcherWithFallback(store NotificationStoreInterface, channels *Registry, router *Router) *Dispatcher {
+	logger := zerolog.Nop()
+	return NewDispatcher(store, channels, router, &Mute{}, &config.DispatcherConfig{
+		Interval:      time.Second,
+		BatchSize:     10,
+		MaxAttempts:   2,
+		RetryCap:      time.Minute,
+		FallbackAfter: time.Hour,
+	}, &logger)
+}
+
+func TestDispatcher_DispatchPending(t *testing.T) {
+	tests := []struct {
+		name             string
+		shouldError      bool
+		sendErr          error
+		attempts         int
+		expectedStatus   domain.NotificationStatus
+		expectedAttempts int
+	}{
+		{
+			name:             "delivered",
+			expectedStatus:   domain.StatusDelivered,
+			expectedAttempts: 1,
+		},
+		{
+			name:             "failed attempt stays queued",
+			shouldError:      true,
+			expectedStatus:   domain.StatusQueued,
+			expectedAttempts: 1,
+		},
+		{
+			name:             "last attempt marks failed",
+			shouldError:      true,
+			attempts:         1,
+			expectedStatus:   domain.StatusFailed,
+			expectedAttempts: 2,
+		},
+		{
+			name:             "permanent error marks failed",
+			sendErr:          &tgbotapi.Error{Code: http.StatusForbidden, Message: "Forbidden: bot was kicked"},
+			expectedStatus:   domain.StatusFailed,
+			expectedAttempts: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := &domain.NotificationRecord{ID: "0001", Notification: testNotification, Status: domain.StatusQueued}
+			if tt.attempts > 0 {
+				record.Attempts = tt.attempts
+				record.Deliveries = []domain.Delivery{{ChatID: 42, Status: domain.StatusQueued, Attempts: tt.attempts}}
+			}
+			store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{"0001": record}}
+			telegram := &MockTelegramBotService{shouldError: tt.shouldError, errorMsg: "telegram API error", sendErr: tt.sendErr}
+
+			newTestDispatcher(store, telegram).dispatchPending(context.Background())
+
+			record = store.records["0001"]
+			if record.Status != tt.expectedStatus {
+				t.Errorf("expected status %q, got %q", tt.expectedStatus, record.Status)
+			}
+			if len(record.Deliveries) != 1 || record.Deliveries[0].ChatID != 42 {
+				t.Fatalf("expected one delivery to chat 42, got %+v", record.Deliveries)
+			}
+			if record.Deliveries[0].Attempts != tt.expectedAttempts {
+				t.Errorf("expected %d attempts, got %d", tt.expectedAttempts, record.Deliveries[0].Attempts)
+			}
+			if len(telegram.sentMessages) != 1 || telegram.sentMessages[0] != "Клиент: Test Company;\nТелефон: +7 912 345 67 89;\nТекст обращение: Test message" {
+				t.Errorf("expected message to be sent once, got %v", telegram.sentMessages)
+			}
+			if record.Status == domain.StatusQueued && !record.NextAttempt.After(record.UpdatedAt) {
+				t.Errorf("expected next attempt to be scheduled after a failure")
+			}
+		})
+	}
+}
+
+func TestDispatcher_FanOut(t *testing.T) {
+	router, err := NewRouter(&config.RoutingConfig{
+		Routes: []config.RouteConfig{
+			{Name: "all", ChatIDs: []int64{1, 2}},
+			{Name: "company", CompanyPattern: "Test", ChatIDs: []int64{2, 3}},
+		},
+		DefaultChatIDs: []int64{42},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{
+		"0001": {ID: "0001", Notification: testNotification, Status: domain.StatusQueued},
+	}}
+	telegram := &MockTelegramBotService{errorMsg: "telegram API error", failChatIDs: []int64{2}}
+	dispatcher := newTestDispatcherWithRouter(store, telegram, router)
+
+	dispatcher.dispatchPending(context.Background())
+
+	record := store.records["0001"]
+	if !slices.Equal(telegram.sentChatIDs, []int64{1, 2, 3}) {
+		t.Errorf("expected sends to chats [1 2 3], got %v", telegram.sentChatIDs)
+	}
+	expected := []domain.NotificationStatus{domain.StatusDelivered, domain.StatusQueued, domain.StatusDelivered}
+	for i, delivery := range record.Deliveries {
+		if delivery.Status != expected[i] {
+			t.Errorf("expected chat %d status %q, got %q", delivery.ChatID, expected[i], delivery.Status)
+		}
+	}
+	if record.Status != domain.StatusQueued {
+		t.Errorf("expected status %q, got %q", domain.StatusQueued, record.Status)
+	}
+
+	telegram.failChatIDs = nil
+	telegram.sentChatIDs = nil
+	record.NextAttempt = time.Time{}
+	dispatcher.dispatchPending(context.Background())
+
+	if !slices.Equal(telegram.sentChatIDs, []int64{2}) {
+		t.Errorf("expected retry to chat 2 only, got %v", telegram.sentChatIDs)
+	}
+	if record.Status != domain.StatusDelivered {
+		t.Errorf("expected status %q, got %q", domain.StatusDelivered, record.Status)
+	}
+}
+
+func TestDispatcher_Muted(t *testing.T) {
+	store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{
+		"0001": {ID: "0001", Notification: testNotification, Status: domain.StatusQueued},
+	}}
+	telegram := &MockTelegramBotService{}
+	dispatcher := newTestDispatcher(store, telegram)
+
+	dispatcher.mute.Set(context.Background(), time.Now().Add(time.Hour))
+	dispatcher.dispatchPending(context.Background())
+
+	if len(telegram.sentMessages) != 0 || store.records["0001"].Status != domain.StatusQueued {
+		t.Errorf("expected nothing to be sent while muted")
+	}
+
+	dispatcher.mute.Set(context.Background(), time.Time{})
+	dispatcher.dispatchPending(context.Background())
+
+	if len(telegram.sentMessages) != 1 || store.records["0001"].Status != domain.StatusDelivered {
+		t.Errorf("expected queued lead to be sent after the mute")
+	}
+}
+
+func TestDispatcher_InterruptedSendStaysQueued(t *testing.T) {
+	store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{
+		"0001": {ID: "0001", Notification: testNotification, Status: domain.StatusQueued},
+	}}
+	telegram := &MockTelegramBotService{sendErr: context.Canceled}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	newTestDispatcher(store, telegram).dispatch(ctx, store.records["0001"])
+
+	record := store.records["0001"]
+	if record.Status != domain.StatusQueued || record.Attempts != 0 {
+		t.Errorf("expected untouched queued record, got status %q with %d attempts", record.Status, record.Attempts)
+	}
+}
+
+func TestDispatcher_StoresMessageIDs(t *testing.T) {
+	store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{
+		"0001": {ID: "0001", Notification: testNotification, Status: domain.StatusQueued},
+	}}
+	telegram := &MockTelegramBotService{}
+
+	newTestDispatcher(store, telegram).dispatchPending(context.Background())
+
+	deliveries := store.records["0001"].Deliveries
+	if len(deliveries) != 1 || !slices.Equal(deliveries[0].MessageIDs, []int{1}) {
+		t.Errorf("expected message id 1 to be stored, got %+v", deliveries)
+	}
+}
+
+func TestDispatcher_History(t *testing.T) {
+	store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{
+		"0001": {ID: "0001", Notification: testNotification, Status: domain.StatusQueued},
+	}}
+	telegram := &MockTelegramBotService{shouldError: true, errorMsg: "telegram down"}
+	dispatcher := newTestDispatcher(store, telegram)
+
+	dispatcher.dispatchPending(context.Background())
+	telegram.shouldError = false
+	store.records["0001"].NextAttempt = time.Time{}
+	dispatcher.dispatchPending(context.Background())
+
+	history := store.records["0001"].Deliveries[0].History
+	if len(history) != 2 || history[0].Error != "telegram down" || history[1].Error != "" || history[1].At.Before(history[0].At) {
+		t.Errorf("expected a failed and a successful attempt, got %+v", history)
+	}
+}
+
+func TestDispatcher_Topics(t *testing.T) {
+	store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{
+		"0001": {ID: "0001", Notification: testNotification, Status: domain.StatusQueued},
+	}}
+	telegram := &MockTelegramBotService{}
+	router, _ := NewRouter(&config.RoutingConfig{DefaultTargets: []config.TargetConfig{{ChatID: -100, ThreadID: 5}}})
+
+	newTestDispatcherWithRouter(store, telegram, router).dispatchPending(context.Background())
+
+	deliveries := store.records["0001"].Deliveries
+	if len(deliveries) != 1 || deliveries[0].ChatID != -100 || deliveries[0].ThreadID != 5 {
+		t.Errorf("expected a delivery to topic 5 of chat -100, got %+v", deliveries)
+	}
+	if !slices.Equal(telegram.sentTopics, []int{5}) {
+		t.Errorf("expected the lead sent to topic 5, got %v", telegram.sentTopics)
+	}
+}
+
+func TestDispatcher_NoRecipients(t *testing.T) {
+	store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{
+		"0001": {ID: "0001", Notification: testNotification, Status: domain.StatusQueued},
+	}}
+
+	newTestDispatcherWithChannels(store, NewRegistry()).dispatchPending(context.Background())
+
+	record := store.records["0001"]
+	if record.Status != domain.StatusFailed || record.LastError != "no recipients" {
+		t.Errorf("expected failed with no recipients, got %q, %q", record.Status, record.LastError)
+	}
+}
+
+func TestDispatcher_KeepsPartiallySentChunks(t *testing.T) {
+	store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{
+		"0001": {ID: "0001", Notification: testNotification, Status: domain.StatusQueued},
+	}}
+	telegram := &MockTelegramBotService{sendErr: errors.New("timeout"), partialIDs: []int{11}}
+	dispatcher := newTestDispatcher(store, telegram)
+
+	dispatcher.dispatchPending(context.Background())
+
+	delivery := store.records["0001"].Deliveries[0]
+	if delivery.Status != domain.StatusQueued || !slices.Equal(delivery.MessageIDs, []int{11}) {
+		t.Fatalf("expected the sent chunk kept on the queued delivery, got %+v", delivery)
+	}
+
+	telegram.sendErr = nil
+	store.records["0001"].NextAttempt = time.Time{}
+	dispatcher.dispatchPending(context.Background())
+
+	delivery = store.records["0001"].Deliveries[0]
+	if len(telegram.sentMessages) != 1 || delivery.Status != domain.StatusDelivered || !slices.Equal(delivery.MessageIDs, []int{11}) {
+		t.Errorf("expected the retry to resume after chunk 11, got %d sends and %+v", len(telegram.sentMessages), delivery)
+	}
+}
+
+func TestDispatcher_Attachments(t *testing.T) {
+	store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{
+		"0001": {ID: "0001", Notification: testNotification, Status: domain.StatusQueued, Attachments: []domain.Attachment{
+			{Name: "brief.pdf", ContentType: "application/pdf", Size: 4, Data: []byte("%PDF")},
+		}},
+	}}
+	telegram := &MockTelegramBotService{}
+	dispatcher := newTestDispatcher(store, telegram)
+
+	dispatcher.dispatchPending(context.Background())
+
+	delivery := store.records["0001"].Deliveries[0]
+	if len(telegram.attached) != 1 || telegram.attached[0].ReplyTo != 1 {
+		t.Errorf("expected the files sent as a reply to message 1, got %+v", telegram.attached)
+	}
+	if delivery.Status != domain.StatusDelivered || !slices.Equal(delivery.AttachmentMessageIDs, []int{100}) {
+		t.Errorf("expected delivered with attachment message 100, got %+v", delivery)
+	}
+
+	manager := newTestManager(store, telegram)
+	if _, err := manager.Retract(context.Background(), "0001"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(telegram.deleted) != 1 || !slices.Equal(telegram.deleted[0].MessageIDs, []int{1, 100}) {
+		t.Errorf("expected the lead and its files to be deleted, got %+v", telegram.deleted)
+	}
+}
+
+func TestDispatcher_AttachmentsFailed(t *testing.T) {
+	store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{
+		"0001": {ID: "0001", Notification: testNotification, Status: domain.StatusQueued, Attachments: []domain.Attachment{
+			{Name: "brief.pdf", ContentType: "application/pdf", Size: 4, Data: []byte("%PDF")},
+		}},
+	}}
+	telegram := &MockTelegramBotService{attachErr: errors.New("upload failed")}
+	dispatcher := newTestDispatcher(store, telegram)
+
+	dispatcher.dispatchPending(context.Background())
+
+	// The lead went out, so the failed upload does not fail or requeue it.
+	record := store.records["0001"]
+	delivery := record.Deliveries[0]
+	if record.Status != domain.StatusDelivered || delivery.Status != domain.StatusDelivered {
+		t.Fatalf("expected the lead delivered despite the upload, got %+v", record)
+	}
+	if delivery.AttachmentError != "upload failed" || delivery.LastError != "" || len(delivery.AttachmentMessageIDs) != 0 {
+		t.Errorf("expected the upload error recorded apart, got %+v", delivery)
+	}
+	if !slices.Equal(delivery.MessageIDs, []int{1}) || len(telegram.sentMessages) != 1 {
+		t.Errorf("expected the lead sent once as message 1, got %+v", delivery)
+	}
+}
+
+func TestDispatcher_ContactCard(t *testing.T) {
+	store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{
+		"0001": {ID: "0001", Notification: testNotification, Status: domain.StatusQueued, Attachments: []domain.Attachment{
+			{Name: "brief.pdf", ContentType: "application/pdf", Size: 4, Data: []byte("%PDF")},
+		}},
+	}}
+	telegram := &MockTelegramBotService{}
+	router, _ := NewRouter(&config.RoutingConfig{DefaultChatIDs: []int64{42}, DefaultContactCard: true})
+	dispatcher := newTestDispatcherWithRouter(store, telegram, router)
+
+	dispatcher.dispatchPending(context.Background())
+
+	if len(telegram.contacts) != 1 || telegram.contacts[0].ReplyTo != 1 {
+		t.Fatalf("expected one contact card replying to message 1, got %+v", telegram.contacts)
+	}
+	delivery := store.records["0001"].Deliveries[0]
+	if delivery.Status != domain.StatusDelivered || delivery.ContactMessageID != 200 {
+		t.Errorf("expected delivered with contact message 200, got %+v", delivery)
+	}
+
+	if _, err := newTestManager(store, telegram).Retract(context.Background(), "0001"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(telegram.deleted) != 1 || !slices.Equal(telegram.deleted[0].MessageIDs, []int{1, 100, 200}) {
+		t.Errorf("expected the lead, its files and the card to be deleted, got %+v", telegram.deleted)
+	}
+}
+
+func TestDispatcher_ContactCardFailed(t *testing.T) {
+	store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{
+		"0001": {ID: "0001", Notification: testNotification, Status: domain.StatusQueued, Attachments: []domain.Attachment{
+			{Name: "brief.pdf", ContentType: "application/pdf", Size: 4, Data: []byte("%PDF")},
+		}},
+	}}
+	telegram := &MockTelegramBotService{contactErr: errors.New("Bad Request: phone number is invalid")}
+	router, _ := NewRouter(&config.RoutingConfig{DefaultChatIDs: []int64{42}, DefaultContactCard: true})
+
+	newTestDispatcherWithRouter(store, telegram, router).dispatchPending(context.Background())
+
+	// The card failing neither fails the lead nor holds back the files.
+	record := store.records["0001"]
+	delivery := record.Deliveries[0]
+	if record.Status != domain.StatusDelivered || delivery.Status != domain.StatusDelivered {
+		t.Fatalf("expected the lead delivered despite the card, got %+v", record)
+	}
+	if delivery.ContactError != "Bad Request: phone number is invalid" || delivery.ContactMessageID != 0 || delivery.LastError != "" {
+		t.Errorf("expected the card error recorded apart, got %+v", delivery)
+	}
+	if !slices.Equal(delivery.AttachmentMessageIDs, []int{100}) {
+		t.Errorf("expected the files sent after the failed card, got %+v", delivery)
+	}
+}
+
+func TestDispatcher_RetractedWhileSending(t *testing.T) {
+	store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{
+		"0001": {ID: "0001", Notification: testNotification, Status: domain.StatusRetracted},
+	}}
+	telegram := &MockTelegramBotService{}
+
+	// The dispatcher still holds the copy it loaded before the retraction.
+	loaded := &domain.NotificationRecord{ID: "0001", Notification: testNotification, Status: domain.StatusQueued}
+	newTestDispatcher(store, telegram).dispatch(context.Background(), loaded)
+
+	if store.records["0001"].Status != domain.StatusRetracted {
+		t.Errorf("expected retraction to be kept, got %q", store.records["0001"].Status)
+	}
+	if len(telegram.deleted) != 1 || telegram.deleted[0].ChatID != 42 {
+		t.Errorf("expected the message sent meanwhile to be deleted, got %+v", telegram.deleted)
+	}
+}
+
+func TestDispatcher_RetryDelay(t *testing.T) {
+	d := newTestDispatcher(nil, nil)
+
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{attempts: 1, expected: time.Second},
+		{attempts: 2, expected: 2 * time.Second},
+		{attempts: 4, expected: 8 * time.Second},
+		{attempts: 10, expected: time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := d.retryDelay(tt.attempts); got != tt.expected {
+			t.Errorf("retryDelay(%d) = %v, expected %v", tt.attempts, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"new-client-notification-bot/config"
+	"new-client-notification-bot/internal/domain"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const ChannelEmail = "email"
+
+const leadTitlePrefix = "Новая заявка: "
+
+// emailHTMLLayout wraps the lead rendered in HTML mode. pre-wrap keeps the
+// line breaks of the template.
+const emailHTMLLayout = `<!DOCTYPE html>
+<html><body><div style="white-space: pre-wrap; font-family: sans-serif">%s</div></body></html>`
+
+var errSTARTTLSUnsupported = errors.New("smtp server does not support STARTTLS")
+
+// EmailService delivers notifications by SMTP, one email per recipient, with
+// a plain text and an HTML version of the lead.
+type EmailService struct {
+	cfg       *config.EmailConfig
+	text      *MessageFormatter
+	html      *MessageFormatter
+	retry     RetryPolicy
+	tlsConfig *tls.Config
+	logger    *zerolog.Logger
+}
+
+func NewEmailService(cfg *config.EmailConfig, templateCfg *config.TemplateConfig, logger *zerolog.Logger) *EmailService {
+	return &EmailService{
+		cfg:  cfg,
+		text: NewMessageFormatter(&config.BotConfig{ParseMode: ParseModePlain}, templateCfg, logger),
+		html: NewMessageFormatter(&config.BotConfig{ParseMode: ParseModeHTML}, templateCfg, logger),
+		retry: RetryPolicy{
+			MaxAttempts: cfg.RetryMaxAttempts,
+			BaseDelay:   cfg.RetryBaseDelay,
+			MaxDelay:    cfg.RetryMaxDelay,
+		},
+		tlsConfig: &tls.Config{ServerName: cfg.Host},
+		logger:    logger,
+	}
+}
+
+func (e *EmailService) Deliveries(notification *domain.Notification) []domain.Delivery {
+	var deliveries []domain.Delivery
+	for _, to := range e.cfg.To {
+		deliveries = append(deliveries, domain.Delivery{Recipient: to, Status: domain.StatusQueued})
+	}
+	return deliveries
+}
+
+func (e *EmailService) Send(ctx context.Context, record *domain.NotificationRecord, delivery *domain.Delivery) error {
+	// The envelope takes bare addresses, the headers keep display names.
+	from, err := mail.ParseAddress(e.cfg.From)
+	if err != nil {
+		return Permanent(fmt.Errorf("parse sender: %w", err))
+	}
+	to, err := mail.ParseAddress(delivery.Recipient)
+	if err != nil {
+		return Permanent(fmt.Errorf("parse recipient: %w", err))
+	}
+
+	msg, err := e.compose(record, from, to)
+	if err != nil {
+		return Permanent(err)
+	}
+
+	attempt := 0
+	err = e.retry.Do(ctx, classifySMTPError, func() error {
+		attempt++
+		err := e.sendMail(ctx, from.Address, to.Address, msg)
+		if err != nil {
+			e.logger.Warn().Err(err).Int("attempt", attempt).Str("recipient", delivery.Recipient).Msg("smtp attempt failed")
+		}
+		return err
+	})
+	if err != nil {
+		e.logger.Error().Err(err).Str("recipient", delivery.Recipient).Msg("failed to send email")
+		if retry, _ := classifySMTPError(err); !retry {
+			return Permanent(err)
+		}
+		return err
+	}
+
+	e.logger.Info().Str("id", record.ID).Str("recipient", delivery.Recipient).Msg("email sent")
+	return nil
+}
+
+// sendMail runs one SMTP session. net/smtp knows nothing about contexts, so
+// the session is bounded by a connection deadline and cut off on cancel.
+func (e *EmailService) sendMail(ctx context.Context, from, to string, msg []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, e.cfg.Timeout)
+	defer cancel()
+
+	addr := net.JoinHostPort(e.cfg.Host, strconv.Itoa(e.cfg.Port))
+	dialer := &net.Dialer{}
+	var conn net.Conn
+	var err error
+	if e.cfg.TLSMode == config.SMTPTLSImplicit {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: e.tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	client, err := smtp.NewClient(conn, e.cfg.Host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if e.cfg.TLSMode == config.SMTPTLSStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errSTARTTLSUnsupported
+		}
+		if err := client.StartTLS(e.tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if e.cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", e.cfg.Username, e.cfg.Password, e.cfg.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// compose renders the lead as a multipart/alternative email. The addresses
+// are written with their display names encoded, as these may be Cyrillic.
+func (e *EmailService) compose(record *domain.NotificationRecord, from, to *mail.Address) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	parts := []struct {
+		contentType string
+		content     string
+	}{
+		{contentType: "text/plain; charset=utf-8", content: e.text.Format(record)},
+		{contentType: "text/html; charset=utf-8", content: fmt.Sprintf(emailHTMLLayout, e.html.Format(record))},
+	}
+	for _, part := range parts {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	// Fields joins the company name into one line, so it cannot add headers.
+	subject := strings.Join(strings.Fields(leadTitlePrefix+record.Notification.CompanyName), " ")
+
+	var msg bytes.Buffer
+	headers := [][2]string{
+		{"From", from.String()},
+		{"To", to.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", "<" + record.ID + "@" + e.cfg.Host + ">"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + mw.Boundary()},
+	}
+	for _, header := range headers {
+		msg.WriteString(header[0] + ": " + header[1] + "\r\n")
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+
+	return msg.Bytes(), nil
+}
+
+// classifySMTPError retries 4xx replies and connection failures. 5xx replies
+// (unknown mailbox, rejected auth) and a server without STARTTLS will fail
+// the same way every time.
+func classifySMTPError(err error) (bool, time.Duration) {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 400 && protoErr.Code < 500, 0
+	}
+	if errors.Is(err, errSTARTTLSUnsupported) {
+		return false, 0
+	}
+	return true, 0
+}
@@ -0,0 +1,372 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"new-client-notification-bot/config"
+	"new-client-notification-bot/internal/domain"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode"
+
+	"github.com/rs/zerolog"
+)
+
+// smtpStandIn is a minimal in-process SMTP server. It speaks just enough of
+// the protocol for net/smtp: EHLO, STARTTLS, AUTH PLAIN, MAIL, RCPT and DATA.
+type smtpStandIn struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	startTLS  bool
+
+	mu sync.Mutex
+	// rcptReplies are the replies to the next RCPT commands, "250 OK" once
+	// they run out.
+	rcptReplies []string
+	sessions    int
+	auth        []string
+	messages    []smtpMessage
+}
+
+type smtpMessage struct {
+	from string
+	to   string
+	tls  bool
+	data string
+}
+
+// newSMTPStandIn starts a stand-in on a local port. With implicit set the
+// whole session runs over TLS.
+func newSMTPStandIn(t *testing.T, implicit, startTLS bool, rcptReplies ...string) (*smtpStandIn, *x509.CertPool) {
+	t.Helper()
+
+	cert, pool := newTestCertificate(t)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	if implicit {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := &smtpStandIn{listener: listener, tlsConfig: tlsConfig, startTLS: startTLS, rcptReplies: rcptReplies}
+	go s.serve(implicit)
+	return s, pool
+}
+
+func (s *smtpStandIn) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpStandIn) serve(implicit bool) {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.session(conn, implicit)
+	}
+}
+
+func (s *smtpStandIn) session(conn net.Conn, secure bool) {
+	defer conn.Close()
+	s.mu.Lock()
+	s.sessions++
+	s.mu.Unlock()
+
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 stand-in ESMTP")
+
+	var msg smtpMessage
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250-stand-in")
+			if s.startTLS && !secure {
+				tp.PrintfLine("250-STARTTLS")
+			}
+			tp.PrintfLine("250 AUTH PLAIN")
+		case "STARTTLS":
+			tp.PrintfLine("220 ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, secure = tlsConn, true
+			tp = textproto.NewConn(conn)
+		case "AUTH":
+			s.mu.Lock()
+			s.auth = append(s.auth, arg)
+			s.mu.Unlock()
+			tp.PrintfLine("235 authenticated")
+		case "MAIL":
+			msg = smtpMessage{from: addressArg(arg), tls: secure}
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			msg.to = addressArg(arg)
+			tp.PrintfLine("%s", s.nextRcptReply())
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("250 OK")
+		}
+	}
+}
+
+func (s *smtpStandIn) nextRcptReply() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.rcptReplies) == 0 {
+		return "250 OK"
+	}
+	reply := s.rcptReplies[0]
+	s.rcptReplies = s.rcptReplies[1:]
+	return reply
+}
+
+// addressArg turns "FROM:<a@b>" into "a@b".
+func addressArg(arg string) string {
+	_, addr, _ := strings.Cut(arg, ":")
+	addr, _, _ = strings.Cut(addr, " ")
+	return strings.Trim(addr, "<>")
+}
+
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "stand-in"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func newTestEmailService(port int, tlsMode, username string, pool *x509.CertPool) *EmailService {
+	logger := zerolog.Nop()
+	service := NewEmailService(&config.EmailConfig{
+		Host:             "127.0.0.1",
+		Port:             port,
+		Username:         username,
+		Password:         "secret",
+		From:             "Лиды <bot@example.com>",
+		To:               []string{"sales@example.com", "Boss <boss@example.com>"},
+		TLSMode:          tlsMode,
+		Timeout:          time.Second,
+		RetryMaxAttempts: 3,
+		RetryBaseDelay:   time.Millisecond,
+		RetryMaxDelay:    time.Millisecond,
+	}, &config.TemplateConfig{}, &logger)
+	service.tlsConfig.RootCAs = pool
+	return service
+}
+
+func TestEmailService_Deliveries(t *testing.T) {
+	service := newTestEmailService(25, config.SMTPTLSNone, "", nil)
+
+	deliveries := service.Deliveries(&testNotification)
+	if len(deliveries) != 2 || deliveries[0].Recipient != "sales@example.com" || deliveries[1].Recipient != "Boss <boss@example.com>" {
+		t.Errorf("expected a delivery per recipient, got %+v", deliveries)
+	}
+}
+
+func TestEmailService_Send(t *testing.T) {
+	tests := []struct {
+		name        string
+		tlsMode     string
+		username    string
+		rcptReplies []string
+		sessions    int
+		expectTLS   bool
+		expectAuth  bool
+	}{
+		{name: "plain", tlsMode: config.SMTPTLSNone, username: "bot", sessions: 1, expectAuth: true},
+		{name: "starttls", tlsMode: config.SMTPTLSStartTLS, username: "bot", sessions: 1, expectTLS: true, expectAuth: true},
+		{name: "implicit tls", tlsMode: config.SMTPTLSImplicit, sessions: 1, expectTLS: true},
+		{name: "temporary rejection is retried", tlsMode: config.SMTPTLSNone, rcptReplies: []string{"451 try again later"}, sessions: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, pool := newSMTPStandIn(t, tt.tlsMode == config.SMTPTLSImplicit, tt.tlsMode == config.SMTPTLSStartTLS, tt.rcptReplies...)
+			service := newTestEmailService(server.port(), tt.tlsMode, tt.username, pool)
+
+			record := &domain.NotificationRecord{ID: "0001", Notification: testNotification}
+			delivery := &domain.Delivery{Recipient: "Boss <boss@example.com>"}
+			if err := service.Send(context.Background(), record, delivery); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			server.mu.Lock()
+			defer server.mu.Unlock()
+			if server.sessions != tt.sessions {
+				t.Errorf("expected %d sessions, got %d", tt.sessions, server.sessions)
+			}
+			if len(server.messages) != 1 {
+				t.Fatalf("expected one message, got %d", len(server.messages))
+			}
+			msg := server.messages[0]
+			if msg.from != "bot@example.com" || msg.to != "boss@example.com" {
+				t.Errorf("unexpected envelope %s -> %s", msg.from, msg.to)
+			}
+			if msg.tls != tt.expectTLS {
+				t.Errorf("expected tls %v, got %v", tt.expectTLS, msg.tls)
+			}
+			if (len(server.auth) > 0) != tt.expectAuth {
+				t.Errorf("expected auth %v, got %v", tt.expectAuth, server.auth)
+			}
+			if tt.expectAuth {
+				credentials, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(server.auth[0], "PLAIN "))
+				if string(credentials) != "\x00bot\x00secret" {
+					t.Errorf("unexpected credentials %q", credentials)
+				}
+			}
+			checkLeadEmail(t, msg.data)
+		})
+	}
+}
+
+func TestEmailService_PermanentRejection(t *testing.T) {
+	server, pool := newSMTPStandIn(t, false, false, "550 no such user")
+	service := newTestEmailService(server.port(), config.SMTPTLSNone, "", pool)
+
+	record := &domain.NotificationRecord{ID: "0001", Notification: testNotification}
+	err := service.Send(context.Background(), record, &domain.Delivery{Recipient: "nobody@example.com"})
+	if err == nil || !isPermanentError(err) {
+		t.Fatalf("expected permanent error, got %v", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.sessions != 1 {
+		t.Errorf("expected no retries, got %d sessions", server.sessions)
+	}
+}
+
+func TestEmailService_STARTTLSUnsupported(t *testing.T) {
+	server, pool := newSMTPStandIn(t, false, false)
+	service := newTestEmailService(server.port(), config.SMTPTLSStartTLS, "bot", pool)
+
+	record := &domain.NotificationRecord{ID: "0001", Notification: testNotification}
+	err := service.Send(context.Background(), record, &domain.Delivery{Recipient: "sales@example.com"})
+	if !isPermanentError(err) {
+		t.Fatalf("expected permanent error, got %v", err)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.messages) != 0 {
+		t.Errorf("expected nothing to be sent in the clear")
+	}
+}
+
+// checkLeadEmail parses a sent email and checks its headers and both parts.
+func checkLeadEmail(t *testing.T, data string) {
+	t.Helper()
+
+	msg, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to parse email: %v", err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Новая заявка: Test Company" {
+		t.Errorf("unexpected subject %q (%v)", subject, err)
+	}
+	for _, header := range []struct{ name, value string }{
+		{name: "From", value: "Лиды <bot@example.com>"},
+		{name: "To", value: "Boss <boss@example.com>"},
+	} {
+		raw := msg.Header.Get(header.name)
+		if strings.ContainsFunc(raw, func(r rune) bool { return r > unicode.MaxASCII }) {
+			t.Errorf("expected an encoded %s header, got %q", header.name, raw)
+		}
+		addresses, err := msg.Header.AddressList(header.name)
+		if err != nil || len(addresses) != 1 {
+			t.Fatalf("failed to parse %s header %q: %v", header.name, raw, err)
+		}
+		if got := addresses[0].Name + " <" + addresses[0].Address + ">"; got != header.value {
+			t.Errorf("unexpected %s header %q", header.name, got)
+		}
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("expected multipart/alternative, got %q (%v)", mediaType, err)
+	}
+
+	parts := map[string]string{}
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read part: %v", err)
+		}
+		body, _ := io.ReadAll(part)
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		parts[contentType] = string(body)
+	}
+
+	if text := parts["text/plain"]; !strings.Contains(text, "Клиент: Test Company;") {
+		t.Errorf("unexpected text part %q", text)
+	}
+	if html := parts["text/html"]; !strings.Contains(html, "<b>Test Company</b>") || !strings.Contains(html, `<a href="tel:+79123456789">`) {
+		t.Errorf("unexpected html part %q", html)
+	}
+}
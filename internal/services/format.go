@@ -0,0 +1,276 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"new-client-notification-bot/config"
+	"new-client-notification-bot/internal/domain"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	ParseModePlain      = ""
+	ParseModeHTML       = "HTML"
+	ParseModeMarkdownV2 = "MarkdownV2"
+)
+
+// notificationTemplate is the name of the template that renders the message
+// body. Other templates in the directory may be used as partials.
+const notificationTemplate = "notification"
+
+const builtinTemplate = `Клиент: {{bold .CompanyName}};
+Телефон: {{phoneLink .Phone}};
+Текст обращение: {{.NotificationText}}
+{{- with .ContactName}}
+Контактное лицо: {{.}}{{end}}
+{{- with .Email}}
+Email: {{.}}{{end}}
+{{- with .PreferredContact}}
+Способ связи: {{.}}{{end}}
+{{- with .Source}}
+Источник: {{.}}{{end}}
+{{- with .PageURL}}
+Страница: {{.}}{{end}}
+{{- with .UTM}}
+UTM: {{.}}{{end}}
+{{- range $name, $value := .CustomFields}}
+{{escape $name}}: {{$value}}{{end}}`
+
+var (
+	nonDigits         = regexp.MustCompile(`\D`)
+	markdownV2Escaper = strings.NewReplacer(
+		`\`, `\\`, "_", `\_`, "*", `\*`, "[", `\[`, "]", `\]`, "(", `\(`, ")", `\)`,
+		"~", `\~`, "`", "\\`", ">", `\>`, "#", `\#`, "+", `\+`, "-", `\-`, "=", `\=`,
+		"|", `\|`, "{", `\{`, "}", `\}`, ".", `\.`, "!", `\!`,
+	)
+	markdownV2URLEscaper = strings.NewReplacer(`\`, `\\`, ")", `\)`)
+)
+
+// MessageData is what notification templates are executed with. All string
+// fields are already escaped for the parse mode, so templates can print them
+// as is. The only exception are the keys of CustomFields, kept as sent so
+// templates can look fields up with index; print them with escape.
+type MessageData struct {
+	domain.Notification
+	// UTM lists the UTM tags that are set, as "utm_source=..., utm_medium=...".
+	UTM        string
+	ReceivedAt time.Time
+	ClientIP   string
+	RequestID  string
+}
+
+type MessageFormatter struct {
+	parseMode string
+	builtin   *template.Template
+	custom    *template.Template
+	logger    *zerolog.Logger
+}
+
+// NewMessageFormatter loads notification templates from cfg.Dir. A missing,
+// unparsable or failing template is logged and the built-in layout is used
+// instead, so a bad edit never stops delivery.
+func NewMessageFormatter(botCfg *config.BotConfig, cfg *config.TemplateConfig, logger *zerolog.Logger) *MessageFormatter {
+	f := &MessageFormatter{
+		parseMode: botCfg.ParseMode,
+		logger:    logger,
+	}
+	f.builtin = template.Must(f.newTemplate().Parse(builtinTemplate))
+
+	if cfg.Dir == "" {
+		return f
+	}
+
+	custom, err := f.loadTemplates(cfg.Dir)
+	if err != nil {
+		logger.Error().Err(err).Str("dir", cfg.Dir).Msg("invalid notification templates, using built-in template")
+		return f
+	}
+	f.custom = custom
+	logger.Info().Str("dir", cfg.Dir).Msg("notification templates loaded")
+
+	return f
+}
+
+func (f *MessageFormatter) ParseMode() string {
+	return f.parseMode
+}
+
+// Format renders a lead for Telegram. Every user-supplied field is escaped
+// for the parse mode, so client input can never open or close an entity.
+func (f *MessageFormatter) Format(record *domain.NotificationRecord) string {
+	data := f.messageData(record)
+
+	if f.custom != nil {
+		message, err := execute(f.custom, data)
+		if err == nil {
+			return message
+		}
+		f.logger.Error().Err(err).Str("id", record.ID).Msg("failed to render notification template, using built-in template")
+	}
+
+	message, err := execute(f.builtin, data)
+	if err != nil {
+		f.logger.Error().Err(err).Str("id", record.ID).Msg("failed to render built-in notification template")
+	}
+	return message
+}
+
+func (f *MessageFormatter) Escape(s string) string {
+	return escapeText(f.parseMode, s)
+}
+
+func escapeText(parseMode, s string) string {
+	switch parseMode {
+	case ParseModeHTML:
+		return html.EscapeString(s)
+	case ParseModeMarkdownV2:
+		return markdownV2Escaper.Replace(s)
+	default:
+		return s
+	}
+}
+
+func (f *MessageFormatter) newTemplate() *template.Template {
+	return template.New(notificationTemplate).Option("missingkey=error").Funcs(template.FuncMap{
+		"escape":    f.Escape,
+		"bold":      f.bold,
+		"phoneLink": f.phoneLink,
+		"date": func(t time.Time, layout string) string {
+			return f.Escape(t.Format(layout))
+		},
+	})
+}
+
+func (f *MessageFormatter) loadTemplates(dir string) (*template.Template, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no *.tmpl files in %s", dir)
+	}
+
+	tmpl := f.newTemplate()
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		if _, err := tmpl.New(name).Parse(string(content)); err != nil {
+			return nil, err
+		}
+	}
+
+	if tmpl.Lookup(notificationTemplate) == nil {
+		return nil, fmt.Errorf("%s.tmpl not found in %s", notificationTemplate, dir)
+	}
+
+	sample := &domain.NotificationRecord{
+		ID: "sample",
+		Notification: domain.Notification{
+			Phone:            "+7 912 345 67 89",
+			CompanyName:      "Sample Company",
+			NotificationText: "Sample text",
+			Source:           "landing",
+			ContactName:      "Sample Name",
+			Email:            "client@example.com",
+			PreferredContact: domain.ContactPhone,
+			PageURL:          "https://example.com/",
+			UTMSource:        "sample",
+			CustomFields:     map[string]string{"sample": "value"},
+		},
+		ClientIP:  "127.0.0.1",
+		RequestID: "sample",
+		CreatedAt: time.Now(),
+	}
+	if _, err := execute(tmpl, f.messageData(sample)); err != nil {
+		return nil, err
+	}
+
+	return tmpl, nil
+}
+
+func (f *MessageFormatter) messageData(record *domain.NotificationRecord) MessageData {
+	n := record.Notification
+	var custom map[string]string
+	if len(n.CustomFields) > 0 {
+		custom = make(map[string]string, len(n.CustomFields))
+		for name, value := range n.CustomFields {
+			custom[name] = f.Escape(value)
+		}
+	}
+
+	return MessageData{
+		Notification: domain.Notification{
+			Phone:            f.Escape(n.Phone),
+			CompanyName:      f.Escape(n.CompanyName),
+			NotificationText: f.Escape(n.NotificationText),
+			Source:           f.Escape(n.Source),
+			ContactName:      f.Escape(n.ContactName),
+			Email:            f.Escape(n.Email),
+			PreferredContact: f.Escape(n.PreferredContact),
+			PageURL:          f.Escape(n.PageURL),
+			UTMSource:        f.Escape(n.UTMSource),
+			UTMMedium:        f.Escape(n.UTMMedium),
+			UTMCampaign:      f.Escape(n.UTMCampaign),
+			UTMTerm:          f.Escape(n.UTMTerm),
+			UTMContent:       f.Escape(n.UTMContent),
+			CustomFields:     custom,
+		},
+		UTM:        f.Escape(utmSummary(&n)),
+		ReceivedAt: record.CreatedAt,
+		ClientIP:   f.Escape(record.ClientIP),
+		RequestID:  f.Escape(record.RequestID),
+	}
+}
+
+// bold and phoneLink receive values that are already escaped.
+func (f *MessageFormatter) bold(s string) string {
+	switch f.parseMode {
+	case ParseModeHTML:
+		return "<b>" + s + "</b>"
+	case ParseModeMarkdownV2:
+		return "*" + s + "*"
+	default:
+		return s
+	}
+}
+
+func (f *MessageFormatter) phoneLink(phone string) string {
+	uri := "tel:" + normalizePhone(phone)
+	switch f.parseMode {
+	case ParseModeHTML:
+		return fmt.Sprintf(`<a href="%s">%s</a>`, uri, phone)
+	case ParseModeMarkdownV2:
+		return fmt.Sprintf("[%s](%s)", phone, markdownV2URLEscaper.Replace(uri))
+	default:
+		return phone
+	}
+}
+
+func execute(tmpl *template.Template, data MessageData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, notificationTemplate, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// normalizePhone turns any accepted spelling of a Russian mobile number into
+// +7XXXXXXXXXX.
+func normalizePhone(phone string) string {
+	digits := nonDigits.ReplaceAllString(phone, "")
+	if len(digits) == 11 && digits[0] == '8' {
+		digits = "7" + digits[1:]
+	}
+	return "+" + digits
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"new-client-notification-bot/config"
+	"new-client-notification-bot/internal/domain"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func newTestFormatter(t *testing.T, parseMode string, templates map[string]string) *MessageFormatter {
+	t.Helper()
+
+	cfg := &config.TemplateConfig{}
+	if templates != nil {
+		cfg.Dir = t.TempDir()
+		for name, content := range templates {
+			if err := os.WriteFile(filepath.Join(cfg.Dir, name), []byte(content), 0o644); err != nil {
+				t.Fatalf("failed to write template: %v", err)
+			}
+		}
+	}
+
+	logger := zerolog.Nop()
+	return NewMessageFormatter(&config.BotConfig{ParseMode: parseMode}, cfg, &logger)
+}
+
+func TestMessageFormatter_Format(t *testing.T) {
+	tests := []struct {
+		name      string
+		parseMode string
+		input     domain.Notification
+		expected  string
+	}{
+		{
+			name: "valid notification formatting",
+			input: domain.Notification{
+				Phone:            "+7 912 345 67 89",
+				CompanyName:      "Test Company",
+				NotificationText: "Test message",
+			},
+			expected: "Клиент: Test Company;\nТелефон: +7 912 345 67 89;\nТекст обращение: Test message",
+		},
+		{
+			name: "notification with special characters",
+			input: domain.Notification{
+				Phone:            "8 912 345 67 89",
+				CompanyName:      "ООО \"Рога и копыта\"",
+				NotificationText: "Сообщение с переносами\nстрок",
+			},
+			expected: "Клиент: ООО \"Рога и копыта\";\nТелефон: 8 912 345 67 89;\nТекст обращение: Сообщение с переносами\nстрок",
+		},
+		{
+			name:      "html",
+			parseMode: ParseModeHTML,
+			input: domain.Notification{
+				Phone:            "8 912 345 67 89",
+				CompanyName:      "<b>Рога & копыта</b>",
+				NotificationText: "<a href=\"https://evil\">click</a>",
+			},
+			expected: "Клиент: <b>&lt;b&gt;Рога &amp; копыта&lt;/b&gt;</b>;\n" +
+				"Телефон: <a href=\"tel:+79123456789\">8 912 345 67 89</a>;\n" +
+				"Текст обращение: &lt;a href=&#34;https://evil&#34;&gt;click&lt;/a&gt;",
+		},
+		{
+			name:      "markdownv2",
+			parseMode: ParseModeMarkdownV2,
+			input: domain.Notification{
+				Phone:            "+7 (912) 345-67-89",
+				CompanyName:      "*bold_company*",
+				NotificationText: "[link](https://evil). Done!",
+			},
+			expected: "Клиент: *\\*bold\\_company\\**;\n" +
+				"Телефон: [\\+7 \\(912\\) 345\\-67\\-89](tel:+79123456789);\n" +
+				"Текст обращение: \\[link\\]\\(https://evil\\)\\. Done\\!",
+		},
+		{
+			name:      "optional fields",
+			parseMode: ParseModeHTML,
+			input: domain.Notification{
+				Phone:            "+7 912 345 67 89",
+				CompanyName:      "Test Company",
+				NotificationText: "Test message",
+				Source:           "landing",
+				ContactName:      "Иван <Петров>",
+				Email:            "ivan@example.com",
+				PreferredContact: domain.ContactTelegram,
+				PageURL:          "https://example.com/?a=1&b=2",
+				UTMSource:        "google",
+				UTMCampaign:      "spring",
+				CustomFields:     map[string]string{"budget": "<100k", "city": "Пермь"},
+			},
+			expected: "Клиент: <b>Test Company</b>;\n" +
+				"Телефон: <a href=\"tel:+79123456789\">+7 912 345 67 89</a>;\n" +
+				"Текст обращение: Test message\n" +
+				"Контактное лицо: Иван &lt;Петров&gt;\n" +
+				"Email: ivan@example.com\n" +
+				"Способ связи: telegram\n" +
+				"Источник: landing\n" +
+				"Страница: https://example.com/?a=1&amp;b=2\n" +
+				"UTM: utm_source=google, utm_campaign=spring\n" +
+				"budget: &lt;100k\n" +
+				"city: Пермь",
+		},
+		{
+			name:      "optional fields in markdownv2",
+			parseMode: ParseModeMarkdownV2,
+			input: domain.Notification{
+				Phone:            "+7 912 345 67 89",
+				CompanyName:      "Test",
+				NotificationText: "Text",
+				UTMMedium:        "cpc",
+				CustomFields:     map[string]string{"order_id": "A-1"},
+			},
+			expected: "Клиент: *Test*;\n" +
+				"Телефон: [\\+7 912 345 67 89](tel:+79123456789);\n" +
+				"Текст обращение: Text\n" +
+				"UTM: utm\\_medium\\=cpc\n" +
+				"order\\_id: A\\-1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			formatter := newTestFormatter(t, tt.parseMode, nil)
+			result := formatter.Format(&domain.NotificationRecord{Notification: tt.input})
+			if result != tt.expected {
+				t.Errorf("Format() = %q, expected %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMessageFormatter_Templates(t *testing.T) {
+	record := &domain.NotificationRecord{
+		ID: "0001",
+		Notification: domain.Notification{
+			Phone:            "+7 912 345 67 89",
+			CompanyName:      "<Test & Co>",
+			NotificationText: "Test message",
+			CustomFields:     map[string]string{"order_id": "<A-1>"},
+		},
+		ClientIP:  "10.0.0.1",
+		RequestID: "req-1",
+		CreatedAt: time.Date(2025, 3, 1, 14, 30, 0, 0, time.UTC),
+	}
+	builtin := "Клиент: <b>&lt;Test &amp; Co&gt;</b>;\nТелефон: <a href=\"tel:+79123456789\">+7 912 345 67 89</a>;\nТекст обращение: Test message\norder_id: &lt;A-1&gt;"
+
+	tests := []struct {
+		name      string
+		templates map[string]string
+		expected  string
+	}{
+		{
+			name: "custom template with metadata and partial",
+			templates: map[string]string{
+				"notification.tmpl": `{{template "header" .}}{{bold .CompanyName}} / {{.ClientIP}} / {{.RequestID}} / {{date .ReceivedAt "02.01.2006 15:04"}}`,
+				"header.tmpl":       `Новая заявка: `,
+			},
+			expected: "Новая заявка: <b>&lt;Test &amp; Co&gt;</b> / 10.0.0.1 / req-1 / 01.03.2025 14:30",
+		},
+		{
+			name:      "custom field looked up by its name",
+			templates: map[string]string{"notification.tmpl": `Заказ {{index .CustomFields "order_id"}}`},
+			expected:  "Заказ &lt;A-1&gt;",
+		},
+		{
+			name:      "parse error falls back to built-in",
+			templates: map[string]string{"notification.tmpl": `{{.CompanyName`},
+			expected:  builtin,
+		},
+		{
+			name:      "unknown field falls back to built-in",
+			templates: map[string]string{"notification.tmpl": `{{.Budget}}`},
+			expected:  builtin,
+		},
+		{
+			name:      "missing notification template falls back to built-in",
+			templates: map[string]string{"header.tmpl": `Новая заявка`},
+			expected:  builtin,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			formatter := newTestFormatter(t, ParseModeHTML, tt.templates)
+			if result := formatter.Format(record); result != tt.expected {
+				t.Errorf("Format() = %q, expected %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		phone    string
+		expected string
+	}{
+		{phone: "+7 912 345 67 89", expected: "+79123456789"},
+		{phone: "8 (912) 345-67-89", expected: "+79123456789"},
+		{phone: "79123456789", expected: "+79123456789"},
+	}
+
+	for _, tt := range tests {
+		if result := normalizePhone(tt.phone); result != tt.expected {
+			t.Errorf("normalizePhone(%q) = %q, expected %q", tt.phone, result, tt.expected)
+		}
+	}
+}
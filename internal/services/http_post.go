@@ -0,0 +1,81 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPError is a non-2xx answer of a webhook endpoint.
+type HTTPError struct {
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("endpoint returned %d: %s", e.StatusCode, e.Body)
+}
+
+// postJSON posts body to target and returns the response status. Errors
+// leave the URL out: webhook URLs often carry a secret, and errors end up in
+// the logs and the notification record.
+func postJSON(ctx context.Context, client *http.Client, target string, body []byte, header http.Header) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, errors.New("invalid webhook url")
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return 0, fmt.Errorf("post to webhook: %w", urlErr.Err)
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		return resp.StatusCode, nil
+	}
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+	return resp.StatusCode, &HTTPError{
+		StatusCode: resp.StatusCode,
+		Body:       strings.TrimSpace(string(respBody)),
+		RetryAfter: time.Duration(retryAfter) * time.Second,
+	}
+}
+
+// classifyHTTPError retries timeouts, rate limiting, server errors and
+// transport failures. Other 4xx answers (bad payload, revoked webhook) are
+// final.
+func classifyHTTPError(err error) (bool, time.Duration) {
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		return true, 0
+	}
+
+	switch {
+	case httpErr.StatusCode == http.StatusTooManyRequests:
+		return true, httpErr.RetryAfter
+	case httpErr.StatusCode == http.StatusRequestTimeout, httpErr.StatusCode >= http.StatusInternalServerError:
+		return true, 0
+	default:
+		return false, 0
+	}
+}
@@ -1,8 +1,83 @@
 package services
 
-import "context"
+import (
+	"context"
+	"new-client-notification-bot/internal/domain"
+	"time"
+)
+
+// Message is a rendered notification addressed to one chat.
+type Message struct {
+	ChatID int64
+	// ThreadID is the forum topic, 0 for the chat itself.
+	ThreadID int
+	Text     string
+	// NotificationID, when set, adds the lead action buttons to the message.
+	NotificationID string
+	// ReplyTo is the message this one answers, 0 for none.
+	ReplyTo int
+	// SentChunks are the messages of the chunks an earlier attempt already
+	// sent; SendMessage sends only the chunks after them, and
+	// SendAttachments only the files after them.
+	SentChunks []int
+}
+
+// SentMessage identifies a message in Telegram, so it can be edited or
+// deleted later. Long messages are sent in chunks, one message ID per chunk.
+type SentMessage struct {
+	ChatID     int64
+	MessageIDs []int
+}
 
 type TelegramBotServiceInterface interface {
-	SendMessage(ctx context.Context, message string) error
+	// SendMessage sends msg in chunks. On error the chunks sent so far are
+	// returned with it, so a retry can resume after them.
+	SendMessage(ctx context.Context, msg Message) (SentMessage, error)
+	// EditMessage replaces the text of sent with msg, sending or deleting
+	// chunks when the new text splits differently.
+	EditMessage(ctx context.Context, sent SentMessage, msg Message) (SentMessage, error)
+	DeleteMessage(ctx context.Context, sent SentMessage) error
+	// SendAttachments sends files to the chat of msg, as a reply to
+	// msg.ReplyTo, one message per file. The text of msg is not used. Like
+	// SendMessage, it returns the files sent so far with an error.
+	SendAttachments(ctx context.Context, msg Message, attachments []domain.Attachment) (SentMessage, error)
+	// SendContact sends a contact card with phone and name, addressed the
+	// same way.
+	SendContact(ctx context.Context, msg Message, phone, name string) (SentMessage, error)
+}
+
+type NotificationStoreInterface interface {
+	Save(ctx context.Context, record *domain.NotificationRecord) error
+	// Modify applies fn to the stored record atomically and saves the result.
+	Modify(ctx context.Context, id string, fn func(record *domain.NotificationRecord) error) (*domain.NotificationRecord, error)
+	Get(ctx context.Context, id string) (*domain.NotificationRecord, error)
+	Pending(ctx context.Context, now time.Time, limit int) ([]*domain.NotificationRecord, error)
+	// Recent returns up to limit records that match, newest first.
+	Recent(ctx context.Context, limit int, match func(record *domain.NotificationRecord) bool) ([]*domain.NotificationRecord, error)
+	// CountSince counts the records created at or after since that match.
+	CountSince(ctx context.Context, since time.Time, match func(record *domain.NotificationRecord) bool) (int, error)
+	// Attachments returns the attachments of a record with their data.
+	Attachments(ctx context.Context, id string) ([]domain.Attachment, error)
 }
 
+type IdempotencyStoreInterface interface {
+	// Reserve stores request unless its key is already in use and not yet
+	// expired at now; then it returns the request stored under the key.
+	Reserve(ctx context.Context, request domain.IdempotentRequest, now time.Time) (*domain.IdempotentRequest, error)
+	// Complete stores the response of a reserved request.
+	Complete(ctx context.Context, request domain.IdempotentRequest) error
+	// Release frees the key of a request, so it can be retried.
+	Release(ctx context.Context, key string) error
+}
+
+type MuteStoreInterface interface {
+	// MuteUntil returns when the delivery mute ends, zero if it is not set.
+	MuteUntil(ctx context.Context) (time.Time, error)
+	// SetMuteUntil saves the end of the mute; a zero time clears it.
+	SetMuteUntil(ctx context.Context, until time.Time) error
+}
+
+type NotificationManagerInterface interface {
+	Update(ctx context.Context, id string, notification domain.Notification) ([]ChangeResult, error)
+	Retract(ctx context.Context, id string) ([]ChangeResult, error)
+}
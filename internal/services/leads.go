@@ -0,0 +1,98 @@
+package services
+
+import (
+	"new-client-notification-bot/internal/domain"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const leadCallbackPrefix = "lead"
+
+// statusSeparator sits between a lead message and its status line.
+const statusSeparator = "\n\n"
+
+type leadAction struct {
+	action string
+	button string
+	status string
+}
+
+var leadActions = []leadAction{
+	{action: domain.ActionTake, button: "✅ Беру", status: "✅ Взял в работу"},
+	{action: domain.ActionSpam, button: "🚫 Спам", status: "🚫 Спам"},
+	{action: domain.ActionCalled, button: "📞 Перезвонили", status: "📞 Перезвонил"},
+}
+
+func findLeadAction(action string) (leadAction, bool) {
+	for _, la := range leadActions {
+		if la.action == action {
+			return la, true
+		}
+	}
+	return leadAction{}, false
+}
+
+// leadKeyboard builds the action buttons for a lead message. Callback data
+// is "lead:<action>:<notification id>", well within the 64 byte limit.
+func leadKeyboard(notificationID string) tgbotapi.InlineKeyboardMarkup {
+	var buttons []tgbotapi.InlineKeyboardButton
+	for _, la := range leadActions {
+		data := strings.Join([]string{leadCallbackPrefix, la.action, notificationID}, ":")
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(la.button, data))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(buttons)
+}
+
+func parseLeadCallback(data string) (action, notificationID string, ok bool) {
+	parts := strings.SplitN(data, ":", 3)
+	if len(parts) != 3 || parts[0] != leadCallbackPrefix || parts[2] == "" {
+		return "", "", false
+	}
+	if _, ok := findLeadAction(parts[1]); !ok {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// statusLine renders e.g. "✅ Взял в работу: @ivan".
+func statusLine(action, name string) string {
+	la, _ := findLeadAction(action)
+	return la.status + ": " + name
+}
+
+func displayName(user *tgbotapi.User) string {
+	if user.UserName != "" {
+		return "@" + user.UserName
+	}
+	return strings.TrimSpace(user.FirstName + " " + user.LastName)
+}
+
+// withStatus replaces the status line at the end of a lead message, keeping
+// the formatting entities of the lead itself. Offsets are in UTF-16 units,
+// like the Bot API counts them.
+func withStatus(text string, entities []tgbotapi.MessageEntity, status string) (string, []tgbotapi.MessageEntity) {
+	base := text
+	if i := strings.LastIndex(text, statusSeparator); i >= 0 && isStatusLine(text[i+len(statusSeparator):]) {
+		base = text[:i]
+	}
+
+	cut := utf16Len(base)
+	var kept []tgbotapi.MessageEntity
+	for _, entity := range entities {
+		if entity.Offset+entity.Length <= cut {
+			kept = append(kept, entity)
+		}
+	}
+
+	return base + statusSeparator + status, kept
+}
+
+func isStatusLine(line string) bool {
+	for _, la := range leadActions {
+		if strings.HasPrefix(line, la.status+": ") {
+			return true
+		}
+	}
+	return false
+}
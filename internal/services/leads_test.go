@@ -0,0 +1,75 @@
+package services
+
+import (
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestParseLeadCallback(t *testing.T) {
+	tests := []struct {
+		data           string
+		expectedAction string
+		expectedID     string
+		expectedOK     bool
+	}{
+		{data: "lead:take:0001", expectedAction: "take", expectedID: "0001", expectedOK: true},
+		{data: "lead:called:0001", expectedAction: "called", expectedID: "0001", expectedOK: true},
+		{data: "lead:delete:0001"},
+		{data: "lead:take:"},
+		{data: "other:take:0001"},
+		{data: "garbage"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.data, func(t *testing.T) {
+			action, id, ok := parseLeadCallback(tt.data)
+			if ok != tt.expectedOK || action != tt.expectedAction || id != tt.expectedID {
+				t.Errorf("parseLeadCallback(%q) = %q, %q, %v", tt.data, action, id, ok)
+			}
+		})
+	}
+}
+
+func TestLeadKeyboard(t *testing.T) {
+	keyboard := leadKeyboard("0192d7a4-5a6b-7c8d-9e0f-123456789abc")
+
+	if len(keyboard.InlineKeyboard) != 1 || len(keyboard.InlineKeyboard[0]) != len(leadActions) {
+		t.Fatalf("expected one row of %d buttons, got %+v", len(leadActions), keyboard.InlineKeyboard)
+	}
+	for _, button := range keyboard.InlineKeyboard[0] {
+		if len(*button.CallbackData) > 64 {
+			t.Errorf("callback data %q exceeds 64 bytes", *button.CallbackData)
+		}
+	}
+}
+
+func TestWithStatus(t *testing.T) {
+	bold := tgbotapi.MessageEntity{Type: "bold", Offset: 8, Length: 4}
+	mention := tgbotapi.MessageEntity{Type: "mention", Offset: 42, Length: 5}
+
+	text, entities := withStatus("Клиент: Тест;\nТелефон: 1", []tgbotapi.MessageEntity{bold}, "✅ Взял в работу: @ivan")
+	if text != "Клиент: Тест;\nТелефон: 1\n\n✅ Взял в работу: @ivan" {
+		t.Errorf("unexpected text %q", text)
+	}
+	if len(entities) != 1 {
+		t.Errorf("expected lead entities to be kept, got %+v", entities)
+	}
+
+	text, entities = withStatus(text, []tgbotapi.MessageEntity{bold, mention}, "🚫 Спам: @petr")
+	if text != "Клиент: Тест;\nТелефон: 1\n\n🚫 Спам: @petr" {
+		t.Errorf("expected previous status to be replaced, got %q", text)
+	}
+	if len(entities) != 1 || entities[0] != bold {
+		t.Errorf("expected status entities to be dropped, got %+v", entities)
+	}
+}
+
+func TestDisplayName(t *testing.T) {
+	if name := displayName(&tgbotapi.User{UserName: "ivan", FirstName: "Иван"}); name != "@ivan" {
+		t.Errorf("expected @ivan, got %q", name)
+	}
+	if name := displayName(&tgbotapi.User{FirstName: "Иван", LastName: "Петров"}); name != "Иван Петров" {
+		t.Errorf("expected full name, got %q", name)
+	}
+}
@@ -0,0 +1,172 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"new-client-notification-bot/internal/domain"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+var ErrNotificationRetracted = errors.New("notification retracted")
+
+// ChangeResult reports an edit or a retraction in one chat.
+type ChangeResult struct {
+	ChatID     int64  `json:"chat_id"`
+	ThreadID   int    `json:"thread_id,omitempty"`
+	MessageIDs []int  `json:"message_ids,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// NotificationManager changes notifications after they have been accepted:
+// it edits the lead in the messages already sent or takes them back.
+type NotificationManager struct {
+	store     NotificationStoreInterface
+	telegram  TelegramBotServiceInterface
+	formatter *MessageFormatter
+	logger    *zerolog.Logger
+}
+
+func NewNotificationManager(store NotificationStoreInterface, telegram TelegramBotServiceInterface, formatter *MessageFormatter, logger *zerolog.Logger) *NotificationManager {
+	return &NotificationManager{
+		store:     store,
+		telegram:  telegram,
+		formatter: formatter,
+		logger:    logger,
+	}
+}
+
+// Update replaces the lead of a notification and edits every message already
+// sent. Chats still waiting for delivery get the new text from the dispatcher.
+func (m *NotificationManager) Update(ctx context.Context, id string, notification domain.Notification) ([]ChangeResult, error) {
+	record, err := m.store.Modify(ctx, id, func(record *domain.NotificationRecord) error {
+		if record.Status == domain.StatusRetracted {
+			return ErrNotificationRetracted
+		}
+		record.Notification = notification
+		record.UpdatedAt = time.Now()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	text := m.formatter.Format(record)
+	// Keep the status a button press wrote under the lead.
+	if len(record.Actions) > 0 {
+		action := record.Actions[len(record.Actions)-1]
+		text += statusSeparator + m.formatter.Escape(statusLine(action.Action, action.Username))
+	}
+
+	var results []ChangeResult
+	messageIDs := map[Target][]int{}
+	for _, delivery := range record.Deliveries {
+		if len(delivery.MessageIDs) == 0 {
+			continue
+		}
+
+		sent := SentMessage{ChatID: delivery.ChatID, MessageIDs: delivery.MessageIDs}
+		edited, err := m.telegram.EditMessage(ctx, sent, Message{ChatID: delivery.ChatID, ThreadID: delivery.ThreadID, Text: text, NotificationID: record.ID})
+		result := ChangeResult{ChatID: delivery.ChatID, ThreadID: delivery.ThreadID, MessageIDs: edited.MessageIDs}
+		if err != nil {
+			m.logger.Error().Err(err).Str("id", id).Int64("chat_id", delivery.ChatID).Msg("failed to edit notification")
+			result.Error = err.Error()
+			// A failed edit leaves old and new chunks mixed: keep track of
+			// both so a retraction still finds every message.
+			for _, messageID := range delivery.MessageIDs {
+				if !slices.Contains(edited.MessageIDs, messageID) {
+					edited.MessageIDs = append(edited.MessageIDs, messageID)
+				}
+			}
+		}
+		messageIDs[Target{ChatID: delivery.ChatID, ThreadID: delivery.ThreadID}] = edited.MessageIDs
+		results = append(results, result)
+	}
+
+	if len(messageIDs) > 0 {
+		_, err = m.store.Modify(ctx, id, func(record *domain.NotificationRecord) error {
+			for i := range record.Deliveries {
+				delivery := &record.Deliveries[i]
+				if ids, ok := messageIDs[Target{ChatID: delivery.ChatID, ThreadID: delivery.ThreadID}]; ok {
+					delivery.MessageIDs = ids
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			m.logger.Error().Err(err).Str("id", id).Msg("failed to store edited message ids")
+		}
+	}
+
+	m.logger.Info().Str("id", id).Int("chats", len(results)).Msg("notification updated")
+	return results, nil
+}
+
+// Retract stops delivery of a notification and deletes the messages already
+// sent. Retracting again retries the chats where deleting failed.
+func (m *NotificationManager) Retract(ctx context.Context, id string) ([]ChangeResult, error) {
+	now := time.Now()
+	record, err := m.store.Modify(ctx, id, func(record *domain.NotificationRecord) error {
+		record.Status = domain.StatusRetracted
+		record.UpdatedAt = now
+		for i := range record.Deliveries {
+			if record.Deliveries[i].Status == domain.StatusQueued {
+				record.Deliveries[i].Status = domain.StatusRetracted
+				record.Deliveries[i].UpdatedAt = now
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var results []ChangeResult
+	errs := map[Target]error{}
+	for _, delivery := range record.Deliveries {
+		sent := SentMessage{ChatID: delivery.ChatID, MessageIDs: sentMessageIDs(&delivery)}
+		if len(sent.MessageIDs) == 0 {
+			continue
+		}
+
+		result := ChangeResult{ChatID: delivery.ChatID, ThreadID: delivery.ThreadID, MessageIDs: sent.MessageIDs}
+		err := m.telegram.DeleteMessage(ctx, sent)
+		if err != nil {
+			m.logger.Error().Err(err).Str("id", id).Int64("chat_id", delivery.ChatID).Msg("failed to delete notification")
+			result.Error = err.Error()
+		}
+		errs[Target{ChatID: delivery.ChatID, ThreadID: delivery.ThreadID}] = err
+		results = append(results, result)
+	}
+
+	if len(errs) > 0 {
+		_, err = m.store.Modify(ctx, id, func(record *domain.NotificationRecord) error {
+			for i := range record.Deliveries {
+				delivery := &record.Deliveries[i]
+				err, ok := errs[Target{ChatID: delivery.ChatID, ThreadID: delivery.ThreadID}]
+				if !ok {
+					continue
+				}
+				delivery.UpdatedAt = time.Now()
+				if err != nil {
+					delivery.LastError = err.Error()
+					continue
+				}
+				delivery.Status = domain.StatusRetracted
+				delivery.MessageIDs = nil
+				delivery.AttachmentMessageIDs = nil
+				delivery.ContactMessageID = 0
+				delivery.LastError = ""
+			}
+			return nil
+		})
+		if err != nil {
+			m.logger.Error().Err(err).Str("id", id).Msg("failed to store retracted deliveries")
+		}
+	}
+
+	m.logger.Info().Str("id", id).Int("chats", len(results)).Msg("notification retracted")
+	return results, nil
+}
@@ -0,0 +1,105 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"new-client-notification-bot/config"
+	"new-client-notification-bot/internal/domain"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func newTestManager(store NotificationStoreInterface, telegram TelegramBotServiceInterface) *NotificationManager {
+	logger := zerolog.Nop()
+	return NewNotificationManager(store, telegram, NewMessageFormatter(&config.BotConfig{}, &config.TemplateConfig{}, &logger), &logger)
+}
+
+func TestNotificationManager_Update(t *testing.T) {
+	store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{
+		"0001": {
+			ID:           "0001",
+			Notification: testNotification,
+			Status:       domain.StatusQueued,
+			Deliveries: []domain.Delivery{
+				{ChatID: 42, Status: domain.StatusDelivered, MessageIDs: []int{7}},
+				{ChatID: 43, Status: domain.StatusQueued},
+			},
+			Actions: []domain.LeadAction{{Action: domain.ActionTake, Username: "@ivan"}},
+		},
+	}}
+	telegram := &MockTelegramBotService{}
+
+	corrected := testNotification
+	corrected.NotificationText = "Corrected message"
+	results, err := newTestManager(store, telegram).Update(context.Background(), "0001", corrected)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(results) != 1 || results[0].ChatID != 42 || results[0].Error != "" {
+		t.Errorf("expected only the delivered chat to be edited, got %+v", results)
+	}
+	if store.records["0001"].Notification.NotificationText != "Corrected message" {
+		t.Errorf("expected stored notification to be replaced")
+	}
+	if len(telegram.edited) != 1 {
+		t.Fatalf("expected one edit, got %d", len(telegram.edited))
+	}
+	text := telegram.edited[0].Text
+	if !strings.Contains(text, "Corrected message") || !strings.HasSuffix(text, "✅ Взял в работу: @ivan") {
+		t.Errorf("expected corrected text with the status line, got %q", text)
+	}
+}
+
+func TestNotificationManager_UpdateRetracted(t *testing.T) {
+	store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{
+		"0001": {ID: "0001", Notification: testNotification, Status: domain.StatusRetracted},
+	}}
+
+	_, err := newTestManager(store, &MockTelegramBotService{}).Update(context.Background(), "0001", testNotification)
+	if !errors.Is(err, ErrNotificationRetracted) {
+		t.Errorf("expected ErrNotificationRetracted, got %v", err)
+	}
+}
+
+func TestNotificationManager_Retract(t *testing.T) {
+	store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{
+		"0001": {
+			ID:           "0001",
+			Notification: testNotification,
+			Status:       domain.StatusQueued,
+			Deliveries: []domain.Delivery{
+				{ChatID: 42, Status: domain.StatusDelivered, MessageIDs: []int{7, 8}},
+				{ChatID: 43, Status: domain.StatusDelivered, MessageIDs: []int{9}},
+				{ChatID: 44, Status: domain.StatusQueued},
+			},
+		},
+	}}
+	telegram := &MockTelegramBotService{failChatIDs: []int64{43}, errorMsg: "message can't be deleted"}
+
+	results, err := newTestManager(store, telegram).Retract(context.Background(), "0001")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(results) != 2 || results[0].Error != "" || results[1].Error == "" {
+		t.Errorf("expected chat 42 retracted and chat 43 failed, got %+v", results)
+	}
+
+	record := store.records["0001"]
+	if record.Status != domain.StatusRetracted {
+		t.Errorf("expected retracted record, got %q", record.Status)
+	}
+	if d := record.Deliveries[0]; d.Status != domain.StatusRetracted || d.MessageIDs != nil {
+		t.Errorf("expected chat 42 retracted, got %+v", d)
+	}
+	if d := record.Deliveries[1]; d.Status != domain.StatusDelivered || !slices.Equal(d.MessageIDs, []int{9}) || d.LastError == "" {
+		t.Errorf("expected chat 43 kept for another attempt, got %+v", d)
+	}
+	if d := record.Deliveries[2]; d.Status != domain.StatusRetracted {
+		t.Errorf("expected queued chat 44 retracted, got %+v", d)
+	}
+}
@@ -0,0 +1,48 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Mute pauses delivery until a point in time. Leads keep queueing in the
+// store meanwhile and go out once the mute ends. The end is saved in the
+// store, so a restart does not lift the mute; a zero Mute lives in memory
+// only.
+type Mute struct {
+	mu    sync.Mutex
+	until time.Time
+	store MuteStoreInterface
+}
+
+// NewMute returns a mute saved in store, restoring the one set before a
+// restart.
+func NewMute(ctx context.Context, store MuteStoreInterface) (*Mute, error) {
+	until, err := store.MuteUntil(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Mute{until: until, store: store}, nil
+}
+
+// Set mutes delivery until the given time, or lifts the mute for a zero
+// time.
+func (m *Mute) Set(ctx context.Context, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.store != nil {
+		if err := m.store.SetMuteUntil(ctx, until); err != nil {
+			return err
+		}
+	}
+	m.until = until
+	return nil
+}
+
+// Until returns when the mute ends and whether it is active at now.
+func (m *Mute) Until(now time.Time) (time.Time, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.until, now.Before(m.until)
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"new-client-notification-bot/internal/domain"
+)
+
+// Notifier delivers notifications through one channel, such as Telegram.
+type Notifier interface {
+	// Deliveries lists the recipients of a notification in this channel,
+	// one queued delivery each.
+	Deliveries(notification *domain.Notification) []domain.Delivery
+	// Send delivers the notification to the recipient of delivery and records
+	// what the channel needs to find the message again, such as message IDs.
+	// Errors wrapped with Permanent are not retried.
+	Send(ctx context.Context, record *domain.NotificationRecord, delivery *domain.Delivery) error
+}
+
+// Retractor is implemented by channels that can take a sent notification
+// back.
+type Retractor interface {
+	Retract(ctx context.Context, delivery *domain.Delivery) error
+}
+
+// PermanentError marks a delivery failure that retrying will not fix.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+func Permanent(err error) error {
+	return &PermanentError{Err: err}
+}
+
+func isPermanentError(err error) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent)
+}
+
+// Registry holds the enabled delivery channels by name, in the order they
+// were registered.
+type Registry struct {
+	names     []string
+	notifiers map[string]Notifier
+}
+
+func NewRegistry() *Registry {
+	return &Registry{notifiers: map[string]Notifier{}}
+}
+
+// Register adds a channel, replacing any channel registered under the same
+// name.
+func (r *Registry) Register(name string, notifier Notifier) {
+	if _, ok := r.notifiers[name]; !ok {
+		r.names = append(r.names, name)
+	}
+	r.notifiers[name] = notifier
+}
+
+func (r *Registry) Get(name string) (Notifier, bool) {
+	notifier, ok := r.notifiers[name]
+	return notifier, ok
+}
+
+func (r *Registry) Names() []string {
+	return r.names
+}
@@ -0,0 +1,284 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"new-client-notification-bot/config"
+	"new-client-notification-bot/internal/domain"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNotifier is a channel with one recipient.
+type fakeNotifier struct {
+	mu      sync.Mutex
+	err     error
+	started chan struct{}
+	release chan struct{}
+	sent    []string
+}
+
+func (f *fakeNotifier) Deliveries(notification *domain.Notification) []domain.Delivery {
+	return []domain.Delivery{{Status: domain.StatusQueued}}
+}
+
+func (f *fakeNotifier) Send(ctx context.Context, record *domain.NotificationRecord, delivery *domain.Delivery) error {
+	if f.started != nil {
+		f.started <- struct{}{}
+		<-f.release
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, record.ID)
+	return f.err
+}
+
+func TestRegistry(t *testing.T) {
+	channels := NewRegistry()
+	first, second := &fakeNotifier{}, &fakeNotifier{}
+	channels.Register("email", first)
+	channels.Register("slack", &fakeNotifier{})
+	channels.Register("email", second)
+
+	if !slices.Equal(channels.Names(), []string{"email", "slack"}) {
+		t.Errorf("expected registration order, got %v", channels.Names())
+	}
+	if notifier, ok := channels.Get("email"); !ok || notifier != second {
+		t.Errorf("expected the latest email channel")
+	}
+	if _, ok := channels.Get("sms"); ok {
+		t.Errorf("expected unknown channel to be missing")
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	cause := errors.New("mailbox unavailable")
+	err := Permanent(cause)
+
+	if !isPermanentError(err) || !errors.Is(err, cause) || err.Error() != cause.Error() {
+		t.Errorf("expected permanent error wrapping the cause, got %v", err)
+	}
+	if isPermanentError(cause) {
+		t.Errorf("expected plain error to be retryable")
+	}
+}
+
+func TestDispatcher_ChannelResults(t *testing.T) {
+	store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{
+		"0001": {ID: "0001", Notification: testNotification, Status: domain.StatusQueued},
+	}}
+	email := &fakeNotifier{}
+	slack := &fakeNotifier{err: Permanent(errors.New("invalid webhook"))}
+	channels := NewRegistry()
+	channels.Register("email", email)
+	channels.Register("slack", slack)
+
+	newTestDispatcherWithChannels(store, channels).dispatchPending(context.Background())
+
+	record := store.records["0001"]
+	if len(record.Deliveries) != 2 {
+		t.Fatalf("expected a delivery per channel, got %+v", record.Deliveries)
+	}
+	byChannel := map[string]domain.Delivery{}
+	for _, delivery := range record.Deliveries {
+		byChannel[delivery.Channel] = delivery
+	}
+	if byChannel["email"].Status != domain.StatusDelivered {
+		t.Errorf("expected email delivered, got %+v", byChannel["email"])
+	}
+	if byChannel["slack"].Status != domain.StatusFailed || byChannel["slack"].LastError != "invalid webhook" {
+		t.Errorf("expected slack failed, got %+v", byChannel["slack"])
+	}
+	if record.Status != domain.StatusFailed {
+		t.Errorf("expected failed record, got %q", record.Status)
+	}
+}
+
+func TestDispatcher_ChannelsInParallel(t *testing.T) {
+	store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{
+		"0001": {ID: "0001", Notification: testNotification, Status: domain.StatusQueued},
+	}}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	channels := NewRegistry()
+	channels.Register("email", &fakeNotifier{started: started, release: release})
+	channels.Register("slack", &fakeNotifier{started: started, release: release})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newTestDispatcherWithChannels(store, channels).dispatchPending(context.Background())
+	}()
+
+	// Both channels have to be sending at the same time.
+	for range 2 {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatalf("expected channels to be sent in parallel")
+		}
+	}
+	close(release)
+	<-done
+
+	if store.records["0001"].Status != domain.StatusDelivered {
+		t.Errorf("expected delivered record, got %q", store.records["0001"].Status)
+	}
+}
+
+func TestDispatcher_DisabledChannel(t *testing.T) {
+	store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{
+		"0001": {
+			ID:           "0001",
+			Notification: testNotification,
+			Status:       domain.StatusQueued,
+			Deliveries:   []domain.Delivery{{Channel: "sms", Status: domain.StatusQueued}},
+		},
+	}}
+
+	newTestDispatcherWithChannels(store, NewRegistry()).dispatchPending(context.Background())
+
+	delivery := store.records["0001"].Deliveries[0]
+	if delivery.Status != domain.StatusFailed || delivery.LastError != "channel sms is not enabled" {
+		t.Errorf("expected delivery to a disabled channel to fail, got %+v", delivery)
+	}
+}
+
+func TestDispatcher_Fallback(t *testing.T) {
+	down := errors.New("connection refused")
+	past := time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name           string
+		record         domain.NotificationRecord
+		telegramErr    error
+		emailErr       error
+		webhookErr     error
+		expectedStatus domain.NotificationStatus
+		expectedVia    []string
+		expectedSent   []string
+		expectedChain  []string
+		expectedStages []domain.NotificationStatus
+	}{
+		{
+			name:           "primary delivers",
+			record:         domain.NotificationRecord{ID: "0001", Status: domain.StatusQueued},
+			expectedStatus: domain.StatusDelivered,
+			expectedVia:    []string{"telegram"},
+			expectedSent:   []string{"telegram"},
+			expectedChain:  []string{"email", "webhook"},
+			expectedStages: []domain.NotificationStatus{domain.StatusDelivered},
+		},
+		{
+			name:           "primary fails permanently",
+			record:         domain.NotificationRecord{ID: "0001", Status: domain.StatusQueued},
+			telegramErr:    Permanent(errors.New("chat not found")),
+			expectedStatus: domain.StatusDelivered,
+			expectedVia:    []string{"email"},
+			expectedSent:   []string{"telegram", "email"},
+			expectedChain:  []string{"webhook"},
+			expectedStages: []domain.NotificationStatus{domain.StatusFailed, domain.StatusDelivered},
+		},
+		{
+			name:           "primary down before the deadline",
+			record:         domain.NotificationRecord{ID: "0001", Status: domain.StatusQueued},
+			telegramErr:    down,
+			expectedStatus: domain.StatusQueued,
+			expectedSent:   []string{"telegram"},
+			expectedChain:  []string{"email", "webhook"},
+			expectedStages: []domain.NotificationStatus{domain.StatusQueued},
+		},
+		{
+			name: "primary down past the deadline",
+			record: domain.NotificationRecord{
+				ID:         "0001",
+				Status:     domain.StatusQueued,
+				Deliveries: []domain.Delivery{{Channel: "telegram", Status: domain.StatusQueued}},
+				Fallback:   []string{"email", "webhook"},
+				FallbackAt: past,
+			},
+			telegramErr:    down,
+			expectedStatus: domain.StatusDelivered,
+			expectedVia:    []string{"email"},
+			expectedSent:   []string{"telegram", "email"},
+			expectedChain:  []string{"webhook"},
+			expectedStages: []domain.NotificationStatus{domain.StatusSkipped, domain.StatusDelivered},
+		},
+		{
+			name:           "first fallback fails too",
+			record:         domain.NotificationRecord{ID: "0001", Status: domain.StatusQueued},
+			telegramErr:    Permanent(errors.New("chat not found")),
+			emailErr:       Permanent(errors.New("mailbox unavailable")),
+			expectedStatus: domain.StatusDelivered,
+			expectedVia:    []string{"webhook"},
+			expectedSent:   []string{"telegram", "email", "webhook"},
+			expectedStages: []domain.NotificationStatus{domain.StatusFailed, domain.StatusFailed, domain.StatusDelivered},
+		},
+		{
+			name:           "whole chain fails",
+			record:         domain.NotificationRecord{ID: "0001", Status: domain.StatusQueued},
+			telegramErr:    Permanent(errors.New("chat not found")),
+			emailErr:       Permanent(errors.New("mailbox unavailable")),
+			webhookErr:     Permanent(errors.New("not found")),
+			expectedStatus: domain.StatusFailed,
+			expectedSent:   []string{"telegram", "email", "webhook"},
+			expectedStages: []domain.NotificationStatus{domain.StatusFailed, domain.StatusFailed, domain.StatusFailed},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := tt.record
+			record.Notification = testNotification
+			store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{"0001": &record}}
+
+			var sent []string
+			channels := NewRegistry()
+			fakes := map[string]*fakeNotifier{
+				"telegram": {err: tt.telegramErr},
+				"email":    {err: tt.emailErr},
+				"webhook":  {err: tt.webhookErr},
+			}
+			for _, name := range []string{"telegram", "email", "webhook"} {
+				channels.Register(name, fakes[name])
+			}
+			router, _ := NewRouter(&config.RoutingConfig{DefaultChatIDs: []int64{42}, DefaultFallback: []string{"email", "webhook"}})
+
+			newTestDispatcherWithFallback(store, channels, router).dispatchPending(context.Background())
+
+			for _, name := range []string{"telegram", "email", "webhook"} {
+				if len(fakes[name].sent) > 0 {
+					sent = append(sent, name)
+				}
+			}
+			stored := store.records["0001"]
+			if stored.Status != tt.expectedStatus {
+				t.Errorf("expected status %q, got %q", tt.expectedStatus, stored.Status)
+			}
+			if !slices.Equal(stored.DeliveredVia, tt.expectedVia) {
+				t.Errorf("expected delivered via %v, got %v", tt.expectedVia, stored.DeliveredVia)
+			}
+			if !slices.Equal(sent, tt.expectedSent) {
+				t.Errorf("expected sends through %v, got %v", tt.expectedSent, sent)
+			}
+			if !slices.Equal(stored.Fallback, tt.expectedChain) {
+				t.Errorf("expected remaining chain %v, got %v", tt.expectedChain, stored.Fallback)
+			}
+			var stages []domain.NotificationStatus
+			for i, delivery := range stored.Deliveries {
+				if delivery.Stage != i {
+					t.Errorf("expected delivery %d at stage %d, got %+v", i, i, delivery)
+				}
+				stages = append(stages, delivery.Status)
+			}
+			if !slices.Equal(stages, tt.expectedStages) {
+				t.Errorf("expected deliveries %v, got %v", tt.expectedStages, stages)
+			}
+			if stored.Status == domain.StatusQueued && stored.NextAttempt.After(stored.FallbackAt) {
+				t.Errorf("expected next attempt %v by the fallback deadline %v", stored.NextAttempt, stored.FallbackAt)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// retryClassifier reports whether err is worth another attempt and, when the
+// remote side asked for it, how long to wait before that attempt.
+type retryClassifier func(err error) (retry bool, after time.Duration)
+
+// Do calls fn until it succeeds, classify rejects the error, the attempts run
+// out or ctx is done. The last error from fn is returned.
+func (p RetryPolicy) Do(ctx context.Context, classify retryClassifier, fn func() error) error {
+	attempts := max(p.MaxAttempts, 1)
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return errors.Join(err, ctx.Err())
+		}
+
+		retry, after := classify(err)
+		if !retry || attempt == attempts {
+			return err
+		}
+
+		wait := after
+		if wait <= 0 {
+			wait = p.backoff(attempt)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+	}
+
+	return err
+}
+
+// backoff returns an exponentially growing delay capped at MaxDelay, with
+// the upper half randomized so that concurrent senders do not retry in step.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 {
+		delay = min(delay, p.MaxDelay)
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	half := delay / 2
+	return half + rand.N(delay-half+1)
+}
@@ -0,0 +1,131 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy_Do(t *testing.T) {
+	errTransient := errors.New("transient")
+	errPermanent := errors.New("permanent")
+
+	classify := func(err error) (bool, time.Duration) {
+		return errors.Is(err, errTransient), 0
+	}
+
+	tests := []struct {
+		name          string
+		results       []error
+		expectedErr   error
+		expectedCalls int
+	}{
+		{
+			name:          "success on first attempt",
+			results:       []error{nil},
+			expectedCalls: 1,
+		},
+		{
+			name:          "success after transient errors",
+			results:       []error{errTransient, errTransient, nil},
+			expectedCalls: 3,
+		},
+		{
+			name:          "permanent error is not retried",
+			results:       []error{errPermanent, nil},
+			expectedErr:   errPermanent,
+			expectedCalls: 1,
+		},
+		{
+			name:          "attempts exhausted",
+			results:       []error{errTransient, errTransient, errTransient, nil},
+			expectedErr:   errTransient,
+			expectedCalls: 3,
+		},
+	}
+
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := policy.Do(context.Background(), classify, func() error {
+				err := tt.results[calls]
+				calls++
+				return err
+			})
+
+			if !errors.Is(err, tt.expectedErr) || (tt.expectedErr == nil && err != nil) {
+				t.Errorf("expected error %v, got %v", tt.expectedErr, err)
+			}
+			if calls != tt.expectedCalls {
+				t.Errorf("expected %d calls, got %d", tt.expectedCalls, calls)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy_HonorsRetryAfter(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 2, BaseDelay: time.Hour, MaxDelay: time.Hour}
+
+	calls := 0
+	start := time.Now()
+	err := policy.Do(context.Background(), func(error) (bool, time.Duration) {
+		return true, 20 * time.Millisecond
+	}, func() error {
+		calls++
+		if calls == 1 {
+			return errors.New("too many requests")
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected to wait for retry_after, waited %v", elapsed)
+	}
+}
+
+func TestRetryPolicy_ContextCancellation(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	calls := 0
+	err := policy.Do(ctx, func(error) (bool, time.Duration) { return true, 0 }, func() error {
+		calls++
+		return errors.New("transient")
+	})
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 call, got %d", calls)
+	}
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{attempt: 1, max: 100 * time.Millisecond},
+		{attempt: 2, max: 200 * time.Millisecond},
+		{attempt: 3, max: 400 * time.Millisecond},
+		{attempt: 10, max: time.Second},
+	}
+
+	for _, tt := range tests {
+		got := policy.backoff(tt.attempt)
+		if got < tt.max/2 || got > tt.max {
+			t.Errorf("backoff(%d) = %v, expected between %v and %v", tt.attempt, got, tt.max/2, tt.max)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package services
+
+import (
+	"fmt"
+	"new-client-notification-bot/config"
+	"new-client-notification-bot/internal/domain"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Target is a Telegram chat, or a forum topic in it when ThreadID is set.
+type Target struct {
+	ChatID   int64
+	ThreadID int
+}
+
+type route struct {
+	companyPattern *regexp.Regexp
+	keywords       []string
+	sources        []string
+	phonePrefixes  []string
+	targets        []Target
+	fallback       []string
+	contactCard    bool
+}
+
+// Router picks the chats and topics a notification goes to. A route matches
+// when every condition it sets matches; a list condition matches when any of
+// its values does. A notification fans out to the targets of all matching
+// routes, and falls back to the default targets when nothing matches.
+type Router struct {
+	routes             []route
+	defaultTargets     []Target
+	defaultFallback    []string
+	defaultContactCard bool
+}
+
+func NewRouter(cfg *config.RoutingConfig) (*Router, error) {
+	router := &Router{
+		defaultTargets:     targets(cfg.DefaultChatIDs, cfg.DefaultTargets),
+		defaultFallback:    cfg.DefaultFallback,
+		defaultContactCard: cfg.DefaultContactCard,
+	}
+
+	for _, rc := range cfg.Routes {
+		r := route{
+			sources:     rc.Sources,
+			targets:     targets(rc.ChatIDs, rc.Targets),
+			fallback:    rc.Fallback,
+			contactCard: rc.ContactCard,
+		}
+
+		if rc.CompanyPattern != "" {
+			pattern, err := regexp.Compile(rc.CompanyPattern)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %w", rc.Name, err)
+			}
+			r.companyPattern = pattern
+		}
+
+		for _, keyword := range rc.Keywords {
+			r.keywords = append(r.keywords, strings.ToLower(keyword))
+		}
+
+		for _, prefix := range rc.PhonePrefixes {
+			r.phonePrefixes = append(r.phonePrefixes, "+"+nonDigits.ReplaceAllString(prefix, ""))
+		}
+
+		router.routes = append(router.routes, r)
+	}
+
+	return router, nil
+}
+
+// targets joins whole chats and topics into one list.
+func targets(chatIDs []int64, topics []config.TargetConfig) []Target {
+	var result []Target
+	for _, chatID := range chatIDs {
+		result = append(result, Target{ChatID: chatID})
+	}
+	for _, topic := range topics {
+		result = append(result, Target{ChatID: topic.ChatID, ThreadID: topic.ThreadID})
+	}
+	return result
+}
+
+// Route returns the distinct targets for n in route order.
+func (r *Router) Route(n *domain.Notification) []Target {
+	var result []Target
+	for _, rt := range r.routes {
+		if !rt.matches(n) {
+			continue
+		}
+		for _, target := range rt.targets {
+			if !slices.Contains(result, target) {
+				result = append(result, target)
+			}
+		}
+	}
+
+	if len(result) == 0 {
+		return slices.Clone(r.defaultTargets)
+	}
+	return result
+}
+
+// Fallback returns the channels to try in turn when the primary ones fail to
+// deliver n: the chains of the matching routes joined in route order, or the
+// default chain when no route matches.
+func (r *Router) Fallback(n *domain.Notification) []string {
+	var chain []string
+	matched := false
+	for _, rt := range r.routes {
+		if !rt.matches(n) {
+			continue
+		}
+		matched = true
+		for _, name := range rt.fallback {
+			if !slices.Contains(chain, name) {
+				chain = append(chain, name)
+			}
+		}
+	}
+
+	if !matched {
+		return slices.Clone(r.defaultFallback)
+	}
+	return chain
+}
+
+// ContactCard reports whether target gets a contact card for n: whether a
+// matching route that sends n to target asks for one.
+func (r *Router) ContactCard(n *domain.Notification, target Target) bool {
+	matched := false
+	for _, rt := range r.routes {
+		if !rt.matches(n) {
+			continue
+		}
+		matched = true
+		if rt.contactCard && slices.Contains(rt.targets, target) {
+			return true
+		}
+	}
+	return !matched && r.defaultContactCard
+}
+
+func (rt *route) matches(n *domain.Notification) bool {
+	if rt.companyPattern != nil && !rt.companyPattern.MatchString(n.CompanyName) {
+		return false
+	}
+
+	if len(rt.keywords) > 0 {
+		text := strings.ToLower(n.NotificationText)
+		if !slices.ContainsFunc(rt.keywords, func(keyword string) bool {
+			return strings.Contains(text, keyword)
+		}) {
+			return false
+		}
+	}
+
+	if len(rt.sources) > 0 && !slices.ContainsFunc(rt.sources, func(source string) bool {
+		return strings.EqualFold(source, n.Source)
+	}) {
+		return false
+	}
+
+	if len(rt.phonePrefixes) > 0 {
+		phone := normalizePhone(n.Phone)
+		if !slices.ContainsFunc(rt.phonePrefixes, func(prefix string) bool {
+			return strings.HasPrefix(phone, prefix)
+		}) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ChatIDs returns every chat the router can deliver to.
+func (r *Router) ChatIDs() []int64 {
+	var chatIDs []int64
+	for _, target := range r.defaultTargets {
+		if !slices.Contains(chatIDs, target.ChatID) {
+			chatIDs = append(chatIDs, target.ChatID)
+		}
+	}
+	for _, rt := range r.routes {
+		for _, target := range rt.targets {
+			if !slices.Contains(chatIDs, target.ChatID) {
+				chatIDs = append(chatIDs, target.ChatID)
+			}
+		}
+	}
+	return chatIDs
+}
@@ -0,0 +1,215 @@
+package services
+
+import (
+	"new-client-notification-bot/config"
+	"new-client-notification-bot/internal/domain"
+	"slices"
+	"testing"
+)
+
+func TestRouter_Route(t *testing.T) {
+	router, err := NewRouter(&config.RoutingConfig{
+		Routes: []config.RouteConfig{
+			{Name: "llc", CompanyPattern: `(?i)^ооо`, ChatIDs: []int64{1}},
+			{Name: "wholesale", Keywords: []string{"Опт", "wholesale"}, ChatIDs: []int64{2}},
+			{Name: "landing", Sources: []string{"landing"}, ChatIDs: []int64{3}},
+			{Name: "moscow", PhonePrefixes: []string{"+7 915", "7916"}, ChatIDs: []int64{4, 1}},
+			{Name: "landing wholesale", Sources: []string{"landing"}, Keywords: []string{"опт"}, ChatIDs: []int64{5}},
+		},
+		DefaultChatIDs: []int64{42},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		input    domain.Notification
+		expected []int64
+	}{
+		{
+			name:     "no route matches",
+			input:    domain.Notification{Phone: "+7 912 345 67 89", CompanyName: "ИП Иванов", NotificationText: "Здравствуйте"},
+			expected: []int64{42},
+		},
+		{
+			name:     "company pattern",
+			input:    domain.Notification{Phone: "+7 912 345 67 89", CompanyName: "ООО Ромашка", NotificationText: "Здравствуйте"},
+			expected: []int64{1},
+		},
+		{
+			name:     "keyword is case-insensitive",
+			input:    domain.Notification{Phone: "+7 912 345 67 89", CompanyName: "ИП Иванов", NotificationText: "Нужна ОПТОВАЯ партия"},
+			expected: []int64{2},
+		},
+		{
+			name:     "phone prefix matches any spelling",
+			input:    domain.Notification{Phone: "8 (916) 345-67-89", CompanyName: "ИП Иванов", NotificationText: "Здравствуйте"},
+			expected: []int64{4, 1},
+		},
+		{
+			name:     "fan out without duplicates",
+			input:    domain.Notification{Phone: "+7 915 345 67 89", CompanyName: "ООО Ромашка", NotificationText: "опт", Source: "Landing"},
+			expected: []int64{1, 2, 3, 4, 5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := router.Route(&tt.input)
+			if !slices.Equal(result, targets(tt.expected, nil)) {
+				t.Errorf("Route() = %v, expected %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRouter_Topics(t *testing.T) {
+	router, err := NewRouter(&config.RoutingConfig{
+		Routes: []config.RouteConfig{
+			{Name: "wholesale", Keywords: []string{"опт"}, ChatIDs: []int64{-100}, Targets: []config.TargetConfig{{ChatID: -100, ThreadID: 5}}},
+			{Name: "retail", Keywords: []string{"розница"}, Targets: []config.TargetConfig{{ChatID: -100, ThreadID: 7}, {ChatID: -100, ThreadID: 5}}},
+		},
+		DefaultTargets: []config.TargetConfig{{ChatID: -100, ThreadID: 1}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		text     string
+		expected []Target
+	}{
+		{name: "default topic", text: "Здравствуйте", expected: []Target{{ChatID: -100, ThreadID: 1}}},
+		{name: "chat and topic", text: "опт", expected: []Target{{ChatID: -100}, {ChatID: -100, ThreadID: 5}}},
+		{name: "topics without duplicates", text: "опт и розница", expected: []Target{{ChatID: -100}, {ChatID: -100, ThreadID: 5}, {ChatID: -100, ThreadID: 7}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := router.Route(&domain.Notification{NotificationText: tt.text})
+			if !slices.Equal(result, tt.expected) {
+				t.Errorf("Route() = %v, expected %v", result, tt.expected)
+			}
+		})
+	}
+
+	if !slices.Equal(router.ChatIDs(), []int64{-100}) {
+		t.Errorf("expected chat -100 once, got %v", router.ChatIDs())
+	}
+}
+
+func TestRouter_Fallback(t *testing.T) {
+	router, err := NewRouter(&config.RoutingConfig{
+		Routes: []config.RouteConfig{
+			{Name: "llc", CompanyPattern: `(?i)^ооо`, ChatIDs: []int64{1}, Fallback: []string{"email", "webhook"}},
+			{Name: "wholesale", Keywords: []string{"опт"}, ChatIDs: []int64{2}, Fallback: []string{"slack", "email"}},
+			{Name: "landing", Sources: []string{"landing"}, ChatIDs: []int64{3}},
+		},
+		DefaultChatIDs:  []int64{42},
+		DefaultFallback: []string{"webhook"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		input    domain.Notification
+		expected []string
+	}{
+		{
+			name:     "no route matches",
+			input:    domain.Notification{CompanyName: "ИП Иванов", NotificationText: "Здравствуйте"},
+			expected: []string{"webhook"},
+		},
+		{
+			name:     "one route",
+			input:    domain.Notification{CompanyName: "ООО Ромашка", NotificationText: "Здравствуйте"},
+			expected: []string{"email", "webhook"},
+		},
+		{
+			name:     "chains joined without repeats",
+			input:    domain.Notification{CompanyName: "ООО Ромашка", NotificationText: "Нужен опт"},
+			expected: []string{"email", "webhook", "slack"},
+		},
+		{
+			name:     "matched route without chain",
+			input:    domain.Notification{CompanyName: "ИП Иванов", NotificationText: "Здравствуйте", Source: "landing"},
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := router.Fallback(&tt.input)
+			if !slices.Equal(result, tt.expected) {
+				t.Errorf("Fallback() = %v, expected %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRouter_ContactCard(t *testing.T) {
+	router, err := NewRouter(&config.RoutingConfig{
+		Routes: []config.RouteConfig{
+			{Name: "llc", CompanyPattern: `(?i)^ооо`, ChatIDs: []int64{1}, ContactCard: true},
+			{Name: "wholesale", Keywords: []string{"опт"}, ChatIDs: []int64{2}},
+		},
+		DefaultChatIDs:     []int64{42},
+		DefaultContactCard: true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		input    domain.Notification
+		target   Target
+		expected bool
+	}{
+		{
+			name:     "route with contact card",
+			input:    domain.Notification{CompanyName: "ООО Ромашка", NotificationText: "Нужен опт"},
+			target:   Target{ChatID: 1},
+			expected: true,
+		},
+		{
+			name:     "route without contact card",
+			input:    domain.Notification{CompanyName: "ООО Ромашка", NotificationText: "Нужен опт"},
+			target:   Target{ChatID: 2},
+			expected: false,
+		},
+		{
+			name:     "default targets",
+			input:    domain.Notification{CompanyName: "ИП Иванов", NotificationText: "Здравствуйте"},
+			target:   Target{ChatID: 42},
+			expected: true,
+		},
+		{
+			name:     "matched route does not use the default",
+			input:    domain.Notification{CompanyName: "ИП Иванов", NotificationText: "Нужен опт"},
+			target:   Target{ChatID: 2},
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := router.ContactCard(&tt.input, tt.target); result != tt.expected {
+				t.Errorf("ContactCard() = %v, expected %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNewRouter_InvalidPattern(t *testing.T) {
+	_, err := NewRouter(&config.RoutingConfig{
+		Routes: []config.RouteConfig{{Name: "broken", CompanyPattern: "(", ChatIDs: []int64{1}}},
+	})
+	if err == nil {
+		t.Errorf("expected error but got none")
+	}
+}
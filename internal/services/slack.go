@@ -0,0 +1,180 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"new-client-notification-bot/config"
+	"new-client-notification-bot/internal/domain"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog"
+)
+
+const ChannelSlack = "slack"
+
+// Block Kit limits, in characters: header text, a section field and section
+// text.
+const (
+	slackHeaderLimit  = 150
+	slackFieldLimit   = 2000
+	slackSectionLimit = 3000
+)
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+type slackText struct {
+	Type  string `json:"type"`
+	Text  string `json:"text"`
+	Emoji bool   `json:"emoji,omitempty"`
+}
+
+type slackBlock struct {
+	Type   string      `json:"type"`
+	Text   *slackText  `json:"text,omitempty"`
+	Fields []slackText `json:"fields,omitempty"`
+}
+
+type slackPayload struct {
+	// Text is shown in notifications, where blocks are not rendered.
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+// SlackService posts notifications to a Slack incoming webhook.
+type SlackService struct {
+	cfg    *config.SlackConfig
+	client *http.Client
+	retry  RetryPolicy
+	logger *zerolog.Logger
+}
+
+func NewSlackService(cfg *config.SlackConfig, logger *zerolog.Logger) *SlackService {
+	return &SlackService{
+		cfg:    cfg,
+		client: &http.Client{},
+		retry: RetryPolicy{
+			MaxAttempts: cfg.RetryMaxAttempts,
+			BaseDelay:   cfg.RetryBaseDelay,
+			MaxDelay:    cfg.RetryMaxDelay,
+		},
+		logger: logger,
+	}
+}
+
+// Deliveries returns a single delivery: the webhook is bound to one Slack
+// channel, and its URL is a secret that should not end up in the record.
+func (s *SlackService) Deliveries(notification *domain.Notification) []domain.Delivery {
+	return []domain.Delivery{{Status: domain.StatusQueued}}
+}
+
+func (s *SlackService) Send(ctx context.Context, record *domain.NotificationRecord, delivery *domain.Delivery) error {
+	body, err := json.Marshal(slackMessage(&record.Notification))
+	if err != nil {
+		return Permanent(err)
+	}
+
+	attempt := 0
+	err = s.retry.Do(ctx, classifyHTTPError, func() error {
+		attempt++
+		err := s.post(ctx, body)
+		if err != nil {
+			s.logger.Warn().Err(err).Int("attempt", attempt).Msg("slack webhook attempt failed")
+		}
+		return err
+	})
+	if err != nil {
+		s.logger.Error().Err(err).Str("id", record.ID).Msg("failed to post to slack")
+		if retry, _ := classifyHTTPError(err); !retry {
+			return Permanent(err)
+		}
+		return err
+	}
+
+	s.logger.Info().Str("id", record.ID).Msg("slack message posted")
+	return nil
+}
+
+func (s *SlackService) post(ctx context.Context, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+
+	_, err := postJSON(ctx, s.client, s.cfg.WebhookURL, body, nil)
+	return err
+}
+
+// slackMessage lays the lead out as a header with the company and a section
+// with the phone and the text side by side. The optional fields that are set
+// follow in a section of their own, and custom fields in one more.
+func slackMessage(n *domain.Notification) slackPayload {
+	payload := slackPayload{
+		Text: leadTitlePrefix + slackEscaper.Replace(n.CompanyName),
+		Blocks: []slackBlock{
+			{
+				Type: "header",
+				Text: &slackText{Type: "plain_text", Text: truncate(n.CompanyName, slackHeaderLimit), Emoji: true},
+			},
+			{
+				Type: "section",
+				Fields: []slackText{
+					{Type: "mrkdwn", Text: slackField("Телефон", n.Phone)},
+					{Type: "mrkdwn", Text: slackField("Текст обращения", n.NotificationText)},
+				},
+			},
+		},
+	}
+
+	var details []slackText
+	for _, field := range [][2]string{
+		{"Контактное лицо", n.ContactName},
+		{"Email", n.Email},
+		{"Способ связи", n.PreferredContact},
+		{"Источник", n.Source},
+		{"Страница", n.PageURL},
+		{"UTM", utmSummary(n)},
+	} {
+		if field[1] != "" {
+			details = append(details, slackText{Type: "mrkdwn", Text: truncate(slackField(field[0], field[1]), slackFieldLimit)})
+		}
+	}
+	if len(details) > 0 {
+		payload.Blocks = append(payload.Blocks, slackBlock{Type: "section", Fields: details})
+	}
+
+	if len(n.CustomFields) > 0 {
+		var lines []string
+		for _, name := range slices.Sorted(maps.Keys(n.CustomFields)) {
+			lines = append(lines, "*"+slackEscaper.Replace(name)+":* "+slackEscaper.Replace(n.CustomFields[name]))
+		}
+		payload.Blocks = append(payload.Blocks, slackBlock{
+			Type: "section",
+			Text: &slackText{Type: "mrkdwn", Text: truncate(strings.Join(lines, "\n"), slackSectionLimit)},
+		})
+	}
+	return payload
+}
+
+func slackField(title, value string) string {
+	return "*" + title + ":*\n" + slackEscaper.Replace(value)
+}
+
+// utmSummary lists the UTM tags of n as "utm_source=..., utm_medium=...".
+func utmSummary(n *domain.Notification) string {
+	var tags []string
+	for _, param := range n.UTMParams() {
+		tags = append(tags, param[0]+"="+param[1])
+	}
+	return strings.Join(tags, ", ")
+}
+
+// truncate cuts s to limit runes, marking the cut with an ellipsis.
+func truncate(s string, limit int) string {
+	if utf8.RuneCountInString(s) <= limit {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:limit-1]) + "…"
+}
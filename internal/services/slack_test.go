@@ -0,0 +1,167 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"new-client-notification-bot/config"
+	"new-client-notification-bot/internal/domain"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// slackStandIn answers webhook posts with the given statuses in turn and
+// 200 "ok" once they run out.
+type slackStandIn struct {
+	mu       sync.Mutex
+	statuses []int
+	payloads []slackPayload
+}
+
+func (s *slackStandIn) handler(w http.ResponseWriter, r *http.Request) {
+	var payload slackPayload
+	json.NewDecoder(r.Body).Decode(&payload)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.payloads = append(s.payloads, payload)
+
+	if len(s.statuses) == 0 {
+		w.Write([]byte("ok"))
+		return
+	}
+	status := s.statuses[0]
+	s.statuses = s.statuses[1:]
+	if status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", "0")
+	}
+	w.WriteHeader(status)
+	w.Write([]byte("invalid_payload"))
+}
+
+func newTestSlackService(webhookURL string) *SlackService {
+	logger := zerolog.Nop()
+	return NewSlackService(&config.SlackConfig{
+		WebhookURL:       webhookURL,
+		Timeout:          time.Second,
+		RetryMaxAttempts: 3,
+		RetryBaseDelay:   time.Millisecond,
+		RetryMaxDelay:    time.Millisecond,
+	}, &logger)
+}
+
+func TestSlackService_Send(t *testing.T) {
+	tests := []struct {
+		name        string
+		statuses    []int
+		shouldError bool
+		permanent   bool
+		posts       int
+	}{
+		{name: "posted", posts: 1},
+		{name: "server error is retried", statuses: []int{http.StatusInternalServerError}, posts: 2},
+		{name: "rate limit is retried", statuses: []int{http.StatusTooManyRequests}, posts: 2},
+		{name: "invalid payload is permanent", statuses: []int{http.StatusBadRequest}, shouldError: true, permanent: true, posts: 1},
+		{
+			name:        "outage exhausts attempts",
+			statuses:    []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway},
+			shouldError: true,
+			posts:       3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			standIn := &slackStandIn{statuses: tt.statuses}
+			server := httptest.NewServer(http.HandlerFunc(standIn.handler))
+			defer server.Close()
+
+			record := &domain.NotificationRecord{ID: "0001", Notification: testNotification}
+			err := newTestSlackService(server.URL).Send(context.Background(), record, &domain.Delivery{})
+
+			if tt.shouldError != (err != nil) {
+				t.Fatalf("expected error %v, got %v", tt.shouldError, err)
+			}
+			if tt.permanent != isPermanentError(err) {
+				t.Errorf("expected permanent %v, got %v", tt.permanent, err)
+			}
+			if len(standIn.payloads) != tt.posts {
+				t.Errorf("expected %d posts, got %d", tt.posts, len(standIn.payloads))
+			}
+		})
+	}
+}
+
+func TestSlackMessage(t *testing.T) {
+	notification := domain.Notification{
+		Phone:            "+7 912 345 67 89",
+		CompanyName:      "ООО <Ромашка> & Co",
+		NotificationText: "Нужен счет <срочно>",
+	}
+
+	payload := slackMessage(&notification)
+
+	if len(payload.Blocks) != 2 {
+		t.Fatalf("expected header and section blocks, got %+v", payload.Blocks)
+	}
+	header := payload.Blocks[0]
+	if header.Type != "header" || header.Text.Type != "plain_text" || header.Text.Text != "ООО <Ромашка> & Co" {
+		t.Errorf("unexpected header %+v", header)
+	}
+	fields := payload.Blocks[1].Fields
+	if len(fields) != 2 || fields[0].Text != "*Телефон:*\n+7 912 345 67 89" || fields[1].Text != "*Текст обращения:*\nНужен счет &lt;срочно&gt;" {
+		t.Errorf("unexpected fields %+v", fields)
+	}
+	if payload.Text != "Новая заявка: ООО &lt;Ромашка&gt; &amp; Co" {
+		t.Errorf("unexpected fallback text %q", payload.Text)
+	}
+
+	notification.CompanyName = strings.Repeat("я", 200)
+	if header := slackMessage(&notification).Blocks[0].Text.Text; len([]rune(header)) != slackHeaderLimit {
+		t.Errorf("expected header cut to %d characters, got %d", slackHeaderLimit, len([]rune(header)))
+	}
+}
+
+func TestSlackMessage_Details(t *testing.T) {
+	notification := testNotification
+	notification.ContactName = "Иван"
+	notification.PageURL = "https://example.com/" + strings.Repeat("a", slackFieldLimit)
+	notification.UTMSource = "google"
+	notification.CustomFields = map[string]string{"city": "Пермь", "budget": "<100k"}
+
+	payload := slackMessage(&notification)
+
+	if len(payload.Blocks) != 4 {
+		t.Fatalf("expected header, main, details and custom field blocks, got %+v", payload.Blocks)
+	}
+	details := payload.Blocks[2].Fields
+	if len(details) != 3 || details[0].Text != "*Контактное лицо:*\nИван" || details[2].Text != "*UTM:*\nutm_source=google" {
+		t.Errorf("unexpected details %+v", details)
+	}
+	if n := len([]rune(details[1].Text)); n != slackFieldLimit {
+		t.Errorf("expected page field cut to %d characters, got %d", slackFieldLimit, n)
+	}
+	if custom := payload.Blocks[3].Text.Text; custom != "*budget:* &lt;100k\n*city:* Пермь" {
+		t.Errorf("unexpected custom fields %q", custom)
+	}
+}
+
+func TestSlackService_ErrorHidesWebhookURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	webhookURL := server.URL + "/services/T000/B000/secret"
+	server.Close()
+
+	service := newTestSlackService(webhookURL)
+	service.retry.MaxAttempts = 1
+
+	record := &domain.NotificationRecord{ID: "0001", Notification: testNotification}
+	err := service.Send(context.Background(), record, &domain.Delivery{})
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("expected error without the webhook url, got %v", err)
+	}
+}
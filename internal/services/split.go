@@ -0,0 +1,403 @@
+package services
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// telegramMessageLimit is the Bot API limit on message text, in UTF-16 code
+// units.
+const telegramMessageLimit = 4096
+
+// chunkMarkerReserve is the room kept in every chunk for its "(i/n)" marker.
+const chunkMarkerReserve = 16
+
+const (
+	breakNone = iota
+	// breakInside is inside an entity but not inside its markup, so the
+	// entity can be closed there and reopened in the next chunk.
+	breakInside
+	breakRune
+	breakWord
+	breakLine
+)
+
+// boundary is a place the text can be split at: its byte offset, the UTF-16
+// length of the text before it and how good a place to split it is. At a
+// breakInside boundary, entities indexes the entities open there in the
+// list scanBoundaries returns with the boundaries.
+type boundary struct {
+	offset   int
+	units    int
+	kind     int
+	entities int
+}
+
+// splitMessage cuts text into chunks of at most limit UTF-16 units, counting
+// the "(i/n)" marker appended to each chunk. It prefers line breaks, then
+// spaces, and cuts inside an HTML or MarkdownV2 entity only when a single
+// entity is longer than a whole chunk. Such an entity is closed at the cut
+// and opened again in the next chunk, so every chunk stays valid markup.
+func splitMessage(text, parseMode string, limit int) []string {
+	if utf16Len(text) <= limit {
+		return []string{text}
+	}
+
+	boundaries, entities := scanBoundaries(text, parseMode)
+	budget := limit - chunkMarkerReserve
+
+	var chunks []string
+	start, reopen := 0, ""
+	for start < len(boundaries)-1 {
+		chunkBudget := budget - utf16Len(reopen)
+		end := pickBoundary(boundaries, start, chunkBudget)
+		closing, next := "", ""
+		if boundaries[end].kind == breakInside {
+			end, closing, next = closeEntities(parseMode, boundaries, entities, start, end, chunkBudget)
+		}
+
+		chunk := strings.TrimSpace(text[boundaries[start].offset:boundaries[end].offset])
+		if chunk != "" {
+			chunks = append(chunks, reopen+chunk+closing)
+		}
+		start, reopen = end, next
+	}
+
+	for i := range chunks {
+		marker := escapeText(parseMode, fmt.Sprintf("(%d/%d)", i+1, len(chunks)))
+		chunks[i] += "\n" + marker
+	}
+	return chunks
+}
+
+// pickBoundary returns the index of the best boundary that keeps the chunk
+// starting at boundaries[start] within budget units.
+func pickBoundary(boundaries []boundary, start, budget int) int {
+	last := len(boundaries) - 1
+	maxUnits := boundaries[start].units + budget
+	if boundaries[last].units <= maxUnits {
+		return last
+	}
+
+	best, bestKind := -1, breakNone
+	for i := start + 1; i <= last && boundaries[i].units <= maxUnits; i++ {
+		if boundaries[i].kind >= bestKind {
+			best, bestKind = i, boundaries[i].kind
+		}
+	}
+
+	if best == -1 {
+		// No place to split within the budget, as inside a tag longer
+		// than a chunk: cut at the next one rather than loop forever.
+		return start + 1
+	}
+	return best
+}
+
+// closeEntities moves a cut at boundaries[end] back until the markup that
+// closes the entities open there fits into budget, and returns the cut with
+// that markup and the markup that opens them again.
+func closeEntities(parseMode string, boundaries []boundary, entities [][]string, start, end, budget int) (int, string, string) {
+	for cut := end; cut > start; cut-- {
+		if boundaries[cut].kind != breakInside {
+			continue
+		}
+		closing, reopen, ok := closeAndReopen(entities[boundaries[cut].entities], parseMode)
+		if ok && boundaries[cut].units-boundaries[start].units+utf16Len(closing) <= budget {
+			return cut, closing, reopen
+		}
+	}
+	return end, "", ""
+}
+
+// scanBoundaries lists the rune boundaries of text that are not inside a
+// markup token for parseMode, marking which of them lie outside of any
+// entity. The start and the end of text are always listed. The entities open
+// at the boundaries are listed apart, once per change, outermost first.
+func scanBoundaries(text, parseMode string) ([]boundary, [][]string) {
+	boundaries := []boundary{{}}
+	var entities [][]string
+
+	var state markupState
+	units := 0
+	for offset := 0; offset < len(text); {
+		r, size := utf8.DecodeRuneInString(text[offset:])
+		state.advance(text, offset, parseMode)
+
+		offset += size
+		units += utf16.RuneLen(r)
+
+		kind, open := breakNone, 0
+		if state.safe() {
+			switch r {
+			case '\n':
+				kind = breakLine
+			case ' ', '\t':
+				kind = breakWord
+			default:
+				kind = breakRune
+			}
+		} else if state.between() {
+			kind = breakInside
+			// The state never changes its lists in place, so an unchanged
+			// list is the same slice.
+			current := state.entities(parseMode)
+			if len(entities) == 0 || !sameSlice(entities[len(entities)-1], current) {
+				entities = append(entities, current)
+			}
+			open = len(entities) - 1
+		}
+		if kind != breakNone || offset == len(text) {
+			boundaries = append(boundaries, boundary{offset: offset, units: units, kind: kind, entities: open})
+		}
+	}
+
+	return boundaries, entities
+}
+
+func sameSlice(a, b []string) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+// markupState follows just enough of the HTML and MarkdownV2 syntax to tell
+// whether a position is inside an entity.
+type markupState struct {
+	// pending counts the runes of the current MarkdownV2 token that are
+	// still to come, such as the second underscore of "__" or the rune
+	// escaped by a backslash.
+	pending int
+
+	inTag    bool
+	inEntity bool
+	tagStart int
+	// tags are the HTML tags open, outermost first. Like markers, the slice
+	// is never changed in place, so it can be kept as is.
+	tags []string
+
+	open      map[string]bool
+	inLink    bool
+	inLinkURL bool
+	// markers are the MarkdownV2 entities open, outermost first. A link is
+	// kept as the markup that closes it, such as "](url)", or just "]"
+	// when its URL cannot be found.
+	markers []string
+}
+
+func (s *markupState) safe() bool {
+	if !s.between() || len(s.tags) > 0 || s.inLink {
+		return false
+	}
+	for _, open := range s.open {
+		if open {
+			return false
+		}
+	}
+	return true
+}
+
+// between reports whether the position is outside of any markup token,
+// although maybe inside an entity.
+func (s *markupState) between() bool {
+	return s.pending == 0 && !s.inTag && !s.inEntity && !s.inLinkURL
+}
+
+// entities returns the entities open, outermost first: HTML tags or
+// MarkdownV2 markers.
+func (s *markupState) entities(parseMode string) []string {
+	if parseMode == ParseModeHTML {
+		return s.tags
+	}
+	return s.markers
+}
+
+// closeAndReopen returns the markup that closes entities and the markup that
+// opens them again. It fails for a link whose URL cannot be found.
+func closeAndReopen(entities []string, parseMode string) (string, string, bool) {
+	var closing, reopen strings.Builder
+	switch parseMode {
+	case ParseModeHTML:
+		for i := len(entities) - 1; i >= 0; i-- {
+			name, _, _ := strings.Cut(strings.Trim(entities[i], "<>"), " ")
+			closing.WriteString("</" + name + ">")
+		}
+		reopen.WriteString(strings.Join(entities, ""))
+	case ParseModeMarkdownV2:
+		for i := len(entities) - 1; i >= 0; i-- {
+			switch marker := entities[i]; {
+			case marker == "]":
+				return "", "", false
+			case marker == "```":
+				closing.WriteString("\n```")
+			default:
+				closing.WriteString(marker)
+			}
+		}
+		for _, marker := range entities {
+			switch {
+			case isLinkMarker(marker):
+				marker = "["
+			case marker == "```":
+				marker += "\n"
+			}
+			reopen.WriteString(marker)
+		}
+	}
+	return closing.String(), reopen.String(), true
+}
+
+func isLinkMarker(marker string) bool {
+	return strings.HasPrefix(marker, "]")
+}
+
+// markdownV2LinkURL finds the URL of the link whose text text is in.
+func markdownV2LinkURL(text string) (string, bool) {
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case ']':
+			rest, ok := strings.CutPrefix(text[i+1:], "(")
+			if !ok {
+				return "", false
+			}
+			for j := 0; j < len(rest); j++ {
+				switch rest[j] {
+				case '\\':
+					j++
+				case ')':
+					return rest[:j], true
+				}
+			}
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// toggle opens the MarkdownV2 entity marker, or closes it if it is open.
+func (s *markupState) toggle(marker string) {
+	s.open[marker] = !s.open[marker]
+	if s.open[marker] {
+		s.markers = append(slices.Clip(s.markers), marker)
+		return
+	}
+	s.markers = without(s.markers, slices.Index(s.markers, marker))
+}
+
+// without returns a copy of markers without the one at i, leaving markers
+// as it is. A negative i removes nothing.
+func without(markers []string, i int) []string {
+	if i < 0 {
+		return markers
+	}
+	return slices.Concat(markers[:i], markers[i+1:])
+}
+
+// advance updates the state for the rune that starts at offset.
+func (s *markupState) advance(text string, offset int, parseMode string) {
+	switch parseMode {
+	case ParseModeHTML:
+		s.advanceHTML(text, offset)
+	case ParseModeMarkdownV2:
+		s.advanceMarkdownV2(text, offset)
+	}
+}
+
+func (s *markupState) advanceHTML(text string, offset int) {
+	switch c := text[offset]; {
+	case s.inTag:
+		if c == '>' {
+			s.inTag = false
+			tag := text[s.tagStart : offset+1]
+			if strings.HasPrefix(tag, "</") {
+				s.tags = slices.Clip(s.tags[:max(len(s.tags)-1, 0)])
+			} else {
+				s.tags = append(slices.Clip(s.tags), tag)
+			}
+		}
+	case s.inEntity:
+		if c == ';' {
+			s.inEntity = false
+		}
+	case c == '<':
+		s.inTag = true
+		s.tagStart = offset
+	case c == '&':
+		s.inEntity = true
+	}
+}
+
+func (s *markupState) advanceMarkdownV2(text string, offset int) {
+	if s.pending > 0 {
+		s.pending--
+		return
+	}
+	if s.open == nil {
+		s.open = map[string]bool{}
+	}
+
+	rest := text[offset:]
+	c := rest[0]
+
+	if c == '\\' {
+		s.pending = 1
+		return
+	}
+
+	// Inside code only the closing backticks are markup.
+	if s.open["```"] || s.open["`"] {
+		if strings.HasPrefix(rest, "```") && s.open["```"] {
+			s.toggle("```")
+			s.pending = 2
+		} else if c == '`' && s.open["`"] {
+			s.toggle("`")
+		}
+		return
+	}
+
+	if s.inLinkURL {
+		if c == ')' {
+			s.inLinkURL = false
+		}
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(rest, "```"):
+		s.toggle("```")
+		s.pending = 2
+	case c == '`':
+		s.toggle("`")
+	case strings.HasPrefix(rest, "__"):
+		s.toggle("__")
+		s.pending = 1
+	case strings.HasPrefix(rest, "||"):
+		s.toggle("||")
+		s.pending = 1
+	case c == '_' || c == '*' || c == '~':
+		s.toggle(string(c))
+	case c == '[' && !s.inLink:
+		// The URL is looked up once, not at every cut inside the link.
+		marker := "]"
+		if url, ok := markdownV2LinkURL(rest[1:]); ok {
+			marker = "](" + url + ")"
+		}
+		s.inLink = true
+		s.markers = append(slices.Clip(s.markers), marker)
+	case c == ']' && s.inLink:
+		s.inLink = false
+		s.inLinkURL = strings.HasPrefix(rest, "](")
+		s.markers = without(s.markers, slices.IndexFunc(s.markers, isLinkMarker))
+	}
+}
+
+func utf16Len(s string) int {
+	units := 0
+	for _, r := range s {
+		units += utf16.RuneLen(r)
+	}
+	return units
+}
@@ -0,0 +1,176 @@
+package services
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestSplitMessage_ShortMessage(t *testing.T) {
+	chunks := splitMessage("short message", ParseModePlain, 100)
+	if len(chunks) != 1 || chunks[0] != "short message" {
+		t.Errorf("expected message to be sent as is, got %q", chunks)
+	}
+}
+
+func TestSplitMessage_Limits(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		parseMode string
+		limit     int
+	}{
+		{
+			name:      "plain lines",
+			text:      strings.Repeat("Строка с текстом заявки\n", 50),
+			parseMode: ParseModePlain,
+			limit:     100,
+		},
+		{
+			name:      "astral runes count as two units",
+			text:      strings.Repeat("😀 ", 100),
+			parseMode: ParseModePlain,
+			limit:     60,
+		},
+		{
+			name:      "html",
+			text:      strings.Repeat("<b>Клиент &amp; Ко</b> <a href=\"tel:+79123456789\">+7 912</a>\n", 20),
+			parseMode: ParseModeHTML,
+			limit:     120,
+		},
+		{
+			name:      "markdownv2",
+			text:      strings.Repeat("*Клиент\\_Ко* [\\+7 912](tel:+79123456789) __под черк__\n", 20),
+			parseMode: ParseModeMarkdownV2,
+			limit:     120,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := splitMessage(tt.text, tt.parseMode, tt.limit)
+			if len(chunks) < 2 {
+				t.Fatalf("expected several chunks, got %d", len(chunks))
+			}
+
+			var rebuilt []string
+			for i, chunk := range chunks {
+				if units := utf16Len(chunk); units > tt.limit {
+					t.Errorf("chunk %d is %d units long, limit %d", i, units, tt.limit)
+				}
+
+				marker := escapeText(tt.parseMode, fmt.Sprintf("(%d/%d)", i+1, len(chunks)))
+				body, found := strings.CutSuffix(chunk, "\n"+marker)
+				if !found {
+					t.Errorf("chunk %d has no marker %q: %q", i, marker, chunk)
+				}
+				rebuilt = append(rebuilt, strings.Fields(body)...)
+
+				if !(&markupState{}).balanced(body, tt.parseMode) {
+					t.Errorf("chunk %d splits an entity: %q", i, body)
+				}
+			}
+
+			if strings.Join(rebuilt, " ") != strings.Join(strings.Fields(tt.text), " ") {
+				t.Errorf("chunks do not add up to the original text")
+			}
+		})
+	}
+}
+
+func TestSplitMessage_PrefersLineBreaks(t *testing.T) {
+	text := "first line with words\nsecond line with words\nthird line with words"
+
+	chunks := splitMessage(text, ParseModePlain, 16+len("second line with words\n"))
+
+	expected := []string{
+		"first line with words\n(1/3)",
+		"second line with words\n(2/3)",
+		"third line with words\n(3/3)",
+	}
+	if strings.Join(chunks, "|") != strings.Join(expected, "|") {
+		t.Errorf("splitMessage() = %q, expected %q", chunks, expected)
+	}
+}
+
+func TestSplitMessage_OversizedEntity(t *testing.T) {
+	long := strings.Repeat("ж", 200)
+	tests := []struct {
+		name      string
+		text      string
+		parseMode string
+		// first is how the first chunk opens.
+		first string
+	}{
+		{name: "html bold", text: "<b>" + long + "</b>", parseMode: ParseModeHTML, first: "<b>"},
+		{name: "html nested link", text: "<i>see <a href=\"https://example.com/?a=1&amp;b=2\">" + long + "</a></i>", parseMode: ParseModeHTML, first: "<i>"},
+		{name: "markdownv2 bold", text: "*" + long + "*", parseMode: ParseModeMarkdownV2, first: "*"},
+		{name: "markdownv2 link", text: "_[" + long + "](https://example.com/\\)x)_", parseMode: ParseModeMarkdownV2, first: "_["},
+		{name: "markdownv2 code block", text: "```\n" + long + "\n```", parseMode: ParseModeMarkdownV2, first: "```"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := splitMessage(tt.text, tt.parseMode, 100)
+			if len(chunks) < 3 {
+				t.Fatalf("expected the entity to be cut, got %q", chunks)
+			}
+
+			xs := 0
+			for i, chunk := range chunks {
+				if units := utf16Len(chunk); units > 100 {
+					t.Errorf("chunk %d is %d units long", i, units)
+				}
+				body, _ := strings.CutSuffix(chunk, "\n"+escapeText(tt.parseMode, fmt.Sprintf("(%d/%d)", i+1, len(chunks))))
+				if !(&markupState{}).balanced(body, tt.parseMode) {
+					t.Errorf("chunk %d leaves an entity open: %q", i, body)
+				}
+				if tt.parseMode == ParseModeHTML {
+					decoder := xml.NewDecoder(strings.NewReader("<root>" + body + "</root>"))
+					for {
+						if _, err := decoder.Token(); err != nil {
+							if err != io.EOF {
+								t.Errorf("chunk %d is not valid markup: %v: %q", i, err, body)
+							}
+							break
+						}
+					}
+				}
+				xs += strings.Count(body, "ж")
+			}
+			if !strings.HasPrefix(chunks[0], tt.first) {
+				t.Errorf("unexpected first chunk %q", chunks[0])
+			}
+			if want := strings.Count(tt.text, "ж"); xs != want {
+				t.Errorf("chunks carry %d of %d characters", xs, want)
+			}
+		})
+	}
+}
+
+// balanced reports whether text leaves no entity open.
+func (s *markupState) balanced(text, parseMode string) bool {
+	for offset := range text {
+		s.advance(text, offset, parseMode)
+	}
+	return s.safe()
+}
+
+func BenchmarkSplitMessage_OversizedEntity(b *testing.B) {
+	for _, tt := range []struct {
+		name      string
+		text      string
+		parseMode string
+	}{
+		{name: "html", text: "<b>" + strings.Repeat("ж", 100_000) + "</b>", parseMode: ParseModeHTML},
+		{name: "markdownv2 link", text: "[" + strings.Repeat("ж", 100_000) + "](https://example.com)", parseMode: ParseModeMarkdownV2},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			for b.Loop() {
+				splitMessage(tt.text, tt.parseMode, telegramMessageLimit)
+			}
+		})
+	}
+}
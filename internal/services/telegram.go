@@ -2,8 +2,12 @@ package services
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"new-client-notification-bot/config"
+	"strings"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -11,39 +15,290 @@ import (
 )
 
 type TelegramBotService struct {
-	bot    *tgbotapi.BotAPI
-	chatID int64
-	logger *zerolog.Logger
+	bot         *tgbotapi.BotAPI
+	parseMode   string
+	sendTimeout time.Duration
+	retry       RetryPolicy
+	logger      *zerolog.Logger
+}
+
+// contextClient binds every Bot API request to ctx, because tgbotapi builds
+// its requests without one.
+type contextClient struct {
+	ctx    context.Context
+	client tgbotapi.HTTPClient
+}
+
+func (c contextClient) Do(req *http.Request) (*http.Response, error) {
+	return c.client.Do(req.WithContext(c.ctx))
 }
 
 func NewTelegramBotService(cfg *config.BotConfig, logger *zerolog.Logger) (*TelegramBotService, error) {
-	bot, err := tgbotapi.NewBotAPI(cfg.BotToken)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.SendTimeout)
+	defer cancel()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.Proxy != nil {
+		transport.Proxy = http.ProxyURL(cfg.Proxy)
+	}
+	client := &http.Client{Transport: transport}
+
+	bot, err := tgbotapi.NewBotAPIWithClient(cfg.BotToken, cfg.APIURL+"/bot%s/%s", contextClient{ctx: ctx, client: client})
 	if err != nil {
-		logger.Error().Err(err).Msg("failed to create telegram bot")
+		logger.Error().Err(err).Str("api_url", cfg.APIURL).Msg("failed to create telegram bot")
 		return nil, err
 	}
-	bot.Client = &http.Client{
-		Timeout: 30 * time.Second,
+	bot.Client = client
+	event := logger.Info().Str("bot_name", bot.Self.UserName).Str("api_url", cfg.APIURL)
+	if cfg.Proxy != nil {
+		event = event.Str("proxy", cfg.Proxy.Redacted())
 	}
-	logger.Info().Str("bot_name", bot.Self.UserName).Msg("telegram bot created")
+	event.Msg("telegram bot created")
 
 	return &TelegramBotService{
-		bot:    bot,
-		chatID: cfg.ChatID,
+		bot:         bot,
+		parseMode:   cfg.ParseMode,
+		sendTimeout: cfg.SendTimeout,
+		retry: RetryPolicy{
+			MaxAttempts: cfg.RetryMaxAttempts,
+			BaseDelay:   cfg.RetryBaseDelay,
+			MaxDelay:    cfg.RetryMaxDelay,
+		},
 		logger: logger,
 	}, nil
 }
 
-func (t *TelegramBotService) SendMessage(ctx context.Context, message string) error {
-	t.logger.Info().Int64("chat_id", t.chatID).Msg("sending message")
+func (t *TelegramBotService) SendMessage(ctx context.Context, msg Message) (SentMessage, error) {
+	chunks := splitMessage(msg.Text, t.parseMode, telegramMessageLimit)
+	t.logger.Info().Int64("chat_id", msg.ChatID).Int("chunks", len(chunks)).Int("sent_chunks", len(msg.SentChunks)).Msg("sending message")
 
-	msg := tgbotapi.NewMessage(t.chatID, message)
+	sent := SentMessage{ChatID: msg.ChatID}
+	for i, chunk := range chunks {
+		if i < len(msg.SentChunks) {
+			sent.MessageIDs = append(sent.MessageIDs, msg.SentChunks[i])
+			continue
+		}
+		messageID, err := t.sendChunk(ctx, msg, chunk, i == len(chunks)-1)
+		if err != nil {
+			return sent, err
+		}
+		sent.MessageIDs = append(sent.MessageIDs, messageID)
+	}
 
-	if _, err := t.bot.Send(msg); err != nil {
-		t.logger.Error().Err(err).Msg("failed to send message")
-		return err
+	t.logger.Info().Int64("chat_id", msg.ChatID).Ints("message_ids", sent.MessageIDs).Msg("message sent")
+	return sent, nil
+}
+
+func (t *TelegramBotService) EditMessage(ctx context.Context, sent SentMessage, msg Message) (SentMessage, error) {
+	chunks := splitMessage(msg.Text, t.parseMode, telegramMessageLimit)
+	t.logger.Info().Int64("chat_id", sent.ChatID).Ints("message_ids", sent.MessageIDs).Int("chunks", len(chunks)).Msg("editing message")
+
+	edited := SentMessage{ChatID: sent.ChatID}
+	for i, chunk := range chunks {
+		last := i == len(chunks)-1
+		if i >= len(sent.MessageIDs) {
+			messageID, err := t.sendChunk(ctx, Message{ChatID: sent.ChatID, ThreadID: msg.ThreadID, NotificationID: msg.NotificationID}, chunk, last)
+			if err != nil {
+				return edited, err
+			}
+			edited.MessageIDs = append(edited.MessageIDs, messageID)
+			continue
+		}
+
+		edit := tgbotapi.NewEditMessageText(sent.ChatID, sent.MessageIDs[i], chunk)
+		edit.ParseMode = t.parseMode
+		if msg.NotificationID != "" && last {
+			keyboard := leadKeyboard(msg.NotificationID)
+			edit.ReplyMarkup = &keyboard
+		}
+		if err := t.send(ctx, edit); err != nil && !isNotModifiedError(err) {
+			return edited, err
+		}
+		edited.MessageIDs = append(edited.MessageIDs, sent.MessageIDs[i])
+	}
+
+	// The new text is shorter: drop the chunks it no longer needs.
+	if len(sent.MessageIDs) > len(chunks) {
+		surplus := SentMessage{ChatID: sent.ChatID, MessageIDs: sent.MessageIDs[len(chunks):]}
+		if err := t.DeleteMessage(ctx, surplus); err != nil {
+			return edited, err
+		}
+	}
+
+	t.logger.Info().Int64("chat_id", sent.ChatID).Ints("message_ids", edited.MessageIDs).Msg("message edited")
+	return edited, nil
+}
+
+func (t *TelegramBotService) DeleteMessage(ctx context.Context, sent SentMessage) error {
+	for _, messageID := range sent.MessageIDs {
+		if err := t.send(ctx, tgbotapi.NewDeleteMessage(sent.ChatID, messageID)); err != nil {
+			return err
+		}
 	}
 
-	t.logger.Info().Int64("chat_id", t.chatID).Msg("message sent")
+	t.logger.Info().Int64("chat_id", sent.ChatID).Ints("message_ids", sent.MessageIDs).Msg("message deleted")
 	return nil
 }
+
+// sendChunk sends one chunk of msg and returns its message ID. Buttons go
+// under the last chunk, right where the lead ends.
+func (t *TelegramBotService) sendChunk(ctx context.Context, msg Message, chunk string, last bool) (int, error) {
+	out := tgbotapi.NewMessage(msg.ChatID, chunk)
+	out.ParseMode = t.parseMode
+	if msg.NotificationID != "" && last {
+		out.ReplyMarkup = leadKeyboard(msg.NotificationID)
+	}
+
+	resp, err := t.sendText(ctx, out, msg.ThreadID)
+	if err != nil {
+		return 0, err
+	}
+
+	var message tgbotapi.Message
+	if err := json.Unmarshal(resp.Result, &message); err != nil {
+		return 0, fmt.Errorf("decode sent message: %w", err)
+	}
+	return message.MessageID, nil
+}
+
+// sendText sends out to the forum topic threadID, or to the chat itself when
+// threadID is 0.
+func (t *TelegramBotService) sendText(ctx context.Context, out tgbotapi.MessageConfig, threadID int) (*tgbotapi.APIResponse, error) {
+	if threadID == 0 {
+		return t.request(ctx, out)
+	}
+
+	params, err := messageParams(out, threadID)
+	if err != nil {
+		return nil, err
+	}
+	return t.call(ctx, func(bot *tgbotapi.BotAPI) (*tgbotapi.APIResponse, error) {
+		return bot.MakeRequest("sendMessage", params)
+	})
+}
+
+// messageParams builds the sendMessage parameters of out by hand, because
+// tgbotapi v5.5 has no field for the forum topic.
+func messageParams(out tgbotapi.MessageConfig, threadID int) (tgbotapi.Params, error) {
+	params := tgbotapi.Params{}
+	params.AddNonZero64("chat_id", out.ChatID)
+	params.AddNonZero("message_thread_id", threadID)
+	params.AddNonZero("reply_to_message_id", out.ReplyToMessageID)
+	params.AddNonEmpty("text", out.Text)
+	params.AddNonEmpty("parse_mode", out.ParseMode)
+	err := params.AddInterface("reply_markup", out.ReplyMarkup)
+	return params, err
+}
+
+// SendContact sends the client as a contact card, so it can be called or
+// saved in one tap.
+func (t *TelegramBotService) SendContact(ctx context.Context, msg Message, phone, name string) (SentMessage, error) {
+	params := replyParams(msg)
+	params["phone_number"] = phone
+	params["first_name"] = name
+
+	resp, err := t.call(ctx, func(bot *tgbotapi.BotAPI) (*tgbotapi.APIResponse, error) {
+		return bot.MakeRequest("sendContact", params)
+	})
+	if err != nil {
+		return SentMessage{ChatID: msg.ChatID}, err
+	}
+
+	var message tgbotapi.Message
+	if err := json.Unmarshal(resp.Result, &message); err != nil {
+		return SentMessage{ChatID: msg.ChatID}, fmt.Errorf("decode sent contact: %w", err)
+	}
+	t.logger.Info().Int64("chat_id", msg.ChatID).Int("message_id", message.MessageID).Msg("contact sent")
+	return SentMessage{ChatID: msg.ChatID, MessageIDs: []int{message.MessageID}}, nil
+}
+
+// replyParams addresses a message to the chat and topic of msg, as a reply
+// to msg.ReplyTo. The message is sent even if the lead has been deleted.
+func replyParams(msg Message) tgbotapi.Params {
+	params := tgbotapi.Params{}
+	params.AddNonZero64("chat_id", msg.ChatID)
+	params.AddNonZero("message_thread_id", msg.ThreadID)
+	params.AddNonZero("reply_to_message_id", msg.ReplyTo)
+	params.AddBool("allow_sending_without_reply", true)
+	return params
+}
+
+// send delivers c with retries, bounding every attempt by the send timeout.
+func (t *TelegramBotService) send(ctx context.Context, c tgbotapi.Chattable) error {
+	_, err := t.request(ctx, c)
+	return err
+}
+
+// request is send that also returns the Bot API response.
+func (t *TelegramBotService) request(ctx context.Context, c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	return t.call(ctx, func(bot *tgbotapi.BotAPI) (*tgbotapi.APIResponse, error) {
+		return bot.Request(c)
+	})
+}
+
+// call runs do with retries. Every attempt gets a bot bound to its own
+// context, bounded by the send timeout.
+func (t *TelegramBotService) call(ctx context.Context, do func(bot *tgbotapi.BotAPI) (*tgbotapi.APIResponse, error)) (*tgbotapi.APIResponse, error) {
+	var resp *tgbotapi.APIResponse
+	attempt := 0
+	err := t.retry.Do(ctx, classifyTelegramError, func() error {
+		attempt++
+		attemptCtx, cancel := context.WithTimeout(ctx, t.sendTimeout)
+		defer cancel()
+
+		var err error
+		resp, err = do(t.botWithContext(attemptCtx))
+		if err != nil {
+			t.logger.Warn().Err(err).Int("attempt", attempt).Msg("telegram request attempt failed")
+		}
+		return err
+	})
+	if err != nil {
+		t.logger.Error().Err(err).Msg("telegram request failed")
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Ping checks that the Bot API answers, with a single getMe call.
+func (t *TelegramBotService) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, t.sendTimeout)
+	defer cancel()
+
+	_, err := t.botWithContext(ctx).GetMe()
+	return err
+}
+
+// botWithContext returns a shallow copy of the bot whose requests are
+// cancelled together with ctx.
+func (t *TelegramBotService) botWithContext(ctx context.Context) *tgbotapi.BotAPI {
+	bot := *t.bot
+	bot.Client = contextClient{ctx: ctx, client: t.bot.Client}
+	return &bot
+}
+
+// classifyTelegramError retries rate limiting, server errors and transport
+// failures. Any other Bot API error (bad request, bot blocked or kicked, chat
+// not found) will not go away on its own and is returned straight away.
+func classifyTelegramError(err error) (bool, time.Duration) {
+	var apiErr *tgbotapi.Error
+	if !errors.As(err, &apiErr) {
+		return true, 0
+	}
+
+	switch {
+	case apiErr.Code == http.StatusTooManyRequests:
+		return true, time.Duration(apiErr.RetryAfter) * time.Second
+	case apiErr.Code >= http.StatusInternalServerError:
+		return true, 0
+	default:
+		return false, 0
+	}
+}
+
+// isNotModifiedError reports whether an edit failed only because the text
+// and buttons are already the same.
+func isNotModifiedError(err error) bool {
+	var apiErr *tgbotapi.Error
+	return errors.As(err, &apiErr) && strings.Contains(apiErr.Message, "message is not modified")
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"context"
+	"new-client-notification-bot/internal/domain"
+	"slices"
+)
+
+const ChannelTelegram = "telegram"
+
+// TelegramNotifier delivers notifications to the Telegram chats and topics
+// picked by the router, with the lead action buttons under every message.
+// The contact card and attachments follow as replies to the lead.
+type TelegramNotifier struct {
+	telegram  TelegramBotServiceInterface
+	store     NotificationStoreInterface
+	router    *Router
+	formatter *MessageFormatter
+}
+
+func NewTelegramNotifier(telegram TelegramBotServiceInterface, store NotificationStoreInterface, router *Router, formatter *MessageFormatter) *TelegramNotifier {
+	return &TelegramNotifier{
+		telegram:  telegram,
+		store:     store,
+		router:    router,
+		formatter: formatter,
+	}
+}
+
+func (n *TelegramNotifier) Deliveries(notification *domain.Notification) []domain.Delivery {
+	var deliveries []domain.Delivery
+	for _, target := range n.router.Route(notification) {
+		deliveries = append(deliveries, domain.Delivery{ChatID: target.ChatID, ThreadID: target.ThreadID, Status: domain.StatusQueued})
+	}
+	return deliveries
+}
+
+// Send sends the lead, then the contact card if the route asks for one, then
+// the attachments. A retry only sends what has not gone out yet, down to the
+// chunks of a long lead and the files of the attachments, so nothing is
+// posted twice.
+func (n *TelegramNotifier) Send(ctx context.Context, record *domain.NotificationRecord, delivery *domain.Delivery) error {
+	sent, err := n.telegram.SendMessage(ctx, Message{
+		ChatID:         delivery.ChatID,
+		ThreadID:       delivery.ThreadID,
+		Text:           n.formatter.Format(record),
+		NotificationID: record.ID,
+		SentChunks:     delivery.MessageIDs,
+	})
+	// Keep the chunks that went out even on error, so they can be edited
+	// or deleted and are not sent again.
+	if len(sent.MessageIDs) > len(delivery.MessageIDs) {
+		delivery.MessageIDs = sent.MessageIDs
+	}
+	if err != nil {
+		return telegramSendError(err)
+	}
+
+	reply := Message{ChatID: delivery.ChatID, ThreadID: delivery.ThreadID, ReplyTo: delivery.MessageIDs[0]}
+	target := Target{ChatID: delivery.ChatID, ThreadID: delivery.ThreadID}
+	if delivery.ContactMessageID == 0 && n.router.ContactCard(&record.Notification, target) {
+		// The card is best-effort like the attachments below.
+		sent, err := n.telegram.SendContact(ctx, reply, normalizePhone(record.Notification.Phone), record.Notification.CompanyName)
+		delivery.ContactError = ""
+		if err != nil {
+			delivery.ContactError = err.Error()
+		} else {
+			delivery.ContactMessageID = sent.MessageIDs[0]
+		}
+	}
+
+	if len(delivery.AttachmentMessageIDs) >= len(record.Attachments) {
+		return nil
+	}
+	// Attachments are best-effort: a failed upload is recorded, but the
+	// delivery is not retried over it.
+	reply.SentChunks = delivery.AttachmentMessageIDs
+	sent, err = sendAttachments(ctx, n.telegram, n.store, record.ID, reply)
+	delivery.AttachmentMessageIDs = sent.MessageIDs
+	delivery.AttachmentError = ""
+	if err != nil {
+		delivery.AttachmentError = err.Error()
+	}
+	return nil
+}
+
+func (n *TelegramNotifier) Retract(ctx context.Context, delivery *domain.Delivery) error {
+	return n.telegram.DeleteMessage(ctx, SentMessage{
+		ChatID:     delivery.ChatID,
+		MessageIDs: sentMessageIDs(delivery),
+	})
+}
+
+// sentMessageIDs returns every message a delivery was sent as.
+func sentMessageIDs(delivery *domain.Delivery) []int {
+	messageIDs := slices.Concat(delivery.MessageIDs, delivery.AttachmentMessageIDs)
+	if delivery.ContactMessageID != 0 {
+		messageIDs = append(messageIDs, delivery.ContactMessageID)
+	}
+	return messageIDs
+}
+
+// sendAttachments loads the attachments of a notification and sends them as
+// addressed by msg.
+func sendAttachments(ctx context.Context, telegram TelegramBotServiceInterface, store NotificationStoreInterface, id string, msg Message) (SentMessage, error) {
+	attachments, err := store.Attachments(ctx, id)
+	if err != nil {
+		return SentMessage{}, err
+	}
+	return telegram.SendAttachments(ctx, msg, attachments)
+}
+
+func telegramSendError(err error) error {
+	if retry, _ := classifyTelegramError(err); !retry {
+		return Permanent(err)
+	}
+	return err
+}
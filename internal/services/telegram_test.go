@@ -3,24 +3,191 @@ package services
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"new-client-notification-bot/config"
+	"new-client-notification-bot/internal/domain"
+	"slices"
+	"strings"
 	"testing"
 	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog"
 )
 
 type MockTelegramBotService struct {
 	shouldError  bool
 	errorMsg     string
+	sendErr      error
+	failChatIDs  []int64
+	sentChatIDs  []int64
+	sentTopics   []int
 	sentMessages []string
+	edited       []Message
+	deleted      []SentMessage
+	attached     []Message
+	attachErr    error
+	contactErr   error
+	contacts     []Message
+	// partialIDs are returned with a SendMessage error, as the chunks that
+	// went out before it.
+	partialIDs []int
+}
+
+// SendMessage numbers sent messages from 1 in the order they are sent.
+// Messages are a single chunk, so one with SentChunks is not sent again.
+func (m *MockTelegramBotService) SendMessage(ctx context.Context, msg Message) (SentMessage, error) {
+	if len(msg.SentChunks) > 0 {
+		return SentMessage{ChatID: msg.ChatID, MessageIDs: msg.SentChunks}, nil
+	}
+	m.sentChatIDs = append(m.sentChatIDs, msg.ChatID)
+	m.sentTopics = append(m.sentTopics, msg.ThreadID)
+	m.sentMessages = append(m.sentMessages, msg.Text)
+	if err := m.err(msg.ChatID); err != nil {
+		return SentMessage{ChatID: msg.ChatID, MessageIDs: m.partialIDs}, err
+	}
+	return SentMessage{ChatID: msg.ChatID, MessageIDs: []int{len(m.sentMessages)}}, nil
+}
+
+func (m *MockTelegramBotService) EditMessage(ctx context.Context, sent SentMessage, msg Message) (SentMessage, error) {
+	m.edited = append(m.edited, msg)
+	if err := m.err(sent.ChatID); err != nil {
+		return SentMessage{ChatID: sent.ChatID}, err
+	}
+	return sent, nil
+}
+
+func (m *MockTelegramBotService) DeleteMessage(ctx context.Context, sent SentMessage) error {
+	if err := m.err(sent.ChatID); err != nil {
+		return err
+	}
+	m.deleted = append(m.deleted, sent)
+	return nil
 }
 
-func (m *MockTelegramBotService) SendMessage(ctx context.Context, message string) error {
-	m.sentMessages = append(m.sentMessages, message)
+// SendAttachments numbers the sent files from 100, after the files of
+// SentChunks.
+func (m *MockTelegramBotService) SendAttachments(ctx context.Context, msg Message, attachments []domain.Attachment) (SentMessage, error) {
+	m.attached = append(m.attached, msg)
+	sent := SentMessage{ChatID: msg.ChatID, MessageIDs: slices.Clone(msg.SentChunks)}
+	if m.attachErr != nil {
+		return sent, m.attachErr
+	}
+	for i := len(msg.SentChunks); i < len(attachments); i++ {
+		sent.MessageIDs = append(sent.MessageIDs, 100+i)
+	}
+	return sent, nil
+}
+
+// SendContact numbers the contact card 200.
+func (m *MockTelegramBotService) SendContact(ctx context.Context, msg Message, phone, name string) (SentMessage, error) {
+	m.contacts = append(m.contacts, msg)
+	if m.contactErr != nil {
+		return SentMessage{ChatID: msg.ChatID}, m.contactErr
+	}
+	if err := m.err(msg.ChatID); err != nil {
+		return SentMessage{ChatID: msg.ChatID}, err
+	}
+	return SentMessage{ChatID: msg.ChatID, MessageIDs: []int{200}}, nil
+}
+
+func (m *MockTelegramBotService) err(chatID int64) error {
+	if slices.Contains(m.failChatIDs, chatID) {
+		return errors.New(m.errorMsg)
+	}
+	if m.sendErr != nil {
+		return m.sendErr
+	}
 	if m.shouldError {
 		return errors.New(m.errorMsg)
 	}
 	return nil
 }
 
+// newTestTelegramBotService points a real TelegramBotService at an httptest
+// stand-in for the Bot API. getMe is answered here, every other method is
+// passed to handler.
+func newTestTelegramBotService(t *testing.T, handler http.HandlerFunc) *TelegramBotService {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/getMe") {
+			w.Write([]byte(`{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"test","username":"test_bot"}}`))
+			return
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	bot, err := tgbotapi.NewBotAPIWithClient("token", server.URL+"/bot%s/%s", server.Client())
+	if err != nil {
+		t.Fatalf("failed to create bot: %v", err)
+	}
+
+	logger := zerolog.Nop()
+	return &TelegramBotService{
+		bot:         bot,
+		sendTimeout: time.Second,
+		retry:       RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		logger:      &logger,
+	}
+}
+
+func TestNewTelegramBotService_Proxy(t *testing.T) {
+	// A plain HTTP proxy gets the absolute URL of the Bot API server.
+	var hosts []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.URL.Host+r.URL.Path)
+		w.Write([]byte(`{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"test","username":"test_bot"}}`))
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	logger := zerolog.Nop()
+	service, err := NewTelegramBotService(&config.BotConfig{
+		BotToken:    "token",
+		SendTimeout: time.Second,
+		APIURL:      "http://bot-api.internal:8081",
+		Proxy:       proxyURL,
+	}, &logger)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if service.bot.Self.UserName != "test_bot" {
+		t.Errorf("expected bot test_bot, got %q", service.bot.Self.UserName)
+	}
+	if !slices.Equal(hosts, []string{"bot-api.internal:8081/bottoken/getMe"}) {
+		t.Errorf("expected getMe through the proxy, got %v", hosts)
+	}
+}
+
+func TestTelegramBotService_SendContact(t *testing.T) {
+	recorder := &botAPIRecorder{}
+	service := newTestTelegramBotService(t, recorder.handler)
+
+	sent, err := service.SendContact(context.Background(), Message{ChatID: -100, ThreadID: 5, ReplyTo: 3}, "+79123456789", "Test Company")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(sent.MessageIDs, []int{7}) {
+		t.Errorf("expected message 7, got %+v", sent)
+	}
+
+	call := recorder.call("sendContact")
+	if call == nil {
+		t.Fatalf("expected sendContact call")
+	}
+	expected := map[string]string{"chat_id": "-100", "message_thread_id": "5", "reply_to_message_id": "3", "phone_number": "+79123456789", "first_name": "Test Company"}
+	for key, value := range expected {
+		if call.params.Get(key) != value {
+			t.Errorf("expected %s %q, got %q", key, value, call.params.Get(key))
+		}
+	}
+}
+
 func TestTelegramBotService_SendMessage(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -59,7 +226,7 @@ func TestTelegramBotService_SendMessage(t *testing.T) {
 			}
 
 			ctx := context.Background()
-			err := mock.SendMessage(ctx, tt.message)
+			_, err := mock.SendMessage(ctx, Message{ChatID: 42, Text: tt.message})
 
 			if tt.shouldError {
 				if err == nil {
@@ -91,13 +258,146 @@ func TestTelegramBotService_ContextCancellation(t *testing.T) {
 
 	time.Sleep(2 * time.Millisecond)
 
-	err := mock.SendMessage(ctx, "test message")
+	_, err := mock.SendMessage(ctx, Message{ChatID: 42, Text: "test message"})
 
 	if err != nil {
 		t.Logf("Context cancellation handled: %v", err)
 	}
 }
 
+func TestTelegramBotService_SendMessageRespectsContext(t *testing.T) {
+	release := make(chan struct{})
+	service := newTestTelegramBotService(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	t.Cleanup(func() { close(release) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := service.SendMessage(ctx, Message{ChatID: 42, Text: "test message"})
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected send to be aborted by the caller deadline, took %v", elapsed)
+	}
+}
+
+func TestTelegramBotService_SendMessageRetriesTransientErrors(t *testing.T) {
+	calls := 0
+	service := newTestTelegramBotService(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Write([]byte(`{"ok":false,"error_code":429,"description":"Too Many Requests","parameters":{"retry_after":0}}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"result":{"message_id":7,"chat":{"id":42}}}`))
+	})
+
+	if _, err := service.SendMessage(context.Background(), Message{ChatID: 42, Text: "test message"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 calls, got %d", calls)
+	}
+}
+
+func TestTelegramBotService_SendMessageResumesChunks(t *testing.T) {
+	var texts []string
+	failed := false
+	service := newTestTelegramBotService(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if len(texts) == 1 && !failed {
+			failed = true
+			w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: message text is empty"}`))
+			return
+		}
+		texts = append(texts, r.PostForm.Get("text"))
+		fmt.Fprintf(w, `{"ok":true,"result":{"message_id":%d,"chat":{"id":42}}}`, len(texts))
+	})
+	msg := Message{ChatID: 42, Text: strings.Repeat("строка заявки\n", 700)}
+
+	sent, err := service.SendMessage(context.Background(), msg)
+	if err == nil || !slices.Equal(sent.MessageIDs, []int{1}) {
+		t.Fatalf("expected the first chunk returned with the error, got %v, %v", sent.MessageIDs, err)
+	}
+
+	msg.SentChunks = sent.MessageIDs
+	sent, err = service.SendMessage(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(sent.MessageIDs, []int{1, 2, 3}) {
+		t.Errorf("expected messages 1, 2 and 3, got %v", sent.MessageIDs)
+	}
+	for i, text := range texts {
+		if marker := fmt.Sprintf("(%d/3)", i+1); !strings.HasSuffix(text, marker) {
+			t.Errorf("expected message %d to end with %s, got %q", i+1, marker, text[max(len(text)-10, 0):])
+		}
+	}
+}
+
+func TestClassifyTelegramError(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		expectedRetry bool
+		expectedAfter time.Duration
+	}{
+		{
+			name:          "rate limited",
+			err:           &tgbotapi.Error{Code: http.StatusTooManyRequests, ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 7}},
+			expectedRetry: true,
+			expectedAfter: 7 * time.Second,
+		},
+		{
+			name:          "server error",
+			err:           &tgbotapi.Error{Code: http.StatusBadGateway},
+			expectedRetry: true,
+		},
+		{
+			name:          "chat not found",
+			err:           &tgbotapi.Error{Code: http.StatusBadRequest, Message: "Bad Request: chat not found"},
+			expectedRetry: false,
+		},
+		{
+			name:          "bot kicked",
+			err:           &tgbotapi.Error{Code: http.StatusForbidden, Message: "Forbidden: bot was kicked from the group chat"},
+			expectedRetry: false,
+		},
+		{
+			name:          "wrapped server error",
+			err:           fmt.Errorf("send: %w", &tgbotapi.Error{Code: http.StatusInternalServerError}),
+			expectedRetry: true,
+		},
+		{
+			name:          "transport error",
+			err:           errors.New("dial tcp: i/o timeout"),
+			expectedRetry: true,
+		},
+		{
+			name:          "attempt timed out",
+			err:           fmt.Errorf("Post: %w", context.DeadlineExceeded),
+			expectedRetry: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retry, after := classifyTelegramError(tt.err)
+			if retry != tt.expectedRetry {
+				t.Errorf("expected retry %v, got %v", tt.expectedRetry, retry)
+			}
+			if after != tt.expectedAfter {
+				t.Errorf("expected retry after %v, got %v", tt.expectedAfter, after)
+			}
+		})
+	}
+}
+
 func BenchmarkTelegramBotService_SendMessage(b *testing.B) {
 	mock := &MockTelegramBotService{}
 	ctx := context.Background()
@@ -105,6 +405,6 @@ func BenchmarkTelegramBotService_SendMessage(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_ = mock.SendMessage(ctx, message)
+		_, _ = mock.SendMessage(ctx, Message{ChatID: 42, Text: message})
 	}
 }
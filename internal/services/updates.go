@@ -0,0 +1,151 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"new-client-notification-bot/internal/domain"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog"
+)
+
+// UpdatesConsumer long-polls the Bot API for updates, handles presses on
+// lead action buttons and passes messages to the bot commands.
+type UpdatesConsumer struct {
+	telegram *TelegramBotService
+	store    NotificationStoreInterface
+	commands *Commands
+	logger   *zerolog.Logger
+}
+
+func NewUpdatesConsumer(telegram *TelegramBotService, store NotificationStoreInterface, commands *Commands, logger *zerolog.Logger) *UpdatesConsumer {
+	return &UpdatesConsumer{
+		telegram: telegram,
+		store:    store,
+		commands: commands,
+		logger:   logger,
+	}
+}
+
+// pollRetryDelay is the pause after a failed getUpdates call.
+const pollRetryDelay = 3 * time.Second
+
+// topicFields holds the forum topic fields of an update, which tgbotapi v5.5
+// does not decode.
+type topicFields struct {
+	Message *struct {
+		MessageThreadID int  `json:"message_thread_id"`
+		IsTopicMessage  bool `json:"is_topic_message"`
+	} `json:"message"`
+}
+
+// Run handles updates until ctx is cancelled.
+func (u *UpdatesConsumer) Run(ctx context.Context) {
+	if err := u.commands.Register(ctx); err != nil {
+		u.logger.Error().Err(err).Msg("failed to register bot commands")
+	}
+
+	cfg := tgbotapi.UpdateConfig{
+		Timeout:        30,
+		AllowedUpdates: []string{"message", "callback_query"},
+	}
+	for ctx.Err() == nil {
+		updates, threadIDs, err := u.poll(ctx, cfg)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			u.logger.Warn().Err(err).Msg("failed to get updates")
+			select {
+			case <-ctx.Done():
+			case <-time.After(pollRetryDelay):
+			}
+			continue
+		}
+
+		for i, update := range updates {
+			cfg.Offset = update.UpdateID + 1
+			u.handleUpdate(ctx, update, threadIDs[i])
+		}
+	}
+}
+
+// poll long-polls getUpdates once. tgbotapi's own loop drops the forum
+// topic of messages, so the response is decoded here and the topic of every
+// update is returned next to it.
+func (u *UpdatesConsumer) poll(ctx context.Context, cfg tgbotapi.UpdateConfig) ([]tgbotapi.Update, []int, error) {
+	resp, err := u.telegram.botWithContext(ctx).Request(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var updates []tgbotapi.Update
+	if err := json.Unmarshal(resp.Result, &updates); err != nil {
+		return nil, nil, err
+	}
+	var topics []topicFields
+	if err := json.Unmarshal(resp.Result, &topics); err != nil {
+		return nil, nil, err
+	}
+
+	threadIDs := make([]int, len(updates))
+	for i, topic := range topics {
+		// Replies in plain groups carry a thread ID too; only forum topics
+		// are targets.
+		if topic.Message != nil && topic.Message.IsTopicMessage {
+			threadIDs[i] = topic.Message.MessageThreadID
+		}
+	}
+	return updates, threadIDs, nil
+}
+
+func (u *UpdatesConsumer) handleUpdate(ctx context.Context, update tgbotapi.Update, threadID int) {
+	switch {
+	case update.CallbackQuery != nil:
+		u.handleCallback(ctx, update.CallbackQuery)
+	case update.Message != nil:
+		u.commands.Handle(ctx, chatMessage{Message: update.Message, ThreadID: threadID})
+	}
+}
+
+func (u *UpdatesConsumer) handleCallback(ctx context.Context, query *tgbotapi.CallbackQuery) {
+	action, id, ok := parseLeadCallback(query.Data)
+	if !ok || query.Message == nil {
+		u.answer(ctx, query, "Неизвестное действие")
+		return
+	}
+
+	_, err := u.store.Modify(ctx, id, func(record *domain.NotificationRecord) error {
+		record.Actions = append(record.Actions, domain.LeadAction{
+			Action:   action,
+			UserID:   query.From.ID,
+			Username: displayName(query.From),
+			ChatID:   query.Message.Chat.ID,
+			At:       time.Now(),
+		})
+		return nil
+	})
+	if err != nil {
+		u.logger.Error().Err(err).Str("id", id).Msg("failed to record lead action")
+		u.answer(ctx, query, "Не удалось сохранить действие")
+		return
+	}
+
+	status := statusLine(action, displayName(query.From))
+	u.logger.Info().Str("id", id).Str("action", action).Int64("user_id", query.From.ID).Msg("lead action recorded")
+	u.answer(ctx, query, status)
+
+	text, entities := withStatus(query.Message.Text, query.Message.Entities, status)
+	edit := tgbotapi.NewEditMessageTextAndMarkup(query.Message.Chat.ID, query.Message.MessageID, text, leadKeyboard(id))
+	edit.Entities = entities
+	if err := u.telegram.send(ctx, edit); err != nil {
+		u.logger.Error().Err(err).Str("id", id).Msg("failed to update lead message")
+	}
+}
+
+func (u *UpdatesConsumer) answer(ctx context.Context, query *tgbotapi.CallbackQuery, text string) {
+	if err := u.telegram.send(ctx, tgbotapi.NewCallback(query.ID, text)); err != nil {
+		u.logger.Error().Err(err).Msg("failed to answer callback query")
+	}
+}
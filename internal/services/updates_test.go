@@ -0,0 +1,234 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"new-client-notification-bot/internal/domain"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog"
+)
+
+// botAPIRecorder keeps the Bot API calls received by the test stand-in.
+type botAPIRecorder struct {
+	mu    sync.Mutex
+	calls []botAPICall
+}
+
+type botAPICall struct {
+	method string
+	params url.Values
+	// files maps the uploaded form fields to their file names.
+	files map[string]string
+}
+
+func (r *botAPIRecorder) record(req *http.Request) string {
+	call := botAPICall{method: req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]}
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+		req.ParseMultipartForm(1 << 20)
+		call.files = map[string]string{}
+		for field, headers := range req.MultipartForm.File {
+			call.files[field] = headers[0].Filename
+		}
+	} else {
+		req.ParseForm()
+	}
+	call.params = req.PostForm
+
+	r.mu.Lock()
+	r.calls = append(r.calls, call)
+	r.mu.Unlock()
+	return call.method
+}
+
+func (r *botAPIRecorder) handler(w http.ResponseWriter, req *http.Request) {
+	method := r.record(req)
+
+	if method == "answerCallbackQuery" {
+		w.Write([]byte(`{"ok":true,"result":true}`))
+		return
+	}
+	w.Write([]byte(`{"ok":true,"result":{"message_id":7,"chat":{"id":42}}}`))
+}
+
+func (r *botAPIRecorder) call(method string) *botAPICall {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.calls {
+		if r.calls[i].method == method {
+			return &r.calls[i]
+		}
+	}
+	return nil
+}
+
+func TestTelegramBotService_SendMessageAddsLeadKeyboard(t *testing.T) {
+	recorder := &botAPIRecorder{}
+	service := newTestTelegramBotService(t, recorder.handler)
+
+	sent, err := service.SendMessage(context.Background(), Message{ChatID: 42, Text: "lead", NotificationID: "0001"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sent.ChatID != 42 || !slices.Equal(sent.MessageIDs, []int{7}) {
+		t.Errorf("expected message 7 in chat 42, got %+v", sent)
+	}
+
+	call := recorder.call("sendMessage")
+	if call == nil {
+		t.Fatalf("expected sendMessage call")
+	}
+	if markup := call.params.Get("reply_markup"); !strings.Contains(markup, "lead:take:0001") {
+		t.Errorf("expected lead keyboard, got %q", markup)
+	}
+}
+
+func TestTelegramBotService_SendMessageToTopic(t *testing.T) {
+	recorder := &botAPIRecorder{}
+	service := newTestTelegramBotService(t, recorder.handler)
+	service.parseMode = ParseModeHTML
+
+	sent, err := service.SendMessage(context.Background(), Message{ChatID: -100, ThreadID: 5, Text: "lead", NotificationID: "0001"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(sent.MessageIDs, []int{7}) {
+		t.Errorf("expected message 7, got %+v", sent)
+	}
+
+	call := recorder.call("sendMessage")
+	if call == nil {
+		t.Fatalf("expected sendMessage call")
+	}
+	expected := map[string]string{"chat_id": "-100", "message_thread_id": "5", "text": "lead", "parse_mode": ParseModeHTML}
+	for key, value := range expected {
+		if call.params.Get(key) != value {
+			t.Errorf("expected %s %q, got %q", key, value, call.params.Get(key))
+		}
+	}
+	if markup := call.params.Get("reply_markup"); !strings.Contains(markup, "lead:take:0001") {
+		t.Errorf("expected lead keyboard, got %q", markup)
+	}
+}
+
+func TestUpdatesConsumer_PollKeepsTopics(t *testing.T) {
+	service := newTestTelegramBotService(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true,"result":[
+			{"update_id":1,"message":{"message_id":3,"chat":{"id":-100},"text":"/chatid","message_thread_id":5,"is_topic_message":true}},
+			{"update_id":2,"message":{"message_id":4,"chat":{"id":-200},"text":"/chatid","message_thread_id":3}},
+			{"update_id":3,"callback_query":{"id":"cb1","data":"lead:take:0001"}}
+		]}`))
+	})
+	logger := zerolog.Nop()
+	consumer := NewUpdatesConsumer(service, &MockNotificationStore{}, nil, &logger)
+
+	updates, threadIDs, err := consumer.poll(context.Background(), tgbotapi.UpdateConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(updates) != 3 || updates[0].Message.Chat.ID != -100 || updates[2].CallbackQuery == nil {
+		t.Fatalf("expected three updates, got %+v", updates)
+	}
+	// A reply in a plain group has a thread ID but no topic.
+	if !slices.Equal(threadIDs, []int{5, 0, 0}) {
+		t.Errorf("expected topics [5 0 0], got %v", threadIDs)
+	}
+}
+
+func TestTelegramBotService_EditMessage(t *testing.T) {
+	recorder := &botAPIRecorder{}
+	service := newTestTelegramBotService(t, recorder.handler)
+
+	// The old text took two chunks, the new one fits into the first.
+	sent := SentMessage{ChatID: 42, MessageIDs: []int{7, 8}}
+	edited, err := service.EditMessage(context.Background(), sent, Message{ChatID: 42, Text: "corrected lead", NotificationID: "0001"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(edited.MessageIDs, []int{7}) {
+		t.Errorf("expected message 7 to remain, got %+v", edited)
+	}
+
+	edit := recorder.call("editMessageText")
+	if edit == nil || edit.params.Get("message_id") != "7" || edit.params.Get("text") != "corrected lead" {
+		t.Fatalf("expected message 7 to be edited, got %+v", edit)
+	}
+	if !strings.Contains(edit.params.Get("reply_markup"), "lead:take:0001") {
+		t.Errorf("expected lead keyboard on the edited message")
+	}
+
+	del := recorder.call("deleteMessage")
+	if del == nil || del.params.Get("message_id") != "8" {
+		t.Errorf("expected surplus message 8 to be deleted, got %+v", del)
+	}
+}
+
+func TestUpdatesConsumer_HandleCallback(t *testing.T) {
+	recorder := &botAPIRecorder{}
+	service := newTestTelegramBotService(t, recorder.handler)
+	store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{
+		"0001": {ID: "0001", Notification: testNotification, Status: domain.StatusDelivered},
+	}}
+	logger := zerolog.Nop()
+	consumer := NewUpdatesConsumer(service, store, nil, &logger)
+
+	consumer.handleUpdate(context.Background(), tgbotapi.Update{
+		CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:   "cb1",
+			From: &tgbotapi.User{ID: 100, UserName: "ivan"},
+			Data: "lead:take:0001",
+			Message: &tgbotapi.Message{
+				MessageID: 7,
+				Chat:      &tgbotapi.Chat{ID: 42},
+				Text:      "Клиент: Test Company",
+			},
+		},
+	}, 0)
+
+	actions := store.records["0001"].Actions
+	if len(actions) != 1 || actions[0].Action != domain.ActionTake || actions[0].Username != "@ivan" || actions[0].ChatID != 42 {
+		t.Errorf("expected take action by @ivan, got %+v", actions)
+	}
+
+	answer := recorder.call("answerCallbackQuery")
+	if answer == nil || answer.params.Get("callback_query_id") != "cb1" {
+		t.Errorf("expected callback query to be answered, got %+v", answer)
+	}
+
+	edit := recorder.call("editMessageText")
+	if edit == nil {
+		t.Fatalf("expected message to be edited")
+	}
+	if text := edit.params.Get("text"); text != "Клиент: Test Company\n\n✅ Взял в работу: @ivan" {
+		t.Errorf("unexpected edited text %q", text)
+	}
+}
+
+func TestUpdatesConsumer_HandleCallbackUnknownLead(t *testing.T) {
+	recorder := &botAPIRecorder{}
+	service := newTestTelegramBotService(t, recorder.handler)
+	store := &MockNotificationStore{records: map[string]*domain.NotificationRecord{}}
+	logger := zerolog.Nop()
+	consumer := NewUpdatesConsumer(service, store, nil, &logger)
+
+	consumer.handleUpdate(context.Background(), tgbotapi.Update{
+		CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:      "cb1",
+			From:    &tgbotapi.User{ID: 100},
+			Data:    "lead:spam:missing",
+			Message: &tgbotapi.Message{MessageID: 7, Chat: &tgbotapi.Chat{ID: 42}},
+		},
+	}, 0)
+
+	if recorder.call("answerCallbackQuery") == nil {
+		t.Errorf("expected callback query to be answered")
+	}
+	if recorder.call("editMessageText") != nil {
+		t.Errorf("expected message to stay unchanged")
+	}
+}
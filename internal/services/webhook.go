@@ -0,0 +1,155 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"new-client-notification-bot/config"
+	"new-client-notification-bot/internal/domain"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const ChannelWebhook = "webhook"
+
+const (
+	webhookIDHeader        = "X-Webhook-Id"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// webhookPayload is the JSON body posted for every lead.
+type webhookPayload struct {
+	ID           string              `json:"id"`
+	Notification domain.Notification `json:"notification"`
+	RequestID    string              `json:"request_id,omitempty"`
+	CreatedAt    time.Time           `json:"created_at"`
+}
+
+// WebhookService forwards notifications as signed JSON posts to our own
+// systems, one delivery per URL.
+type WebhookService struct {
+	cfg    *config.WebhookConfig
+	client *http.Client
+	retry  RetryPolicy
+	// names are the redacted URLs kept in deliveries, in config order, and
+	// urls maps them back to the real ones.
+	names  []string
+	urls   map[string]string
+	logger *zerolog.Logger
+}
+
+func NewWebhookService(cfg *config.WebhookConfig, logger *zerolog.Logger) *WebhookService {
+	var names []string
+	urls := map[string]string{}
+	for i, raw := range cfg.URLs {
+		name := redactURL(raw)
+		// URLs that differ only in the redacted parts still need a name each.
+		if _, ok := urls[name]; ok {
+			name += "#" + strconv.Itoa(i+1)
+		}
+		names = append(names, name)
+		urls[name] = raw
+	}
+
+	return &WebhookService{
+		cfg:    cfg,
+		client: &http.Client{},
+		retry: RetryPolicy{
+			MaxAttempts: cfg.RetryMaxAttempts,
+			BaseDelay:   cfg.RetryBaseDelay,
+			MaxDelay:    cfg.RetryMaxDelay,
+		},
+		names:  names,
+		urls:   urls,
+		logger: logger,
+	}
+}
+
+func (w *WebhookService) Deliveries(notification *domain.Notification) []domain.Delivery {
+	var deliveries []domain.Delivery
+	for _, name := range w.names {
+		deliveries = append(deliveries, domain.Delivery{Recipient: name, Status: domain.StatusQueued})
+	}
+	return deliveries
+}
+
+func (w *WebhookService) Send(ctx context.Context, record *domain.NotificationRecord, delivery *domain.Delivery) error {
+	target, ok := w.urls[delivery.Recipient]
+	if !ok {
+		return Permanent(errors.New("webhook is no longer configured"))
+	}
+
+	body, err := json.Marshal(webhookPayload{
+		ID:           record.ID,
+		Notification: record.Notification,
+		RequestID:    record.RequestID,
+		CreatedAt:    record.CreatedAt,
+	})
+	if err != nil {
+		return Permanent(err)
+	}
+
+	attempt := 0
+	err = w.retry.Do(ctx, classifyHTTPError, func() error {
+		attempt++
+		attemptCtx, cancel := context.WithTimeout(ctx, w.cfg.Timeout)
+		defer cancel()
+
+		// Every attempt is signed anew, so its timestamp stays fresh.
+		status, err := postJSON(attemptCtx, w.client, target, body, w.sign(record.ID, body, time.Now()))
+		delivery.ResponseStatus = status
+		if err != nil {
+			w.logger.Warn().Err(err).Int("attempt", attempt).Str("url", delivery.Recipient).Msg("webhook attempt failed")
+		}
+		return err
+	})
+	if err != nil {
+		w.logger.Error().Err(err).Str("id", record.ID).Str("url", delivery.Recipient).Msg("failed to post webhook")
+		if retry, _ := classifyHTTPError(err); !retry {
+			return Permanent(err)
+		}
+		return err
+	}
+
+	w.logger.Info().Str("id", record.ID).Str("url", delivery.Recipient).Int("status", delivery.ResponseStatus).Msg("webhook posted")
+	return nil
+}
+
+// sign returns the headers that let the receiver verify a post: the
+// signature is the hex HMAC-SHA256 of "<timestamp>.<body>" keyed with the
+// shared secret, sent as "sha256=<hex>".
+func (w *WebhookService) sign(id string, body []byte, now time.Time) http.Header {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(w.cfg.Secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	header := http.Header{}
+	header.Set(webhookIDHeader, id)
+	header.Set(webhookTimestampHeader, timestamp)
+	header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	return header
+}
+
+// redactURL drops credentials and the query string, which may hold tokens,
+// so the URL can be stored and logged.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
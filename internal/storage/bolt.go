@@ -0,0 +1,333 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"new-client-notification-bot/internal/domain"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	notificationsBucket = []byte("notifications")
+	pendingBucket       = []byte("pending")
+	// attachmentsBucket keeps file data under "<id>/<index>", so loading a
+	// record never reads its files.
+	attachmentsBucket = []byte("attachments")
+	idempotencyBucket = []byte("idempotency")
+	// idempotencyExpiryBucket indexes the idempotency keys by expiry under
+	// "<expiry><key>", so expired keys are found without a full scan.
+	idempotencyExpiryBucket = []byte("idempotency_expiry")
+	// settingsBucket keeps the state set from the chat, such as the mute.
+	settingsBucket = []byte("settings")
+)
+
+var muteUntilKey = []byte("mute_until")
+
+var ErrNotFound = errors.New("notification not found")
+
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{notificationsBucket, pendingBucket, attachmentsBucket, idempotencyBucket, idempotencyExpiryBucket, settingsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// Save stores the record together with the data of its attachments.
+func (s *BoltStore) Save(ctx context.Context, record *domain.NotificationRecord) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		attachments := tx.Bucket(attachmentsBucket)
+		for i, attachment := range record.Attachments {
+			if attachment.Data == nil {
+				continue
+			}
+			if err := attachments.Put(attachmentKey(record.ID, i), attachment.Data); err != nil {
+				return err
+			}
+		}
+		return putRecord(tx, record)
+	})
+}
+
+func (s *BoltStore) Modify(ctx context.Context, id string, fn func(record *domain.NotificationRecord) error) (*domain.NotificationRecord, error) {
+	var record domain.NotificationRecord
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		data := tx.Bucket(notificationsBucket).Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		if err := fn(&record); err != nil {
+			return err
+		}
+		return putRecord(tx, &record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (s *BoltStore) Get(ctx context.Context, id string) (*domain.NotificationRecord, error) {
+	var record domain.NotificationRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(notificationsBucket).Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, &record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (s *BoltStore) Attachments(ctx context.Context, id string) ([]domain.Attachment, error) {
+	var attachments []domain.Attachment
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(notificationsBucket).Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+		var record domain.NotificationRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+
+		bucket := tx.Bucket(attachmentsBucket)
+		for i, attachment := range record.Attachments {
+			data := bucket.Get(attachmentKey(id, i))
+			if data == nil {
+				return fmt.Errorf("attachment %d of %s is missing", i, id)
+			}
+			// Bolt data is only valid inside the transaction.
+			attachment.Data = append([]byte(nil), data...)
+			attachments = append(attachments, attachment)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attachments, nil
+}
+
+// Pending returns up to limit queued records that are due at now, oldest
+// first. Record IDs are time-ordered, so the key order of the pending bucket
+// is the arrival order.
+func (s *BoltStore) Pending(ctx context.Context, now time.Time, limit int) ([]*domain.NotificationRecord, error) {
+	var records []*domain.NotificationRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		notifications := tx.Bucket(notificationsBucket)
+		cursor := tx.Bucket(pendingBucket).Cursor()
+		for k, _ := cursor.First(); k != nil && len(records) < limit; k, _ = cursor.Next() {
+			data := notifications.Get(k)
+			if data == nil {
+				continue
+			}
+			var record domain.NotificationRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			if record.NextAttempt.After(now) {
+				continue
+			}
+			records = append(records, &record)
+		}
+		return nil
+	})
+	return records, err
+}
+
+// Recent returns up to limit records that match, newest first.
+func (s *BoltStore) Recent(ctx context.Context, limit int, match func(record *domain.NotificationRecord) bool) ([]*domain.NotificationRecord, error) {
+	var records []*domain.NotificationRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(notificationsBucket).Cursor()
+		for k, data := cursor.Last(); k != nil && len(records) < limit; k, data = cursor.Prev() {
+			var record domain.NotificationRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			if match(&record) {
+				records = append(records, &record)
+			}
+		}
+		return nil
+	})
+	return records, err
+}
+
+// CountSince counts the records created at or after since that match.
+func (s *BoltStore) CountSince(ctx context.Context, since time.Time, match func(record *domain.NotificationRecord) bool) (int, error) {
+	count := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(notificationsBucket).Cursor()
+		for k, data := cursor.Last(); k != nil; k, data = cursor.Prev() {
+			var record domain.NotificationRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			if record.CreatedAt.Before(since) {
+				break
+			}
+			if match(&record) {
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Reserve stores request unless its key is taken. Keys expired at now are
+// dropped first.
+func (s *BoltStore) Reserve(ctx context.Context, request domain.IdempotentRequest, now time.Time) (*domain.IdempotentRequest, error) {
+	var existing *domain.IdempotentRequest
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := pruneIdempotency(tx, now); err != nil {
+			return err
+		}
+		if data := tx.Bucket(idempotencyBucket).Get([]byte(request.Key)); data != nil {
+			existing = &domain.IdempotentRequest{}
+			return json.Unmarshal(data, existing)
+		}
+		return putIdempotent(tx, &request)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+func (s *BoltStore) Complete(ctx context.Context, request domain.IdempotentRequest) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putIdempotent(tx, &request)
+	})
+}
+
+func (s *BoltStore) Release(ctx context.Context, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(idempotencyBucket).Delete([]byte(key))
+	})
+}
+
+func (s *BoltStore) MuteUntil(ctx context.Context) (time.Time, error) {
+	var until time.Time
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(settingsBucket).Get(muteUntilKey); data != nil {
+			return until.UnmarshalText(data)
+		}
+		return nil
+	})
+	return until, err
+}
+
+func (s *BoltStore) SetMuteUntil(ctx context.Context, until time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if until.IsZero() {
+			return tx.Bucket(settingsBucket).Delete(muteUntilKey)
+		}
+		data, err := until.MarshalText()
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(settingsBucket).Put(muteUntilKey, data)
+	})
+}
+
+// pruneIdempotency deletes the keys expired at now. An index entry left by
+// an earlier expiry of a key does not delete the key.
+func pruneIdempotency(tx *bolt.Tx, now time.Time) error {
+	requests := tx.Bucket(idempotencyBucket)
+	cursor := tx.Bucket(idempotencyExpiryBucket).Cursor()
+	for k, _ := cursor.First(); k != nil; k, _ = cursor.First() {
+		expiresAt := int64(binary.BigEndian.Uint64(k[:8]))
+		if expiresAt > now.UnixNano() {
+			return nil
+		}
+
+		key := k[8:]
+		var request domain.IdempotentRequest
+		if data := requests.Get(key); data != nil {
+			if err := json.Unmarshal(data, &request); err != nil {
+				return err
+			}
+			if request.ExpiresAt.UnixNano() == expiresAt {
+				if err := requests.Delete(key); err != nil {
+					return err
+				}
+			}
+		}
+		if err := cursor.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func putIdempotent(tx *bolt.Tx, request *domain.IdempotentRequest) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(idempotencyBucket).Put([]byte(request.Key), data); err != nil {
+		return err
+	}
+
+	expiry := binary.BigEndian.AppendUint64(nil, uint64(request.ExpiresAt.UnixNano()))
+	return tx.Bucket(idempotencyExpiryBucket).Put(append(expiry, request.Key...), []byte{})
+}
+
+func attachmentKey(id string, index int) []byte {
+	return []byte(id + "/" + strconv.Itoa(index))
+}
+
+func putRecord(tx *bolt.Tx, record *domain.NotificationRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	key := []byte(record.ID)
+	if err := tx.Bucket(notificationsBucket).Put(key, data); err != nil {
+		return err
+	}
+
+	pending := tx.Bucket(pendingBucket)
+	if record.Status == domain.StatusQueued {
+		return pending.Put(key, []byte{})
+	}
+	return pending.Delete(key)
+}
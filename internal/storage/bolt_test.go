@@ -0,0 +1,300 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"new-client-notification-bot/internal/domain"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *BoltStore {
+	t.Helper()
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestBoltStore_SaveAndGet(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	record := &domain.NotificationRecord{
+		ID: "0001",
+		Notification: domain.Notification{
+			Phone:            "+7 912 345 67 89",
+			CompanyName:      "Test Company",
+			NotificationText: "Test message",
+		},
+		Status: domain.StatusQueued,
+	}
+
+	if err := store.Save(ctx, record); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, err := store.Get(ctx, "0001")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got.Notification, record.Notification) {
+		t.Errorf("expected notification %+v, got %+v", record.Notification, got.Notification)
+	}
+
+	if _, err := store.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestBoltStore_Pending(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	records := []*domain.NotificationRecord{
+		{ID: "0001", Status: domain.StatusQueued},
+		{ID: "0002", Status: domain.StatusDelivered},
+		{ID: "0003", Status: domain.StatusQueued, NextAttempt: now.Add(time.Minute)},
+		{ID: "0004", Status: domain.StatusQueued},
+	}
+	for _, record := range records {
+		if err := store.Save(ctx, record); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	pending, err := store.Pending(ctx, now, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pending) != 2 || pending[0].ID != "0001" || pending[1].ID != "0004" {
+		t.Fatalf("expected pending [0001 0004], got %+v", pending)
+	}
+
+	_, err = store.Modify(ctx, "0001", func(record *domain.NotificationRecord) error {
+		record.Status = domain.StatusDelivered
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	pending, err = store.Pending(ctx, now, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pending) != 1 || pending[0].ID != "0004" {
+		t.Errorf("expected pending [0004], got %+v", pending)
+	}
+}
+
+func TestBoltStore_Modify(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	if err := store.Save(ctx, &domain.NotificationRecord{ID: "0001", Status: domain.StatusDelivered}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	record, err := store.Modify(ctx, "0001", func(record *domain.NotificationRecord) error {
+		record.Actions = append(record.Actions, domain.LeadAction{Action: domain.ActionTake, Username: "@ivan"})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(record.Actions) != 1 {
+		t.Errorf("expected modified record to be returned, got %+v", record)
+	}
+
+	stored, err := store.Get(ctx, "0001")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(stored.Actions) != 1 || stored.Actions[0].Username != "@ivan" {
+		t.Errorf("expected action to be stored, got %+v", stored.Actions)
+	}
+
+	errAbort := errors.New("abort")
+	_, err = store.Modify(ctx, "0001", func(record *domain.NotificationRecord) error {
+		record.Status = domain.StatusFailed
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Errorf("expected abort error, got %v", err)
+	}
+	if stored, _ := store.Get(ctx, "0001"); stored.Status != domain.StatusDelivered {
+		t.Errorf("expected aborted modification to be rolled back, got status %q", stored.Status)
+	}
+
+	_, err = store.Modify(ctx, "missing", func(record *domain.NotificationRecord) error { return nil })
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestBoltStore_RecentAndCountSince(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	for i, age := range []time.Duration{72 * time.Hour, 3 * time.Hour, 2 * time.Hour, time.Hour} {
+		record := &domain.NotificationRecord{
+			ID:        fmt.Sprintf("000%d", i+1),
+			Status:    domain.StatusDelivered,
+			CreatedAt: now.Add(-age),
+		}
+		if i == 2 {
+			record.Status = domain.StatusFailed
+		}
+		if err := store.Save(ctx, record); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	delivered := func(record *domain.NotificationRecord) bool { return record.Status == domain.StatusDelivered }
+
+	recent, err := store.Recent(ctx, 2, delivered)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(recent) != 2 || recent[0].ID != "0004" || recent[1].ID != "0002" {
+		t.Errorf("expected [0004 0002], got %+v", recent)
+	}
+
+	count, err := store.CountSince(ctx, now.Add(-24*time.Hour), delivered)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 records in the last day, got %d", count)
+	}
+}
+
+func TestBoltStore_Attachments(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	record := &domain.NotificationRecord{
+		ID:     "0001",
+		Status: domain.StatusQueued,
+		Attachments: []domain.Attachment{
+			{Name: "brief.pdf", ContentType: "application/pdf", Size: 4, Data: []byte("%PDF")},
+			{Name: "screen.png", ContentType: "image/png", Size: 3, Data: []byte("png")},
+		},
+	}
+	if err := store.Save(ctx, record); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, err := store.Get(ctx, "0001")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got.Attachments) != 2 || got.Attachments[0].Name != "brief.pdf" || got.Attachments[0].Data != nil {
+		t.Errorf("expected attachment metadata without data, got %+v", got.Attachments)
+	}
+
+	// Rewriting the record keeps the files.
+	if _, err := store.Modify(ctx, "0001", func(record *domain.NotificationRecord) error {
+		record.Status = domain.StatusDelivered
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	attachments, err := store.Attachments(ctx, "0001")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(attachments) != 2 || string(attachments[0].Data) != "%PDF" || string(attachments[1].Data) != "png" || attachments[1].ContentType != "image/png" {
+		t.Errorf("expected both attachments with data, got %+v", attachments)
+	}
+
+	if _, err := store.Attachments(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestBoltStore_Mute(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	ctx := context.Background()
+
+	if until, err := store.MuteUntil(ctx); err != nil || !until.IsZero() {
+		t.Fatalf("expected no mute, got %v, %v", until, err)
+	}
+	until := time.Now().Add(time.Hour).Round(0)
+	if err := store.SetMuteUntil(ctx, until); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	store.Close()
+
+	store, err = NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	if got, err := store.MuteUntil(ctx); err != nil || !got.Equal(until) {
+		t.Errorf("expected mute until %v after reopening, got %v, %v", until, got, err)
+	}
+
+	if err := store.SetMuteUntil(ctx, time.Time{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, err := store.MuteUntil(ctx); err != nil || !got.IsZero() {
+		t.Errorf("expected the mute to be cleared, got %v, %v", got, err)
+	}
+}
+
+func TestBoltStore_Idempotency(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	request := domain.IdempotentRequest{Key: "key-1", Hash: "hash-1", ExpiresAt: now.Add(time.Second)}
+	existing, err := store.Reserve(ctx, request, now)
+	if err != nil || existing != nil {
+		t.Fatalf("expected the key to be reserved, got %+v, %v", existing, err)
+	}
+
+	existing, err = store.Reserve(ctx, domain.IdempotentRequest{Key: "key-1", Hash: "hash-2", ExpiresAt: now.Add(time.Second)}, now)
+	if err != nil || existing == nil || existing.Hash != "hash-1" || existing.Status != 0 {
+		t.Fatalf("expected the request in progress, got %+v, %v", existing, err)
+	}
+
+	request.Status = 202
+	request.Body = []byte(`{"success":true}`)
+	request.ExpiresAt = now.Add(time.Hour)
+	if err := store.Complete(ctx, request); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The index entry of the reservation has expired, the response has not.
+	existing, err = store.Reserve(ctx, domain.IdempotentRequest{Key: "key-1", Hash: "hash-1", ExpiresAt: now.Add(time.Hour)}, now.Add(time.Minute))
+	if err != nil || existing == nil || existing.Status != 202 || string(existing.Body) != `{"success":true}` {
+		t.Fatalf("expected the stored response, got %+v, %v", existing, err)
+	}
+
+	existing, err = store.Reserve(ctx, domain.IdempotentRequest{Key: "key-1", Hash: "hash-3", ExpiresAt: now.Add(3 * time.Hour)}, now.Add(2*time.Hour))
+	if err != nil || existing != nil {
+		t.Fatalf("expected the expired key to be reserved again, got %+v, %v", existing, err)
+	}
+
+	if err := store.Release(ctx, "key-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	existing, err = store.Reserve(ctx, domain.IdempotentRequest{Key: "key-1", Hash: "hash-4", ExpiresAt: now.Add(3 * time.Hour)}, now.Add(2*time.Hour))
+	if err != nil || existing != nil {
+		t.Fatalf("expected the released key to be reserved again, got %+v, %v", existing, err)
+	}
+}